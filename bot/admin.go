@@ -0,0 +1,227 @@
+package bot
+
+import (
+	ctx "context"
+	"fmt"
+	"github.com/pkg/errors"
+	tele "gopkg.in/telebot.v3"
+	"strconv"
+	"strings"
+	"time"
+	"youtube-stream-notifier-bot/db"
+	"youtube-stream-notifier-bot/logging"
+	"youtube-stream-notifier-bot/metrics"
+	"youtube-stream-notifier-bot/templates"
+)
+
+var errNotSubscriptionMode = errors.New("WebSub is not used in polling mode")
+
+const (
+	// Broadcast is slower than the dispatcher allows, so stream notifications are not delayed by it
+	broadcastInterval = time.Second / 10
+	// Keeps /channel reply within the Telegram message limit
+	maxListedSubscribers = 50
+)
+
+// OperatorOnly restricts the command to the configured operators.
+// Other users get no reply, so the commands stay hidden.
+func (s *Service) OperatorOnly(next tele.HandlerFunc) tele.HandlerFunc {
+	return func(context tele.Context) error {
+		sender := context.Sender()
+		if sender == nil || !s.operators[sender.ID] {
+			return nil
+		}
+		return next(context)
+	}
+}
+
+// Stats shows the number of chats, channels and subscriptions and the YouTube quota used today
+func (s *Service) Stats(context tele.Context) error {
+	stats, err := s.db.GetStats(updateContext(context))
+	if err != nil {
+		return errors.Wrap(err, "cannot get stats")
+	}
+	return context.Send(
+		fmt.Sprintf(
+			templates.AdminStats,
+			stats.Chats,
+			stats.EnabledChats,
+			stats.Channels,
+			stats.Subscriptions,
+			metrics.YouTubeQuotaToday(),
+		),
+	)
+}
+
+// Broadcast sends the message to all enabled chats in the background and reports the result when done
+func (s *Service) Broadcast(context tele.Context) error {
+	text := strings.TrimSpace(context.Data())
+	if len(text) == 0 {
+		return context.Send(fmt.Sprintf(templates.AdminUsage, "/broadcast <message>"))
+	}
+	chats, err := s.db.ListEnabledChats(updateContext(context))
+	if err != nil {
+		return errors.Wrap(err, "cannot list enabled chats")
+	}
+	err = context.Send(fmt.Sprintf(templates.BroadcastStarted, len(chats)))
+	if err != nil {
+		return err
+	}
+	operatorChatId := context.Chat().ID
+	s.consume(func() {
+		sent, failed := s.broadcast(chats, text)
+		logger().Info("broadcast finished", "sent", sent, "failed", failed)
+		_, err := s.dispatcher.Send(s.deliveryCtx, operatorChatId, 0, fmt.Sprintf(templates.BroadcastDone, sent, failed))
+		if err != nil {
+			logger().Error("unable to report broadcast result", logging.ChatId, operatorChatId, logging.Err(err))
+		}
+	})
+	return nil
+}
+
+// broadcast sends the text to the chats one by one, it stops when the delivery is stopped
+func (s *Service) broadcast(chats []db.Chat, text string) (int, int) {
+	ticker := time.NewTicker(broadcastInterval)
+	defer ticker.Stop()
+	sent := 0
+	for i, chat := range chats {
+		if i > 0 {
+			select {
+			case <-s.deliveryCtx.Done():
+				return sent, len(chats) - sent
+			case <-ticker.C:
+			}
+		}
+		// Announcements go to the chat itself, not to its linked Telegram channel
+		chat.TelegramChannelId = nil
+		threadId := 0
+		if chat.ThreadId != nil {
+			threadId = *chat.ThreadId
+		}
+		_, err := s.dispatcher.Send(s.deliveryCtx, chat.Id, threadId, text)
+		if err != nil && errors.Is(err, errDispatcherStopped) {
+			return sent, len(chats) - sent
+		}
+		if err != nil {
+			s.handleSendError(s.deliveryCtx, chat, err)
+			continue
+		}
+		sent++
+	}
+	return sent, len(chats) - sent
+}
+
+// ChannelInfo shows the WebSub lease state and the subscribers of the channel
+func (s *Service) ChannelInfo(context tele.Context) error {
+	id := strings.TrimSpace(context.Data())
+	if len(id) == 0 {
+		return context.Send(fmt.Sprintf(templates.AdminUsage, "/channel <channel id>"))
+	}
+	ctx := updateContext(context)
+	channel, err := s.db.GetChannel(ctx, id)
+	if err != nil && errors.Is(err, db.ErrNotFound) {
+		return context.Send(fmt.Sprintf(templates.ChannelNotFound, id))
+	}
+	if err != nil {
+		return err
+	}
+	chats, err := s.db.GetSubscribedChats(ctx, id)
+	if err != nil {
+		return errors.Wrapf(err, "cannot get subscribers of channel %v", id)
+	}
+	var chatIds []string
+	for i, chat := range chats {
+		if i == maxListedSubscribers {
+			chatIds = append(chatIds, "...")
+			break
+		}
+		chatIds = append(chatIds, strconv.FormatInt(chat.Id, 10))
+	}
+	return context.Send(
+		fmt.Sprintf(
+			templates.AdminChannel,
+			channel.Title,
+			channel.Id,
+			leaseState(channel, time.Now()),
+			len(chats),
+			strings.Join(chatIds, ", "),
+		),
+	)
+}
+
+func leaseState(channel db.Channel, now time.Time) string {
+	expiresAt := leaseExpiresAt(channel)
+	if expiresAt == nil {
+		return fmt.Sprintf("not confirmed, requested at %v", channel.LastUpdate.Format(time.RFC3339))
+	}
+	if expiresAt.Before(now) {
+		return fmt.Sprintf("expired at %v", expiresAt.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("expires at %v", expiresAt.Format(time.RFC3339))
+}
+
+// leaseExpiresAt returns the end of the WebSub lease or nil if the hub has not confirmed the subscription
+func leaseExpiresAt(channel db.Channel) *time.Time {
+	if channel.LeaseSeconds == nil {
+		return nil
+	}
+	expiresAt := channel.LastUpdate.Add(time.Duration(*channel.LeaseSeconds) * time.Second)
+	return &expiresAt
+}
+
+// Resubscribe renews the WebSub subscription to the channel without waiting for the lease to expire
+func (s *Service) Resubscribe(context tele.Context) error {
+	id := strings.TrimSpace(context.Data())
+	if len(id) == 0 {
+		return context.Send(fmt.Sprintf(templates.AdminUsage, "/resubscribe <channel id>"))
+	}
+	err := s.resubscribe(updateContext(context), id)
+	if err != nil && errors.Is(err, errNotSubscriptionMode) {
+		return context.Send(templates.NotSubscriptionMode)
+	}
+	if err != nil && errors.Is(err, db.ErrNotFound) {
+		return context.Send(fmt.Sprintf(templates.ChannelNotFound, id))
+	}
+	if err != nil {
+		return err
+	}
+	return context.Send(fmt.Sprintf(templates.ResubscribeSuccess, id))
+}
+
+// resubscribe sends a subscription request for the known channel to the hub
+func (s *Service) resubscribe(ctx ctx.Context, channelId string) error {
+	if s.callbackURL == nil {
+		return errNotSubscriptionMode
+	}
+	_, err := s.db.GetChannel(ctx, channelId)
+	if err != nil {
+		return err
+	}
+	err = subscribe(s.hubURL, feedCallbackURL(*s.callbackURL), channelId)
+	if err != nil {
+		return errors.Wrapf(err, "cannot resubscribe to channel %v", channelId)
+	}
+	return nil
+}
+
+// DisableChat stops notifications to the chat until it is started again
+func (s *Service) DisableChat(context tele.Context) error {
+	id, err := strconv.ParseInt(strings.TrimSpace(context.Data()), 10, 64)
+	if err != nil {
+		return context.Send(fmt.Sprintf(templates.AdminUsage, "/disable <chat id>"))
+	}
+	ctx := updateContext(context)
+	_, err = s.db.GetChat(ctx, id)
+	if err != nil && errors.Is(err, db.ErrNotFound) {
+		return context.Send(fmt.Sprintf(templates.ChatNotFound, id))
+	}
+	if err != nil {
+		return err
+	}
+	err = s.db.SetChatEnabled(ctx, id, false)
+	if err != nil {
+		return errors.Wrapf(err, "cannot disable chat %v", id)
+	}
+	logger().Info("chat disabled by operator", logging.ChatId, id, "operator_id", context.Sender().ID)
+	return context.Send(fmt.Sprintf(templates.ChatDisabled, id))
+}
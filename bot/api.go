@@ -0,0 +1,640 @@
+package bot
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"youtube-stream-notifier-bot/db"
+	"youtube-stream-notifier-bot/logging"
+	"youtube-stream-notifier-bot/youtube"
+)
+
+const (
+	apiPathPrefix   = "/api"
+	defaultAPILimit = 100
+	maxAPILimit     = 1000
+	// Channel ids are accepted by the API as well as channel urls
+	channelURLFormat = "https://www.youtube.com/channel/%v"
+)
+
+type apiChat struct {
+	Id                int64   `json:"id"`
+	Enabled           bool    `json:"enabled"`
+	TimeZone          *string `json:"timeZone,omitempty"`
+	TelegramChannelId *int64  `json:"telegramChannelId,omitempty"`
+	ThreadId          *int    `json:"threadId,omitempty"`
+}
+
+type apiLease struct {
+	Confirmed bool       `json:"confirmed"`
+	Expired   bool       `json:"expired"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	// Time of the last subscription request or confirmation
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type apiChannel struct {
+	Id    string   `json:"id"`
+	Title string   `json:"title"`
+	Lease apiLease `json:"lease"`
+	// Filled only for a single channel
+	Subscribers []int64 `json:"subscribers,omitempty"`
+	// Filled only for the subscriptions of a chat
+	ThreadId *int        `json:"threadId,omitempty"`
+	Webhook  *apiWebhook `json:"webhook,omitempty"`
+}
+
+type apiLeases struct {
+	Expired  int          `json:"expired"`
+	Channels []apiChannel `json:"channels"`
+}
+
+type apiStream struct {
+	Id           string            `json:"id"`
+	State        db.StreamState    `json:"state"`
+	DoneUpcoming bool              `json:"doneUpcoming"`
+	DoneLive     bool              `json:"doneLive"`
+	UpdatedAt    time.Time         `json:"updatedAt"`
+	Deliveries   []apiDeliveryStat `json:"deliveries,omitempty"`
+}
+
+type apiDeliveryStat struct {
+	Target db.DeliveryTarget `json:"target"`
+	State  db.StreamState    `json:"state"`
+	Status db.DeliveryStatus `json:"status"`
+	Count  int               `json:"count"`
+}
+
+type apiAddSubscription struct {
+	// YouTube channel id or any url accepted by /add
+	Channel  string `json:"channel"`
+	ThreadId *int   `json:"threadId,omitempty"`
+}
+
+type apiWebhook struct {
+	Id        int64  `json:"id"`
+	ChatId    int64  `json:"chatId"`
+	ChannelId string `json:"channelId"`
+	URL       string `json:"url"`
+	// Returned only when the webhook is set
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type apiSetWebhook struct {
+	URL string `json:"url"`
+	// Generated if empty
+	Secret string `json:"secret,omitempty"`
+}
+
+type apiDeadLetter struct {
+	Id        int64          `json:"id"`
+	WebhookId int64          `json:"webhookId"`
+	StreamId  string         `json:"streamId"`
+	State     db.StreamState `json:"state"`
+	Payload   string         `json:"payload"`
+	Error     string         `json:"error"`
+	Attempts  int            `json:"attempts"`
+	CreatedAt time.Time      `json:"createdAt"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// registerAPI serves the admin JSON API under /api, every request must carry the bearer token
+func (s *Service) registerAPI(router *mux.Router, token string) {
+	api := router.PathPrefix(apiPathPrefix).Subrouter()
+	api.Use(bearerAuth(token))
+	api.Methods(http.MethodGet).Path("/chats").HandlerFunc(s.apiListChats)
+	api.Methods(http.MethodGet).Path("/chats/{id}").HandlerFunc(s.apiGetChat)
+	api.Methods(http.MethodGet).Path("/chats/{id}/subscriptions").HandlerFunc(s.apiListSubscriptions)
+	api.Methods(http.MethodPost).Path("/chats/{id}/subscriptions").HandlerFunc(s.apiAddSubscription)
+	api.Methods(http.MethodDelete).Path("/chats/{id}/subscriptions/{channelId}").HandlerFunc(s.apiRemoveSubscription)
+	api.Methods(http.MethodPut).Path("/chats/{id}/subscriptions/{channelId}/webhook").HandlerFunc(s.apiSetWebhook)
+	api.Methods(http.MethodDelete).Path("/chats/{id}/subscriptions/{channelId}/webhook").HandlerFunc(s.apiRemoveWebhook)
+	api.Methods(http.MethodGet).Path("/channels").HandlerFunc(s.apiListChannels)
+	api.Methods(http.MethodGet).Path("/channels/{channelId}").HandlerFunc(s.apiGetChannel)
+	api.Methods(http.MethodPost).Path("/channels/{channelId}/resubscribe").HandlerFunc(s.apiResubscribe)
+	api.Methods(http.MethodGet).Path("/leases").HandlerFunc(s.apiListLeases)
+	api.Methods(http.MethodGet).Path("/streams").HandlerFunc(s.apiListStreams)
+	api.Methods(http.MethodGet).Path("/streams/{streamId}").HandlerFunc(s.apiGetStream)
+	api.Methods(http.MethodGet).Path("/webhooks").HandlerFunc(s.apiListWebhooks)
+	api.Methods(http.MethodGet).Path("/dead-letters").HandlerFunc(s.apiListDeadLetters)
+	api.Methods(http.MethodPost).Path("/dead-letters/{deadLetterId}/retry").HandlerFunc(s.apiRetryDeadLetter)
+	api.Methods(http.MethodDelete).Path("/dead-letters/{deadLetterId}").HandlerFunc(s.apiRemoveDeadLetter)
+}
+
+func bearerAuth(token string) mux.MiddlewareFunc {
+	expected := []byte("Bearer " + token)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			actual := []byte(request.Header.Get("Authorization"))
+			if subtle.ConstantTimeCompare(actual, expected) != 1 {
+				writeAPIError(writer, http.StatusUnauthorized, errors.New("invalid token"))
+				return
+			}
+			next.ServeHTTP(writer, request)
+		})
+	}
+}
+
+func (s *Service) apiListChats(writer http.ResponseWriter, request *http.Request) {
+	limit, offset, err := pagination(request)
+	if err != nil {
+		writeAPIError(writer, http.StatusBadRequest, err)
+		return
+	}
+	chats, err := s.db.ListChats(request.Context(), limit, offset)
+	if err != nil {
+		writeAPIError(writer, http.StatusInternalServerError, err)
+		return
+	}
+	response := make([]apiChat, 0, len(chats))
+	for _, chat := range chats {
+		response = append(response, toAPIChat(chat))
+	}
+	writeAPIResponse(writer, http.StatusOK, response)
+}
+
+func (s *Service) apiGetChat(writer http.ResponseWriter, request *http.Request) {
+	chat, ok := s.apiChat(writer, request)
+	if !ok {
+		return
+	}
+	writeAPIResponse(writer, http.StatusOK, toAPIChat(chat))
+}
+
+func (s *Service) apiListSubscriptions(writer http.ResponseWriter, request *http.Request) {
+	chat, ok := s.apiChat(writer, request)
+	if !ok {
+		return
+	}
+	channels, err := s.db.GetSubscribedChannels(request.Context(), chat.Id)
+	if err != nil {
+		writeAPIError(writer, http.StatusInternalServerError, err)
+		return
+	}
+	webhooks, err := s.db.GetChatWebhooks(request.Context(), chat.Id)
+	if err != nil {
+		writeAPIError(writer, http.StatusInternalServerError, err)
+		return
+	}
+	channelWebhooks := map[string]apiWebhook{}
+	for _, webhook := range webhooks {
+		channelWebhooks[webhook.ChannelId] = toAPIWebhook(webhook)
+	}
+	response := make([]apiChannel, 0, len(channels))
+	for _, channel := range channels {
+		apiChannel := toAPIChannel(channel, time.Now())
+		apiChannel.ThreadId = channel.SubscriptionThreadId
+		if webhook, ok := channelWebhooks[channel.Id]; ok {
+			apiChannel.Webhook = &webhook
+		}
+		response = append(response, apiChannel)
+	}
+	writeAPIResponse(writer, http.StatusOK, response)
+}
+
+func (s *Service) apiAddSubscription(writer http.ResponseWriter, request *http.Request) {
+	chat, ok := s.apiChat(writer, request)
+	if !ok {
+		return
+	}
+	var body apiAddSubscription
+	err := json.NewDecoder(request.Body).Decode(&body)
+	if err != nil {
+		writeAPIError(writer, http.StatusBadRequest, errors.Wrap(err, "invalid body"))
+		return
+	}
+	channel, ok := s.apiFindChannel(writer, request, body.Channel)
+	if !ok {
+		return
+	}
+	err = s.subscribeChat(request.Context(), chat.Id, channel, body.ThreadId)
+	if err != nil {
+		writeAPIError(writer, http.StatusInternalServerError, err)
+		return
+	}
+	stored, err := s.db.GetChannel(request.Context(), channel.Id)
+	if err != nil {
+		writeAPIError(writer, http.StatusInternalServerError, err)
+		return
+	}
+	response := toAPIChannel(stored, time.Now())
+	response.ThreadId = body.ThreadId
+	writeAPIResponse(writer, http.StatusCreated, response)
+}
+
+func (s *Service) apiRemoveSubscription(writer http.ResponseWriter, request *http.Request) {
+	chat, ok := s.apiChat(writer, request)
+	if !ok {
+		return
+	}
+	err := s.RemoveSubscription(request.Context(), chat.Id, mux.Vars(request)["channelId"])
+	if err != nil {
+		writeAPIError(writer, http.StatusInternalServerError, err)
+		return
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Service) apiListChannels(writer http.ResponseWriter, request *http.Request) {
+	limit, offset, err := pagination(request)
+	if err != nil {
+		writeAPIError(writer, http.StatusBadRequest, err)
+		return
+	}
+	channels, err := s.db.ListChannels(request.Context(), limit, offset)
+	if err != nil {
+		writeAPIError(writer, http.StatusInternalServerError, err)
+		return
+	}
+	now := time.Now()
+	response := make([]apiChannel, 0, len(channels))
+	for _, channel := range channels {
+		response = append(response, toAPIChannel(channel, now))
+	}
+	writeAPIResponse(writer, http.StatusOK, response)
+}
+
+func (s *Service) apiGetChannel(writer http.ResponseWriter, request *http.Request) {
+	id := mux.Vars(request)["channelId"]
+	channel, err := s.db.GetChannel(request.Context(), id)
+	if err != nil && errors.Is(err, db.ErrNotFound) {
+		writeAPIError(writer, http.StatusNotFound, errors.Errorf("channel %v is not found", id))
+		return
+	}
+	if err != nil {
+		writeAPIError(writer, http.StatusInternalServerError, err)
+		return
+	}
+	chats, err := s.db.GetSubscribedChats(request.Context(), id)
+	if err != nil {
+		writeAPIError(writer, http.StatusInternalServerError, err)
+		return
+	}
+	response := toAPIChannel(channel, time.Now())
+	response.Subscribers = make([]int64, 0, len(chats))
+	for _, chat := range chats {
+		response.Subscribers = append(response.Subscribers, chat.Id)
+	}
+	writeAPIResponse(writer, http.StatusOK, response)
+}
+
+func (s *Service) apiResubscribe(writer http.ResponseWriter, request *http.Request) {
+	id := mux.Vars(request)["channelId"]
+	err := s.resubscribe(request.Context(), id)
+	if err != nil && errors.Is(err, errNotSubscriptionMode) {
+		writeAPIError(writer, http.StatusConflict, err)
+		return
+	}
+	if err != nil && errors.Is(err, db.ErrNotFound) {
+		writeAPIError(writer, http.StatusNotFound, errors.Errorf("channel %v is not found", id))
+		return
+	}
+	if err != nil {
+		writeAPIError(writer, http.StatusBadGateway, err)
+		return
+	}
+	writer.WriteHeader(http.StatusAccepted)
+}
+
+// apiListLeases shows the leases of the channels with subscribers, only they are renewed
+func (s *Service) apiListLeases(writer http.ResponseWriter, request *http.Request) {
+	channels, err := s.db.ListActiveChannels(request.Context())
+	if err != nil {
+		writeAPIError(writer, http.StatusInternalServerError, err)
+		return
+	}
+	now := time.Now()
+	response := apiLeases{Channels: make([]apiChannel, 0, len(channels))}
+	for _, channel := range channels {
+		apiChannel := toAPIChannel(channel, now)
+		if apiChannel.Lease.Expired {
+			response.Expired++
+		}
+		response.Channels = append(response.Channels, apiChannel)
+	}
+	writeAPIResponse(writer, http.StatusOK, response)
+}
+
+func (s *Service) apiListStreams(writer http.ResponseWriter, request *http.Request) {
+	limit, offset, err := pagination(request)
+	if err != nil {
+		writeAPIError(writer, http.StatusBadRequest, err)
+		return
+	}
+	streams, err := s.db.ListStreams(request.Context(), limit, offset)
+	if err != nil {
+		writeAPIError(writer, http.StatusInternalServerError, err)
+		return
+	}
+	response := make([]apiStream, 0, len(streams))
+	for _, stream := range streams {
+		response = append(response, toAPIStream(stream))
+	}
+	writeAPIResponse(writer, http.StatusOK, response)
+}
+
+func (s *Service) apiGetStream(writer http.ResponseWriter, request *http.Request) {
+	id := mux.Vars(request)["streamId"]
+	stream, err := s.db.GetStream(request.Context(), id)
+	if err != nil && errors.Is(err, db.ErrNotFound) {
+		writeAPIError(writer, http.StatusNotFound, errors.Errorf("stream %v is not found", id))
+		return
+	}
+	if err != nil {
+		writeAPIError(writer, http.StatusInternalServerError, err)
+		return
+	}
+	stats, err := s.db.GetDeliveryStats(request.Context(), id)
+	if err != nil {
+		writeAPIError(writer, http.StatusInternalServerError, err)
+		return
+	}
+	response := toAPIStream(stream)
+	for _, stat := range stats {
+		response.Deliveries = append(
+			response.Deliveries,
+			apiDeliveryStat{Target: stat.Target, State: stat.State, Status: stat.Status, Count: stat.Count},
+		)
+	}
+	writeAPIResponse(writer, http.StatusOK, response)
+}
+
+// apiFindChannel finds the channel by id or url, the error response is written if it fails
+func (s *Service) apiFindChannel(writer http.ResponseWriter, request *http.Request, data string) (youtube.ChannelInfo, bool) {
+	data = strings.TrimSpace(data)
+	if len(data) == 0 {
+		writeAPIError(writer, http.StatusBadRequest, errors.New("channel is required"))
+		return youtube.ChannelInfo{}, false
+	}
+	if !strings.Contains(data, "/") {
+		data = fmt.Sprintf(channelURLFormat, data)
+	}
+	channel, err := s.youtube.FindChannel(request.Context(), data)
+	if err != nil && (errors.Is(err, youtube.ErrBadUrl) || errors.Is(err, youtube.ErrUnsupportedUrl)) {
+		writeAPIError(writer, http.StatusBadRequest, err)
+		return youtube.ChannelInfo{}, false
+	}
+	if err != nil {
+		writeAPIError(writer, http.StatusBadGateway, err)
+		return youtube.ChannelInfo{}, false
+	}
+	return channel, true
+}
+
+func (s *Service) apiListWebhooks(writer http.ResponseWriter, request *http.Request) {
+	limit, offset, err := pagination(request)
+	if err != nil {
+		writeAPIError(writer, http.StatusBadRequest, err)
+		return
+	}
+	webhooks, err := s.db.ListWebhooks(request.Context(), limit, offset)
+	if err != nil {
+		writeAPIError(writer, http.StatusInternalServerError, err)
+		return
+	}
+	response := make([]apiWebhook, 0, len(webhooks))
+	for _, webhook := range webhooks {
+		response = append(response, toAPIWebhook(webhook))
+	}
+	writeAPIResponse(writer, http.StatusOK, response)
+}
+
+// apiSetWebhook attaches the webhook to the chat subscription, the secret is shown only here
+func (s *Service) apiSetWebhook(writer http.ResponseWriter, request *http.Request) {
+	chat, ok := s.apiChat(writer, request)
+	if !ok {
+		return
+	}
+	var body apiSetWebhook
+	err := json.NewDecoder(request.Body).Decode(&body)
+	if err != nil {
+		writeAPIError(writer, http.StatusBadRequest, errors.Wrap(err, "invalid body"))
+		return
+	}
+	if !validWebhookURL(body.URL, false) {
+		writeAPIError(writer, http.StatusBadRequest, errors.New("url must be an absolute http or https URL"))
+		return
+	}
+	channelId := mux.Vars(request)["channelId"]
+	webhook, err := s.setWebhook(request.Context(), chat.Id, channelId, body.URL, body.Secret)
+	if err != nil && errors.Is(err, errNotSubscribed) {
+		writeAPIError(writer, http.StatusNotFound, errors.Errorf("chat %v is not subscribed to channel %v", chat.Id, channelId))
+		return
+	}
+	if err != nil {
+		writeAPIError(writer, http.StatusInternalServerError, err)
+		return
+	}
+	response := toAPIWebhook(webhook)
+	response.Secret = webhook.Secret
+	writeAPIResponse(writer, http.StatusOK, response)
+}
+
+func (s *Service) apiRemoveWebhook(writer http.ResponseWriter, request *http.Request) {
+	chat, ok := s.apiChat(writer, request)
+	if !ok {
+		return
+	}
+	channelId := mux.Vars(request)["channelId"]
+	err := s.db.RemoveWebhook(request.Context(), chat.Id, channelId)
+	if err != nil && errors.Is(err, db.ErrNotFound) {
+		writeAPIError(writer, http.StatusNotFound, errors.Errorf("subscription of chat %v to channel %v has no webhook", chat.Id, channelId))
+		return
+	}
+	if err != nil {
+		writeAPIError(writer, http.StatusInternalServerError, err)
+		return
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Service) apiListDeadLetters(writer http.ResponseWriter, request *http.Request) {
+	limit, offset, err := pagination(request)
+	if err != nil {
+		writeAPIError(writer, http.StatusBadRequest, err)
+		return
+	}
+	letters, err := s.db.ListDeadLetters(request.Context(), limit, offset)
+	if err != nil {
+		writeAPIError(writer, http.StatusInternalServerError, err)
+		return
+	}
+	response := make([]apiDeadLetter, 0, len(letters))
+	for _, letter := range letters {
+		response = append(response, toAPIDeadLetter(letter))
+	}
+	writeAPIResponse(writer, http.StatusOK, response)
+}
+
+// apiRetryDeadLetter sends the event once more, the dead letter is kept if the webhook fails again
+func (s *Service) apiRetryDeadLetter(writer http.ResponseWriter, request *http.Request) {
+	letter, ok := s.apiDeadLetter(writer, request)
+	if !ok {
+		return
+	}
+	err := s.webhooks.redeliver(request.Context(), letter)
+	if err != nil && errors.Is(err, db.ErrNotFound) {
+		writeAPIError(writer, http.StatusNotFound, errors.Errorf("webhook %v is not found", letter.WebhookId))
+		return
+	}
+	if err != nil {
+		writeAPIError(writer, http.StatusBadGateway, err)
+		return
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Service) apiRemoveDeadLetter(writer http.ResponseWriter, request *http.Request) {
+	letter, ok := s.apiDeadLetter(writer, request)
+	if !ok {
+		return
+	}
+	err := s.db.RemoveDeadLetter(request.Context(), letter.Id)
+	if err != nil {
+		writeAPIError(writer, http.StatusInternalServerError, err)
+		return
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+// apiDeadLetter gets the dead letter from the path, the error response is written if it fails
+func (s *Service) apiDeadLetter(writer http.ResponseWriter, request *http.Request) (db.DeadLetter, bool) {
+	id, err := strconv.ParseInt(mux.Vars(request)["deadLetterId"], 10, 64)
+	if err != nil {
+		writeAPIError(writer, http.StatusBadRequest, errors.Wrap(err, "invalid dead letter id"))
+		return db.DeadLetter{}, false
+	}
+	letter, err := s.db.GetDeadLetter(request.Context(), id)
+	if err != nil && errors.Is(err, db.ErrNotFound) {
+		writeAPIError(writer, http.StatusNotFound, errors.Errorf("dead letter %v is not found", id))
+		return db.DeadLetter{}, false
+	}
+	if err != nil {
+		writeAPIError(writer, http.StatusInternalServerError, err)
+		return db.DeadLetter{}, false
+	}
+	return letter, true
+}
+
+// apiChat gets the chat from the path, the error response is written if it fails
+func (s *Service) apiChat(writer http.ResponseWriter, request *http.Request) (db.Chat, bool) {
+	id, err := strconv.ParseInt(mux.Vars(request)["id"], 10, 64)
+	if err != nil {
+		writeAPIError(writer, http.StatusBadRequest, errors.Wrap(err, "invalid chat id"))
+		return db.Chat{}, false
+	}
+	chat, err := s.db.GetChat(request.Context(), id)
+	if err != nil && errors.Is(err, db.ErrNotFound) {
+		writeAPIError(writer, http.StatusNotFound, errors.Errorf("chat %v is not found", id))
+		return db.Chat{}, false
+	}
+	if err != nil {
+		writeAPIError(writer, http.StatusInternalServerError, err)
+		return db.Chat{}, false
+	}
+	return chat, true
+}
+
+func pagination(request *http.Request) (int, int, error) {
+	limit := defaultAPILimit
+	offset := 0
+	query := request.URL.Query()
+	if value := query.Get("limit"); len(value) > 0 {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 || parsed > maxAPILimit {
+			return 0, 0, errors.Errorf("limit must be between 1 and %v", maxAPILimit)
+		}
+		limit = parsed
+	}
+	if value := query.Get("offset"); len(value) > 0 {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			return 0, 0, errors.New("offset must not be negative")
+		}
+		offset = parsed
+	}
+	return limit, offset, nil
+}
+
+func toAPIChat(chat db.Chat) apiChat {
+	return apiChat{
+		Id:                chat.Id,
+		Enabled:           chat.Enabled,
+		TimeZone:          chat.TimeZone,
+		TelegramChannelId: chat.TelegramChannelId,
+		ThreadId:          chat.ThreadId,
+	}
+}
+
+func toAPIChannel(channel db.Channel, now time.Time) apiChannel {
+	expiresAt := leaseExpiresAt(channel)
+	return apiChannel{
+		Id:    channel.Id,
+		Title: channel.Title,
+		Lease: apiLease{
+			Confirmed: expiresAt != nil,
+			Expired:   expiresAt != nil && expiresAt.Before(now),
+			ExpiresAt: expiresAt,
+			UpdatedAt: channel.LastUpdate,
+		},
+	}
+}
+
+func toAPIStream(stream db.DoneStream) apiStream {
+	return apiStream{
+		Id:           stream.Id,
+		State:        stream.State,
+		DoneUpcoming: stream.DoneUpcoming,
+		DoneLive:     stream.DoneLive,
+		UpdatedAt:    stream.UpdatedAt,
+	}
+}
+
+func toAPIWebhook(webhook db.Webhook) apiWebhook {
+	return apiWebhook{
+		Id:        webhook.Id,
+		ChatId:    webhook.ChatId,
+		ChannelId: webhook.ChannelId,
+		URL:       webhook.URL,
+		CreatedAt: webhook.CreatedAt,
+	}
+}
+
+func toAPIDeadLetter(letter db.DeadLetter) apiDeadLetter {
+	return apiDeadLetter{
+		Id:        letter.Id,
+		WebhookId: letter.WebhookId,
+		StreamId:  letter.StreamId,
+		State:     letter.State,
+		Payload:   letter.Payload,
+		Error:     letter.Error,
+		Attempts:  letter.Attempts,
+		CreatedAt: letter.CreatedAt,
+	}
+}
+
+func writeAPIResponse(writer http.ResponseWriter, status int, response interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	err := json.NewEncoder(writer).Encode(response)
+	if err != nil {
+		logger().Warn("unable to write api response", logging.Err(err))
+	}
+}
+
+func writeAPIError(writer http.ResponseWriter, status int, err error) {
+	if status >= http.StatusInternalServerError {
+		logger().Error("api request failed", logging.Err(err))
+	}
+	writeAPIResponse(writer, status, apiError{Error: err.Error()})
+}
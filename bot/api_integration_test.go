@@ -0,0 +1,59 @@
+//go:build integration
+
+package bot
+
+import (
+	ctx "context"
+	"github.com/gorilla/mux"
+	tele "gopkg.in/telebot.v3"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"youtube-stream-notifier-bot/db"
+	"youtube-stream-notifier-bot/mutex"
+	"youtube-stream-notifier-bot/youtube"
+)
+
+// TestAPIUnknownChannel checks the not found mapping of the Postgres storage, see the db package tests for the setup
+func TestAPIUnknownChannel(t *testing.T) {
+	address := os.Getenv("TEST_POSTGRES_ADDRESS")
+	if len(address) == 0 {
+		address = "localhost:5432"
+	}
+	storage := db.New(address, "bot", "makelovenotwar", "bot")
+	defer storage.Close()
+	err := storage.Migrate(ctx.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	callback := "https://example.com"
+	service := NewService(
+		newFakeYouTube(),
+		storage,
+		mutex.NewBuilder(mutex.NewMemoryLocker()),
+		&fakeTimeZones{zone: "Europe/Amsterdam"},
+		newFakeTelegram(),
+		&tele.User{ID: 1, Username: "notifier_bot"},
+		&callback,
+		youtube.HubYouTubeURL,
+		nil,
+		false,
+		4,
+		nil,
+	)
+	router := mux.NewRouter()
+	service.registerAPI(router, "token")
+
+	for _, request := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/api/channels/UCmissingChannelForTests", nil),
+		httptest.NewRequest(http.MethodPost, "/api/channels/UCmissingChannelForTests/resubscribe", nil),
+	} {
+		request.Header.Set("Authorization", "Bearer token")
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusNotFound {
+			t.Fatalf("%v %v: expected not found, got %v %v", request.Method, request.URL, recorder.Code, recorder.Body)
+		}
+	}
+}
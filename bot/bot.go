@@ -5,13 +5,17 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
 	tele "gopkg.in/telebot.v3"
-	"log"
+	"log/slog"
 	"net/http"
+	"os"
 	"time"
 	"youtube-stream-notifier-bot/db"
+	"youtube-stream-notifier-bot/logging"
+	"youtube-stream-notifier-bot/metrics"
 	"youtube-stream-notifier-bot/mutex"
 	"youtube-stream-notifier-bot/templates"
 	"youtube-stream-notifier-bot/timezone"
+	"youtube-stream-notifier-bot/tracing"
 	"youtube-stream-notifier-bot/youtube"
 )
 
@@ -23,6 +27,19 @@ const (
 	RedisAddress = "redis:6379"
 )
 
+const (
+	defaultShutdownTimeout = time.Second * 20
+	tracingShutdownTimeout = time.Second * 5
+	// HTTP requests in flight get this long after the notifications are drained
+	serverShutdownTimeout = time.Second * 5
+)
+
+const (
+	LockBackendRedis    = "redis"
+	LockBackendPostgres = "postgres"
+	LockBackendMemory   = "memory"
+)
+
 type Config struct {
 	// YouTube Data API key
 	YoutubeAPIKey string `json:"youtubeAPIKey,omitempty"`
@@ -30,33 +47,204 @@ type Config struct {
 	TelegramBotToken string `json:"telegramBotToken,omitempty"`
 	// timezonedb.com token for getting time zone by location
 	TimeZoneDBToken string `json:"timeZoneDBToken"`
-	// Host with port that is pointing to this server
+	// Host with port that is pointing to this server, the hub calls back http://<host>/video
 	// Optional
-	// If missing, search.list method will be used (limited to 100 request per day)
+	// If missing and callbackURL is missing too, search.list method will be used (limited to 100 request per day)
 	Host *string `json:"host,omitempty"`
-	// Enable debug. Currently only turns on SQL output
+	// Base URL the hub calls back (scheme, host and path prefix), e.g. https://example.com/notifier,
+	// the callback is <callbackURL>/video. It takes precedence over host
+	// Optional
+	CallbackURL string `json:"callbackURL,omitempty"`
+	// Address the HTTP server listens on
+	// Optional
+	// If missing, :42069 is used, or :443 with autocertDomains
+	ListenAddress string `json:"listenAddress,omitempty"`
+	// Certificate and key files, the server uses HTTPS when they are set
+	// Optional
+	TLSCertFile string `json:"tlsCertFile,omitempty"`
+	TLSKeyFile  string `json:"tlsKeyFile,omitempty"`
+	// Domains to obtain Let's Encrypt certificates for, the server uses HTTPS with them.
+	// The server must be reachable on port 443 of these domains
+	// Optional
+	AutocertDomains []string `json:"autocertDomains,omitempty"`
+	// Directory where obtained certificates are kept between restarts
+	// Optional
+	// If missing, ./certs is used
+	AutocertCacheDir string `json:"autocertCacheDir,omitempty"`
+	// Contact email for Let's Encrypt
+	// Optional
+	AutocertEmail string `json:"autocertEmail,omitempty"`
+	// Enable debug. Logs SQL queries and lowers the log level to debug unless logLevel is set
 	Debug bool `json:"debug,omitempty"`
+	// Log level: "debug", "info", "warn" or "error"
+	// Optional
+	// If missing, info is used
+	LogLevel string `json:"logLevel,omitempty"`
+	// Log format: "text" or "json"
+	// Optional
+	// If missing, text is used
+	LogFormat string `json:"logFormat,omitempty"`
+	// Allow any member of a group to add and remove channels
+	// Optional
+	// If missing, only group administrators can manage subscriptions
+	GroupMembersCanManage bool `json:"groupMembersCanManage,omitempty"`
+	// Bearer token of the admin JSON API served under /api
+	// Optional
+	// If missing, the API is disabled
+	APIToken string `json:"apiToken,omitempty"`
+	// Telegram user ids of operators allowed to use /stats, /broadcast, /channel, /resubscribe and /disable
+	// Optional
+	// If missing, the commands are disabled
+	OperatorIds []int64 `json:"operatorIds,omitempty"`
+	// Number of workers sending notifications about a stream in parallel
+	// Optional
+	// If missing, 32 workers are used
+	NotificationWorkers int `json:"notificationWorkers,omitempty"`
+	// Lock backend: "redis", "postgres" or "memory"
+	// Optional
+	// If missing, Redis is used. Memory locks are only suitable for a single instance
+	LockBackend string `json:"lockBackend,omitempty"`
+	// Base URL of YouTube Data API
+	// Optional
+	// If missing, https://youtube.googleapis.com/ is used
+	YoutubeAPIURL string `json:"youtubeAPIURL,omitempty"`
+	// WebSub hub subscribe URL
+	// Optional
+	// If missing, https://pubsubhubbub.appspot.com/subscribe is used
+	HubURL string `json:"hubURL,omitempty"`
+	// Tracing exporter: "otlp" or "stdout"
+	// Optional
+	// If missing, tracing is disabled
+	TracingExporter string `json:"tracingExporter,omitempty"`
+	// OTLP HTTP endpoint (host:port) for the otlp exporter
+	// Optional
+	// If missing, OTEL_EXPORTER_OTLP_ENDPOINT or localhost:4318 is used
+	TracingEndpoint string `json:"tracingEndpoint,omitempty"`
+	// Time given to in-flight notifications on shutdown, the rest is saved to the outbox
+	// Optional
+	// If missing, 20 seconds are used
+	ShutdownTimeoutSeconds int `json:"shutdownTimeoutSeconds,omitempty"`
+	// Telegram updates mode: "polling" or "webhook"
+	// Optional
+	// If missing, long polling is used. Webhook mode allows running several replicas behind a load balancer
+	TelegramUpdates string `json:"telegramUpdates,omitempty"`
+	// Public HTTPS URL that is routed to /telegram of this server
+	// Required in webhook mode
+	TelegramWebhookURL string `json:"telegramWebhookURL,omitempty"`
+	// Secret token Telegram sends with every webhook request
+	// Optional
+	// If missing, it is derived from the bot token, so all replicas use the same secret
+	TelegramWebhookSecret string `json:"telegramWebhookSecret,omitempty"`
+	// Public base URL of this server used in /calendar links, e.g. https://example.com/notifier
+	// Optional
+	// If missing, the callback base URL is used. Without both calendars are disabled
+	CalendarURL string `json:"calendarURL,omitempty"`
+}
+
+func logger() *slog.Logger {
+	return logging.For("bot")
+}
+
+// SetupLogging configures the default logger used by all components
+func SetupLogging(config Config) error {
+	level := config.LogLevel
+	if len(level) == 0 && config.Debug {
+		level = slog.LevelDebug.String()
+	}
+	return logging.Setup(os.Stderr, level, config.LogFormat)
+}
+
+func hubURL(configured string) string {
+	if len(configured) > 0 {
+		return configured
+	}
+	return youtube.HubYouTubeURL
+}
+
+func newLocker(backend string, dbService *db.DB) (mutex.Locker, error) {
+	switch backend {
+	case "", LockBackendRedis:
+		return mutex.NewRedisLocker(RedisAddress), nil
+	case LockBackendPostgres:
+		return mutex.NewPostgresLocker(dbService.SQL()), nil
+	case LockBackendMemory:
+		return mutex.NewMemoryLocker(), nil
+	}
+	return nil, errors.Errorf("unknown lock backend: %v", backend)
+}
+
+func readinessChecks(callback *string, dbService *db.DB, mutexBuilder *mutex.Builder, bot *tele.Bot) []readinessCheck {
+	checks := []readinessCheck{
+		{name: "postgres", check: dbService.Ping},
+		{name: "locks", check: mutexBuilder.Ping},
+		{
+			name: "telegram", check: func(context.Context) error {
+				_, err := bot.Raw("getMe", nil)
+				return err
+			},
+		},
+	}
+	// Leases are only used in subscription mode
+	if callback != nil {
+		checks = append(checks, readinessCheck{name: "websub", check: leasesCheck(dbService.CountExpiredLeases)})
+	}
+	return checks
 }
 
 func Start(ctx context.Context, config Config, confirm chan<- struct{}) error {
-	ytService, err := youtube.NewService(config.YoutubeAPIKey)
+	callback, err := callbackURL(config)
+	if err != nil {
+		return err
+	}
+	calendar, err := calendarURL(config, callback)
+	if err != nil {
+		return err
+	}
+	shutdownTracing, err := tracing.Setup(ctx, config.TracingExporter, config.TracingEndpoint)
+	if err != nil {
+		return err
+	}
+
+	ytService, err := youtube.NewService(ctx, config.YoutubeAPIKey, config.YoutubeAPIURL)
 	if err != nil {
 		return err
 	}
 
 	dbService := db.New(DBAddress, DBUser, DBPassword, DB)
+	err = dbService.Migrate(ctx)
+	if err != nil {
+		return err
+	}
 
-	mutexBuilder := mutex.NewBuilder(RedisAddress)
+	locker, err := newLocker(config.LockBackend, dbService)
+	if err != nil {
+		return err
+	}
+	mutexBuilder := mutex.NewBuilder(locker)
 	if config.Debug {
 		dbService.EnableDebug()
 	}
 
 	tz := timezone.NewService(config.TimeZoneDBToken)
 
+	poller, err := newPoller(config)
+	if err != nil {
+		return err
+	}
 	s := tele.Settings{
-		Token: config.TelegramBotToken,
-		Poller: &tele.LongPoller{
-			Timeout: time.Second * 10,
+		Token:  config.TelegramBotToken,
+		Poller: poller,
+		OnError: func(err error, context tele.Context) {
+			if context == nil || context.Chat() == nil {
+				logger().Error("bot error", logging.Err(err))
+				return
+			}
+			l := logger().With(logging.ChatId, context.Chat().ID)
+			l.Error("unable to handle update", logging.Err(err))
+			err = context.Send(templates.UnexpectedError)
+			if err != nil {
+				l.Error("unable to send error message", logging.Err(err))
+			}
 		},
 	}
 	bot, err := tele.NewBot(s)
@@ -70,19 +258,43 @@ func Start(ctx context.Context, config Config, confirm chan<- struct{}) error {
 		mutexBuilder,
 		tz,
 		bot,
-		config.Host,
+		bot.Me,
+		callback,
+		hubURL(config.HubURL),
+		calendar,
+		config.GroupMembersCanManage,
+		config.NotificationWorkers,
+		config.OperatorIds,
 	)
 
+	bot.Use(withUpdateContext)
 	bot.Handle("/start", botService.Start)
-	bot.Handle("/add", botService.AddSubscription)
+	// Commands addressed to the bot in groups (e.g. /add@botname) are routed to the same handlers,
+	// commands addressed to other bots are dropped by telebot
+	bot.Handle("/add", botService.AddSubscription, botService.AdminOnly)
 	bot.Handle("/list", botService.ListSubscribedChannels)
-	bot.Handle("/remove", botService.ShowRemoveSubscription)
+	bot.Handle("/remove", botService.ShowRemoveSubscription, botService.AdminOnly)
 	bot.Handle(
 		"/timezone", func(context tele.Context) error {
 			return context.Send(templates.SetTimeZoneHelp)
 		},
 	)
-	bot.Handle(tele.OnLocation, botService.OnLocation)
+	bot.Handle("/here", botService.Here, botService.AdminOnly)
+	bot.Handle("/discord", botService.SetChatTarget(db.DeliveryTargetDiscord), botService.AdminOnly)
+	bot.Handle("/slack", botService.SetChatTarget(db.DeliveryTargetSlack), botService.AdminOnly)
+	bot.Handle("/webhook", botService.Webhook, botService.AdminOnly)
+	bot.Handle("/calendar", botService.Calendar)
+	bot.Handle("/link", botService.LinkTelegramChannel)
+	bot.Handle("/unlink", botService.UnlinkTelegramChannel, botService.AdminOnly)
+	bot.Handle(tele.OnLocation, botService.OnLocation, botService.AdminOnly)
+	bot.Handle(tele.OnAddedToGroup, botService.OnAddedToGroup)
+	bot.Handle(tele.OnMyChatMember, botService.OnMyChatMember)
+	bot.Handle(tele.OnMigration, botService.OnMigration)
+	bot.Handle("/stats", botService.Stats, botService.OperatorOnly)
+	bot.Handle("/broadcast", botService.Broadcast, botService.OperatorOnly)
+	bot.Handle("/channel", botService.ChannelInfo, botService.OperatorOnly)
+	bot.Handle("/resubscribe", botService.Resubscribe, botService.OperatorOnly)
+	bot.Handle("/disable", botService.DisableChat, botService.OperatorOnly)
 	bot.Handle(
 		"/help", func(context tele.Context) error {
 			return context.Send(templates.Hello)
@@ -93,42 +305,95 @@ func Start(ctx context.Context, config Config, confirm chan<- struct{}) error {
 			defer func() {
 				err := context.Respond()
 				if err != nil {
-					log.Print(err)
+					logger().Error("unable to respond to callback", logging.Err(err))
 				}
 			}()
 			return botService.ProcessCallback(context)
 		},
+		botService.AdminOnly,
 	)
 
-	bot.OnError = func(err error, context tele.Context) {
-		log.Print(err.Error())
-		err = context.Send(templates.UnexpectedError)
-		if err != nil {
-			log.Print(err)
-		}
-	}
-
-	go func() {
-		<-ctx.Done()
-		bot.Stop()
-		confirm <- struct{}{}
-	}()
+	botService.StartDisabledChatsPurge(ctx)
+	botService.StartOutbox()
 
-	if config.Host == nil {
+	router := mux.NewRouter()
+	server, err := newServer(config, router)
+	if err != nil {
+		return err
+	}
+	router.Methods(http.MethodGet).Path("/metrics").Handler(metrics.Handler())
+	router.Methods(http.MethodGet).Path("/healthz").HandlerFunc(healthHandler)
+	checks := readinessChecks(callback, dbService, mutexBuilder, bot)
+	router.Methods(http.MethodGet).Path("/readyz").Handler(readinessHandler(checks))
+	if len(config.APIToken) > 0 {
+		botService.registerAPI(router, config.APIToken)
+	}
+	if calendar != nil {
+		botService.registerCalendar(router)
+	}
+	err = registerPoller(bot, poller, config, router)
+	if err != nil {
+		return err
+	}
+	if callback == nil {
 		botService.StartPollingMode(ctx)
-		log.Println("Started polling mode")
+		logger().Info("started polling mode")
 	} else {
-		router := mux.NewRouter()
 		err := botService.StartSubscriptionMode(ctx, router)
 		if err != nil {
 			return err
 		}
-		go func() {
-			log.Fatal(http.ListenAndServe(":42069", router))
-		}()
-		log.Println("Started subscription mode")
+		logger().Info("started subscription mode")
 	}
+	go func() {
+		err := server.serve()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger().Error("http server stopped", logging.Err(err))
+			os.Exit(1)
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		timeout := defaultShutdownTimeout
+		if config.ShutdownTimeoutSeconds > 0 {
+			timeout = time.Duration(config.ShutdownTimeoutSeconds) * time.Second
+		}
+		shutdown(timeout, server.Server, bot, botService, dbService)
+		tracingCtx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+		defer cancel()
+		err := shutdownTracing(tracingCtx)
+		if err != nil {
+			logger().Warn("unable to flush traces", logging.Err(err))
+		}
+		confirm <- struct{}{}
+	}()
 	// Blocks until stop
 	bot.Start()
 	return nil
 }
+
+// shutdown stops taking updates and drains the notifications within the timeout, then stops the HTTP server.
+// Feed requests that arrive during the drain are answered with 503 and retried by the hub,
+// so the server does not wait for them and has its own timeout.
+func shutdown(timeout time.Duration, server *http.Server, bot *tele.Bot, botService *Service, dbService *db.DB) {
+	logger().Info("shutting down", "timeout", timeout)
+	bot.Stop()
+	drainCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := botService.Shutdown(drainCtx)
+	if err != nil {
+		logger().Warn("notifications were not drained", logging.Err(err))
+	}
+	serverCtx, cancel := context.WithTimeout(context.Background(), serverShutdownTimeout)
+	defer cancel()
+	err = server.Shutdown(serverCtx)
+	if err != nil {
+		logger().Warn("unable to shut down http server", logging.Err(err))
+	}
+	err = dbService.Close()
+	if err != nil {
+		logger().Warn("unable to close database", logging.Err(err))
+	}
+	logger().Info("shut down")
+}
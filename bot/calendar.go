@@ -0,0 +1,209 @@
+package bot
+
+import (
+	ctx "context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	tele "gopkg.in/telebot.v3"
+	"net/http"
+	"strings"
+	"time"
+	"youtube-stream-notifier-bot/db"
+	"youtube-stream-notifier-bot/logging"
+	"youtube-stream-notifier-bot/templates"
+	"youtube-stream-notifier-bot/youtube"
+)
+
+const (
+	calendarPathFormat = "/calendar/%v.ics"
+	calendarRoute      = "/calendar/{token:[0-9a-f]+}.ics"
+	calendarTokenSize  = 16
+	calendarReset      = "reset"
+	// Streams that started earlier are not in the calendar
+	calendarHistory   = time.Hour * 24 * 30
+	maxCalendarEvents = 500
+	// YouTube does not tell how long the stream will be
+	calendarEventDuration = time.Hour
+	// Calendar apps poll the feed, there is no need to query the db for every request
+	calendarMaxAge = time.Minute * 5
+	icsTimeFormat  = "20060102T150405Z"
+	// Lines longer than this are folded as required by RFC 5545
+	icsLineLength = 75
+)
+
+// saveStream keeps the stream details for calendars.
+// It is called for every notification, so rescheduled streams are updated even if they were notified already.
+func (s *Service) saveStream(ctx ctx.Context, stream youtube.StreamInfo) {
+	record := db.Stream{
+		Id:        stream.Id,
+		ChannelId: stream.Channel.Id,
+		Title:     stream.Title,
+		UpdatedAt: time.Now(),
+	}
+	if !stream.ScheduledStart.IsZero() {
+		scheduledStart := stream.ScheduledStart
+		record.ScheduledStart = &scheduledStart
+	}
+	actualStart := stream.ActualStart
+	// Search results of the poller do not include the start, the stream is live since about now
+	if !stream.IsUpcoming && actualStart.IsZero() {
+		actualStart = stream.ReceivedAt
+		if actualStart.IsZero() {
+			actualStart = time.Now()
+		}
+	}
+	if !actualStart.IsZero() {
+		record.ActualStart = &actualStart
+	}
+	err := s.db.SaveStream(ctx, record)
+	if err != nil {
+		logger().Warn("unable to save stream", logging.StreamId, stream.Id, logging.Err(err))
+	}
+}
+
+// Calendar replies with the calendar URL of the chat, "/calendar reset" replaces the URL
+func (s *Service) Calendar(context tele.Context) error {
+	if s.calendarURL == nil {
+		return context.Send(templates.CalendarDisabled)
+	}
+	ctx := updateContext(context)
+	id := context.Chat().ID
+	chat, err := s.db.GetChat(ctx, id)
+	if err != nil && errors.Is(err, db.ErrNotFound) {
+		return context.Send(templates.UserNotStarted)
+	}
+	if err != nil {
+		return err
+	}
+	reset := strings.TrimSpace(context.Data()) == calendarReset
+	if reset {
+		allowed, err := s.canManage(context)
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			return context.Send(templates.AdminOnly)
+		}
+	}
+	token := chat.CalendarToken
+	if token == nil || reset {
+		generated, err := randomHex(calendarTokenSize)
+		if err != nil {
+			return err
+		}
+		err = s.db.SetChatCalendarToken(ctx, id, generated)
+		if err != nil {
+			return err
+		}
+		token = &generated
+	}
+	link := strings.TrimSuffix(*s.calendarURL, "/") + fmt.Sprintf(calendarPathFormat, *token)
+	return context.Send(fmt.Sprintf(templates.CalendarLink, link))
+}
+
+// registerCalendar serves the calendars, the token in the path is the only authorization
+func (s *Service) registerCalendar(router *mux.Router) {
+	router.Methods(http.MethodGet).Path(calendarRoute).HandlerFunc(s.calendarHandler)
+}
+
+func (s *Service) calendarHandler(writer http.ResponseWriter, request *http.Request) {
+	chat, err := s.db.GetChatByCalendarToken(request.Context(), mux.Vars(request)["token"])
+	if err != nil && errors.Is(err, db.ErrNotFound) {
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger().Error("unable to get chat by calendar token", logging.Err(err))
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	streams, err := s.db.GetCalendarStreams(request.Context(), chat.Id, now.Add(-calendarHistory), maxCalendarEvents)
+	if err != nil {
+		logger().Error("unable to get calendar streams", logging.ChatId, chat.Id, logging.Err(err))
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	writer.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%v", int(calendarMaxAge.Seconds())))
+	_, err = writer.Write([]byte(renderCalendar(streams, now)))
+	if err != nil {
+		logger().Warn("unable to write calendar", logging.ChatId, chat.Id, logging.Err(err))
+	}
+}
+
+// renderCalendar makes an iCalendar with an event for every stream.
+// Event UID is the stream id, so the rescheduled stream updates the existing event.
+func renderCalendar(streams []db.Stream, now time.Time) string {
+	var b strings.Builder
+	writeLine := func(line string) {
+		b.WriteString(foldLine(line))
+		b.WriteString("\r\n")
+	}
+	writeLine("BEGIN:VCALENDAR")
+	writeLine("VERSION:2.0")
+	writeLine("PRODID:-//youtube-stream-notifier-bot//calendar//EN")
+	writeLine("CALSCALE:GREGORIAN")
+	writeLine("METHOD:PUBLISH")
+	writeLine("X-WR-CALNAME:YouTube streams")
+	for _, stream := range streams {
+		start := stream.ScheduledStart
+		if stream.ActualStart != nil {
+			start = stream.ActualStart
+		}
+		if start == nil {
+			continue
+		}
+		url := videoURL(stream.Id)
+		writeLine("BEGIN:VEVENT")
+		writeLine("UID:" + stream.Id + "@youtube.com")
+		writeLine("DTSTAMP:" + now.UTC().Format(icsTimeFormat))
+		writeLine("LAST-MODIFIED:" + stream.UpdatedAt.UTC().Format(icsTimeFormat))
+		writeLine(fmt.Sprintf("SEQUENCE:%v", stream.Sequence))
+		writeLine("DTSTART:" + start.UTC().Format(icsTimeFormat))
+		writeLine("DTEND:" + start.Add(calendarEventDuration).UTC().Format(icsTimeFormat))
+		writeLine("SUMMARY:" + escapeText(fmt.Sprintf("%v: %v", stream.ChannelTitle, stream.Title)))
+		writeLine("DESCRIPTION:" + escapeText(url))
+		writeLine("URL:" + url)
+		writeLine("END:VEVENT")
+	}
+	writeLine("END:VCALENDAR")
+	return b.String()
+}
+
+// escapeText escapes a TEXT value of iCalendar
+func escapeText(text string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(text)
+}
+
+// foldLine splits the line into 75 octet parts without breaking UTF-8 characters
+func foldLine(line string) string {
+	if len(line) <= icsLineLength {
+		return line
+	}
+	var b strings.Builder
+	width := 0
+	for _, r := range line {
+		size := len(string(r))
+		if width+size > icsLineLength {
+			b.WriteString("\r\n ")
+			// The leading space counts towards the length of the continuation line
+			width = 1
+		}
+		b.WriteRune(r)
+		width += size
+	}
+	return b.String()
+}
+
+func randomHex(size int) (string, error) {
+	bytes := make([]byte, size)
+	_, err := rand.Read(bytes)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to generate random token")
+	}
+	return hex.EncodeToString(bytes), nil
+}
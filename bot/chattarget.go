@@ -0,0 +1,295 @@
+package bot
+
+import (
+	ctx "context"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	tele "gopkg.in/telebot.v3"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"youtube-stream-notifier-bot/db"
+	"youtube-stream-notifier-bot/logging"
+	"youtube-stream-notifier-bot/metrics"
+	"youtube-stream-notifier-bot/templates"
+	"youtube-stream-notifier-bot/youtube"
+)
+
+const (
+	chatTargetAttempts = 3
+	// Delay before the first retry, it doubles with every attempt
+	chatTargetBackoff = time.Second
+	// YouTube red
+	discordEmbedColor = 0xFF0000
+	chatTargetOff     = "off"
+)
+
+// Names of the targets shown to users
+var chatTargetNames = map[db.DeliveryTarget]string{
+	db.DeliveryTargetDiscord: "Discord",
+	db.DeliveryTargetSlack:   "Slack",
+}
+
+// chatTargetSink posts notifications to the Discord or Slack webhooks of the subscribed chats.
+// Deliveries are claimed in the delivery log like Telegram ones, so every target is notified once.
+type chatTargetSink struct {
+	db      Storage
+	target  db.DeliveryTarget
+	render  func(stream youtube.StreamInfo) interface{}
+	client  *http.Client
+	backoff time.Duration
+	slots   chan struct{}
+}
+
+func newChatTargetSink(storage Storage, target db.DeliveryTarget, render func(stream youtube.StreamInfo) interface{}) *chatTargetSink {
+	return &chatTargetSink{
+		db:      storage,
+		target:  target,
+		render:  render,
+		client:  &http.Client{Timeout: webhookTimeout},
+		backoff: chatTargetBackoff,
+		slots:   make(chan struct{}, webhookConcurrency),
+	}
+}
+
+func newDiscordSink(storage Storage) *chatTargetSink {
+	return newChatTargetSink(storage, db.DeliveryTargetDiscord, renderDiscord)
+}
+
+func newSlackSink(storage Storage) *chatTargetSink {
+	return newChatTargetSink(storage, db.DeliveryTargetSlack, renderSlack)
+}
+
+func (c *chatTargetSink) Notify(ctx ctx.Context, stream youtube.StreamInfo) error {
+	targets, err := c.db.GetSubscribedTargets(ctx, stream.Channel.Id, c.target)
+	if err != nil {
+		return errors.Wrapf(err, "unable to get subscribed %v targets", c.target)
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+	payload, err := json.Marshal(c.render(stream))
+	if err != nil {
+		return errors.Wrapf(err, "unable to encode %v message", c.target)
+	}
+	key := deliveryKey{streamId: stream.Id, state: db.StreamStateOf(stream.IsUpcoming)}
+	var wg sync.WaitGroup
+	wg.Add(len(targets))
+	for _, target := range targets {
+		target := target
+		go func() {
+			defer wg.Done()
+			c.notifyTarget(ctx, target, key, payload)
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+func (c *chatTargetSink) notifyTarget(ctx ctx.Context, target db.ChatTarget, key deliveryKey, payload []byte) {
+	l := logger().With(logging.StreamId, key.streamId, logging.ChatId, target.ChatId, "target", c.target)
+	claimed, err := c.db.ClaimDelivery(detach(ctx), key.streamId, key.state, target.ChatId, c.target)
+	if err != nil {
+		l.Error("unable to claim delivery", logging.Err(err))
+		return
+	}
+	if !claimed {
+		return
+	}
+	status := db.DeliveryStatusSent
+	err = c.post(ctx, target.URL, payload)
+	if err != nil {
+		status = db.DeliveryStatusFailed
+		l.Warn("unable to notify chat target", logging.Err(err))
+	}
+	metrics.ChatTargetNotifications.WithLabelValues(string(c.target), string(status)).Inc()
+	err = c.db.CompleteDelivery(detach(ctx), key.streamId, key.state, target.ChatId, c.target, status, nil)
+	if err != nil {
+		l.Error("unable to save delivery status", logging.Err(err))
+	}
+}
+
+// post retries network errors, 5xx and 429 responses, waiting at least the Retry-After of the latter
+func (c *chatTargetSink) post(ctx ctx.Context, url string, payload []byte) error {
+	delay := c.backoff
+	var err error
+	for attempt := 0; attempt < chatTargetAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return errors.Wrap(ctx.Err(), "delivery is stopped")
+			case <-time.After(retryDelay(err, delay)):
+			}
+			delay *= 2
+		}
+		err = c.attempt(ctx, url, payload)
+		if err == nil {
+			return nil
+		}
+		var webhookErr *webhookError
+		if errors.As(err, &webhookErr) && webhookErr.permanent {
+			return err
+		}
+	}
+	return err
+}
+
+// attempt holds a request slot only for the request, so rate limited targets waiting to retry do not block others
+func (c *chatTargetSink) attempt(ctx ctx.Context, url string, payload []byte) error {
+	select {
+	case c.slots <- struct{}{}:
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "delivery is stopped")
+	}
+	defer func() {
+		<-c.slots
+	}()
+	return postJSON(ctx, c.client, url, payload, nil)
+}
+
+type discordMessage struct {
+	Embeds []discordEmbed `json:"embeds"`
+}
+
+type discordEmbed struct {
+	Title       string        `json:"title"`
+	URL         string        `json:"url"`
+	Description string        `json:"description"`
+	Color       int           `json:"color"`
+	Author      discordAuthor `json:"author"`
+	Timestamp   string        `json:"timestamp,omitempty"`
+}
+
+type discordAuthor struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// renderDiscord makes an embed, the scheduled time is shown in the time zone of every reader
+func renderDiscord(stream youtube.StreamInfo) interface{} {
+	embed := discordEmbed{
+		Title:       stream.Title,
+		URL:         videoURL(stream.Id),
+		Description: fmt.Sprintf("New live stream on %v channel!", stream.Channel.Title),
+		Color:       discordEmbedColor,
+		Author: discordAuthor{
+			Name: stream.Channel.Title,
+			URL:  fmt.Sprintf(channelURLFormat, stream.Channel.Id),
+		},
+	}
+	if stream.IsUpcoming {
+		start := stream.ScheduledStart.Unix()
+		embed.Description = fmt.Sprintf(
+			"New upcoming stream on %v channel!\nScheduled for <t:%v:F> (<t:%v:R>)",
+			stream.Channel.Title, start, start,
+		)
+		embed.Timestamp = stream.ScheduledStart.UTC().Format(time.RFC3339)
+	}
+	return discordMessage{Embeds: []discordEmbed{embed}}
+}
+
+type slackMessage struct {
+	// Shown in notifications and clients without blocks
+	Text   string       `json:"text"`
+	Blocks []slackBlock `json:"blocks"`
+}
+
+type slackBlock struct {
+	Type     string      `json:"type"`
+	Text     *slackText  `json:"text,omitempty"`
+	Elements []slackText `json:"elements,omitempty"`
+}
+
+type slackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// renderSlack makes a section block, the scheduled time is shown in the time zone of every reader
+func renderSlack(stream youtube.StreamInfo) interface{} {
+	channel := slackEscape(stream.Channel.Title)
+	text := fmt.Sprintf("New live stream on %v channel!", channel)
+	if stream.IsUpcoming {
+		text = fmt.Sprintf("New upcoming stream on %v channel!", channel)
+	}
+	section := fmt.Sprintf("*<%v|%v>*\n%v", videoURL(stream.Id), slackEscape(stream.Title), text)
+	blocks := []slackBlock{{Type: "section", Text: &slackText{Type: "mrkdwn", Text: section}}}
+	if stream.IsUpcoming {
+		scheduled := fmt.Sprintf(
+			"Scheduled for <!date^%v^{date_short_pretty} at {time}|%v>",
+			stream.ScheduledStart.Unix(),
+			stream.ScheduledStart.UTC().Format(time.RFC1123),
+		)
+		blocks = append(blocks, slackBlock{Type: "context", Elements: []slackText{{Type: "mrkdwn", Text: scheduled}}})
+	}
+	return slackMessage{Text: text, Blocks: blocks}
+}
+
+// slackEscape escapes the control characters of Slack mrkdwn
+func slackEscape(text string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(text)
+}
+
+func videoURL(videoId string) string {
+	return fmt.Sprintf("https://youtube.com/watch?v=%v", videoId)
+}
+
+// validChatTargetURL accepts only incoming webhooks of the service, so chats cannot make the bot call arbitrary URLs
+func validChatTargetURL(target db.DeliveryTarget, rawURL string) bool {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || parsed.Scheme != "https" || len(parsed.RawQuery) > 0 {
+		return false
+	}
+	switch target {
+	case db.DeliveryTargetDiscord:
+		switch parsed.Host {
+		case "discord.com", "discordapp.com", "ptb.discord.com", "canary.discord.com":
+			return strings.HasPrefix(parsed.Path, "/api/webhooks/")
+		}
+	case db.DeliveryTargetSlack:
+		return parsed.Host == "hooks.slack.com" && strings.HasPrefix(parsed.Path, "/services/")
+	}
+	return false
+}
+
+// SetChatTarget returns the handler of the command that attaches the Discord or Slack webhook to the chat
+func (s *Service) SetChatTarget(target db.DeliveryTarget) tele.HandlerFunc {
+	name := chatTargetNames[target]
+	return func(context tele.Context) error {
+		ctx := updateContext(context)
+		id := context.Chat().ID
+		_, err := s.db.GetChat(ctx, id)
+		if err != nil && errors.Is(err, db.ErrNotFound) {
+			return context.Send(templates.UserNotStarted)
+		}
+		if err != nil {
+			return err
+		}
+		data := strings.TrimSpace(context.Data())
+		if len(data) == 0 {
+			command := "/" + string(target)
+			return context.Send(fmt.Sprintf(templates.ChatTargetUsage, name, command, command))
+		}
+		if data == chatTargetOff {
+			removed, err := s.db.RemoveChatTarget(ctx, id, target)
+			if err != nil {
+				return errors.Wrapf(err, "cannot remove %v target of chat %v", target, id)
+			}
+			if !removed {
+				return context.Send(fmt.Sprintf(templates.ChatTargetNotSet, name))
+			}
+			return context.Send(fmt.Sprintf(templates.ChatTargetRemoved, name))
+		}
+		if !validChatTargetURL(target, data) {
+			return context.Send(fmt.Sprintf(templates.ChatTargetInvalid, name))
+		}
+		err = s.db.SetChatTarget(ctx, db.ChatTarget{ChatId: id, Target: target, URL: data, CreatedAt: time.Now()})
+		if err != nil {
+			return errors.Wrapf(err, "cannot set %v target of chat %v", target, id)
+		}
+		return context.Send(fmt.Sprintf(templates.ChatTargetSuccess, name))
+	}
+}
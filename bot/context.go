@@ -0,0 +1,47 @@
+package bot
+
+import (
+	ctx "context"
+	tele "gopkg.in/telebot.v3"
+	"time"
+	"youtube-stream-notifier-bot/tracing"
+)
+
+const (
+	// Handling of a single update, including database and YouTube calls, is limited by the timeout
+	updateTimeout    = time.Minute
+	updateContextKey = "ctx"
+)
+
+// withUpdateContext stores the context of the update in the telebot context,
+// handlers get it with updateContext
+func withUpdateContext(next tele.HandlerFunc) tele.HandlerFunc {
+	return func(context tele.Context) error {
+		updateCtx, cancel := ctx.WithTimeout(ctx.Background(), updateTimeout)
+		defer cancel()
+		var chatId int64
+		if chat := context.Chat(); chat != nil {
+			chatId = chat.ID
+		}
+		updateCtx, span := tracing.Start(updateCtx, "telegram update", tracing.ChatId.Int64(chatId))
+		context.Set(updateContextKey, updateCtx)
+		err := next(context)
+		tracing.End(span, err)
+		return err
+	}
+}
+
+// updateContext returns the context of the update, or the background context outside the middleware
+func updateContext(context tele.Context) ctx.Context {
+	updateCtx, ok := context.Get(updateContextKey).(ctx.Context)
+	if !ok {
+		return ctx.Background()
+	}
+	return updateCtx
+}
+
+// detach keeps the values of the context, e.g. the trace, but ignores its cancellation.
+// It is used to save the state of the delivery after it is stopped.
+func detach(parent ctx.Context) ctx.Context {
+	return ctx.WithoutCancel(parent)
+}
@@ -0,0 +1,316 @@
+package bot
+
+import (
+	ctx "context"
+	"github.com/pkg/errors"
+	tele "gopkg.in/telebot.v3"
+	"time"
+	"youtube-stream-notifier-bot/db"
+	"youtube-stream-notifier-bot/logging"
+	"youtube-stream-notifier-bot/metrics"
+)
+
+const (
+	// Chats disabled for longer than this are removed along with their subscriptions
+	disabledChatRetention = time.Hour * 24 * 30
+	purgeInterval         = time.Hour
+	// Outbox messages are resent by another replica if this one does not finish them in time
+	outboxLease = time.Minute * 5
+	// Messages claimed at once, even a batch to a single group is sent well within the lease
+	outboxBatchSize = 50
+	// Messages left by a stopped replica or failed to send are taken again by the next check after their lease
+	outboxInterval = time.Minute
+)
+
+type sendFailure int
+
+const (
+	sendFailureOther sendFailure = iota
+	// Bot was blocked by the user or the user is deactivated
+	sendFailureBlocked
+	sendFailureChatNotFound
+	// Bot was removed from the group, supergroup or channel
+	sendFailureKicked
+	// Group was upgraded to a supergroup and has a new id
+	sendFailureMigrated
+)
+
+// reason is the label of the failure in metrics
+func (f sendFailure) reason() string {
+	switch f {
+	case sendFailureBlocked:
+		return metrics.ReasonBlocked
+	case sendFailureChatNotFound:
+		return metrics.ReasonChatNotFound
+	case sendFailureKicked:
+		return metrics.ReasonKicked
+	case sendFailureMigrated:
+		return metrics.ReasonMigrated
+	}
+	return metrics.ReasonOther
+}
+
+// classifySendError returns the kind of failure and, for migrated groups, the new chat id
+func classifySendError(err error) (sendFailure, int64) {
+	var groupErr tele.GroupError
+	if errors.As(err, &groupErr) {
+		return sendFailureMigrated, groupErr.MigratedTo
+	}
+	switch {
+	case errors.Is(err, tele.ErrBlockedByUser),
+		errors.Is(err, tele.ErrUserIsDeactivated),
+		errors.Is(err, tele.ErrNotStartedByUser):
+		return sendFailureBlocked, 0
+	case errors.Is(err, tele.ErrChatNotFound):
+		return sendFailureChatNotFound, 0
+	case errors.Is(err, tele.ErrKickedFromGroup),
+		errors.Is(err, tele.ErrKickedFromSuperGroup),
+		errors.Is(err, tele.ErrKickedFromChannel):
+		return sendFailureKicked, 0
+	}
+	return sendFailureOther, 0
+}
+
+// deliveryKey identifies the stream notification the message belongs to
+type deliveryKey struct {
+	streamId string
+	state    db.StreamState
+}
+
+// sendResult is the outcome of sending a message to a chat
+type sendResult struct {
+	status db.DeliveryStatus
+	// Chat id after a possible migration
+	chatId    int64
+	messageId *int
+}
+
+// sendToChat sends the notification to the chat delivery target.
+// If the group was upgraded to a supergroup the chat is migrated and the message is sent once more.
+// Messages that could not be sent before shutdown are saved to the outbox along with the delivery key.
+func (s *Service) sendToChat(ctx ctx.Context, chat db.Chat, message string, key *deliveryKey) sendResult {
+	threadId := deliveryThread(chat)
+	sent, err := s.dispatcher.Send(ctx, deliveryTarget(chat), threadId, message)
+	if err != nil && !errors.Is(err, errDispatcherStopped) {
+		failure, migratedTo := classifySendError(err)
+		if failure == sendFailureMigrated && chat.TelegramChannelId == nil {
+			migrateErr := s.migrateChat(ctx, chat.Id, migratedTo)
+			if migrateErr != nil {
+				logger().Error(
+					"unable to migrate chat",
+					logging.ChatId, chat.Id,
+					"migrated_to", migratedTo,
+					logging.Err(migrateErr),
+				)
+				metrics.NotificationsFailed.WithLabelValues(metrics.ReasonMigrated).Inc()
+				return sendResult{status: db.DeliveryStatusFailed, chatId: chat.Id}
+			}
+			chat.Id = migratedTo
+			sent, err = s.dispatcher.Send(ctx, chat.Id, threadId, message)
+		}
+	}
+	if err != nil && errors.Is(err, errDispatcherStopped) {
+		return sendResult{status: s.saveToOutbox(ctx, chat.Id, threadId, message, key), chatId: chat.Id}
+	}
+	if err != nil {
+		failure, _ := classifySendError(err)
+		metrics.NotificationsFailed.WithLabelValues(failure.reason()).Inc()
+		s.handleSendError(ctx, chat, err)
+		return sendResult{status: db.DeliveryStatusFailed, chatId: chat.Id}
+	}
+	metrics.NotificationsSent.Inc()
+	return sendResult{status: db.DeliveryStatusSent, chatId: chat.Id, messageId: &sent.ID}
+}
+
+// saveToOutbox is called when the delivery is stopped, so it ignores the cancellation of ctx
+func (s *Service) saveToOutbox(
+	ctx ctx.Context,
+	chatId int64,
+	threadId int,
+	message string,
+	key *deliveryKey,
+) db.DeliveryStatus {
+	outboxMessage := db.OutboxMessage{
+		ChatId:    chatId,
+		Text:      message,
+		CreatedAt: time.Now(),
+	}
+	if threadId != 0 {
+		outboxMessage.ThreadId = &threadId
+	}
+	if key != nil {
+		outboxMessage.StreamId = &key.streamId
+		outboxMessage.State = &key.state
+	}
+	err := s.db.AddOutboxMessage(detach(ctx), outboxMessage)
+	if err != nil {
+		logger().Error("unable to save message to outbox", logging.ChatId, chatId, logging.Err(err))
+		return db.DeliveryStatusFailed
+	}
+	return db.DeliveryStatusQueued
+}
+
+// completeDelivery saves the outcome of the stream notification, even if the delivery is stopped
+func (s *Service) completeDelivery(ctx ctx.Context, key deliveryKey, result sendResult) {
+	err := s.db.CompleteDelivery(
+		detach(ctx),
+		key.streamId,
+		key.state,
+		result.chatId,
+		db.DeliveryTargetTelegram,
+		result.status,
+		result.messageId,
+	)
+	if err != nil {
+		logger().Error(
+			"unable to save delivery status",
+			logging.StreamId, key.streamId,
+			logging.ChatId, result.chatId,
+			logging.Err(err),
+		)
+	}
+}
+
+// StartOutbox periodically sends messages saved to the outbox during a shutdown.
+// A message is removed from the outbox only when it no longer has to be sent,
+// so messages that failed or were in flight when a replica died are sent by a later check.
+func (s *Service) StartOutbox() {
+	s.consume(func() {
+		ticker := time.NewTicker(outboxInterval)
+		defer ticker.Stop()
+		for {
+			s.resumeOutbox()
+			select {
+			case <-s.stopping:
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+}
+
+// resumeOutbox claims the messages in batches, so each batch is sent before its lease expires.
+// Messages that were not sent stay claimed until the lease expires and are not taken by the next batch.
+func (s *Service) resumeOutbox() {
+	for {
+		messages, err := s.db.ClaimOutboxMessages(s.deliveryCtx, outboxLease, outboxBatchSize)
+		if err != nil {
+			logger().Error("unable to claim outbox messages", logging.Err(err))
+			return
+		}
+		if len(messages) == 0 {
+			return
+		}
+		logger().Info("resuming outbox messages", "count", len(messages))
+		for _, message := range messages {
+			select {
+			case <-s.stopping:
+				// The rest of the batch is taken by another replica when the lease expires
+				return
+			default:
+			}
+			if !s.resumeOutboxMessage(message) {
+				continue
+			}
+			err := s.db.RemoveOutboxMessage(detach(s.deliveryCtx), message.Id)
+			if err != nil {
+				logger().Error("unable to remove outbox message", logging.ChatId, message.ChatId, logging.Err(err))
+			}
+		}
+		if len(messages) < outboxBatchSize {
+			return
+		}
+	}
+}
+
+// resumeOutboxMessage returns true if the message is sent or can't be sent anymore
+func (s *Service) resumeOutboxMessage(message db.OutboxMessage) bool {
+	chat, err := s.db.GetChat(s.deliveryCtx, message.ChatId)
+	if err != nil && errors.Is(err, db.ErrNotFound) {
+		return true
+	}
+	if err != nil {
+		logger().Error("unable to get chat for outbox message", logging.ChatId, message.ChatId, logging.Err(err))
+		return false
+	}
+	if !chat.Enabled {
+		return true
+	}
+	var key *deliveryKey
+	if message.StreamId != nil && message.State != nil {
+		key = &deliveryKey{streamId: *message.StreamId, state: *message.State}
+	}
+	chat.SubscriptionThreadId = message.ThreadId
+	result := s.sendToChat(s.deliveryCtx, chat, message.Text, key)
+	if key != nil {
+		s.completeDelivery(s.deliveryCtx, *key, result)
+	}
+	// Delivery stopped again, the message is saved to the outbox once more
+	return result.status == db.DeliveryStatusSent || result.status == db.DeliveryStatusQueued
+}
+
+// OnMigration handles the service message sent when a group is upgraded to a supergroup
+func (s *Service) OnMigration(context tele.Context) error {
+	from, to := context.Migration()
+	return s.migrateChat(updateContext(context), from, to)
+}
+
+func (s *Service) migrateChat(ctx ctx.Context, fromId, toId int64) error {
+	err := s.db.MigrateChat(ctx, fromId, toId)
+	// Chat is already migrated by the service message or by a concurrent send
+	if err != nil && errors.Is(err, db.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	logger().Info("chat migrated", logging.ChatId, fromId, "migrated_to", toId)
+	return nil
+}
+
+// handleSendError disables the chat or unlinks its Telegram channel if the error says it can no longer receive messages
+func (s *Service) handleSendError(ctx ctx.Context, chat db.Chat, err error) {
+	failure, _ := classifySendError(err)
+	l := logger().With(logging.ChatId, chat.Id)
+	switch failure {
+	case sendFailureOther, sendFailureMigrated:
+		l.Warn("unable to send message", logging.Err(err))
+	default:
+		// The linked Telegram channel is gone, but the controlling chat is still fine
+		if chat.TelegramChannelId != nil {
+			l := l.With("telegram_channel_id", *chat.TelegramChannelId)
+			l.Info("unlinking telegram channel", logging.Err(err))
+			err := s.db.UnlinkTelegramChannel(ctx, *chat.TelegramChannelId)
+			if err != nil {
+				l.Error("unable to unlink telegram channel", logging.Err(err))
+			}
+			return
+		}
+		l.Info("disabling chat", logging.Err(err))
+		err := s.db.SetChatEnabled(ctx, chat.Id, false)
+		if err != nil {
+			l.Error("unable to disable chat", logging.Err(err))
+		}
+	}
+}
+
+// StartDisabledChatsPurge periodically removes chats that have been disabled for a long time
+func (s *Service) StartDisabledChatsPurge(ctx ctx.Context) {
+	go func() {
+		ticker := time.NewTicker(purgeInterval)
+		defer ticker.Stop()
+		for {
+			purged, err := s.db.PurgeDisabledChats(ctx, time.Now().Add(-disabledChatRetention))
+			if err != nil {
+				logger().Error("unable to purge disabled chats", logging.Err(err))
+			} else if purged > 0 {
+				logger().Info("purged disabled chats", "count", purged)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
@@ -0,0 +1,112 @@
+package bot
+
+import (
+	ctx "context"
+	tele "gopkg.in/telebot.v3"
+	"net/http"
+	"time"
+	"youtube-stream-notifier-bot/db"
+	"youtube-stream-notifier-bot/mutex"
+	"youtube-stream-notifier-bot/youtube"
+)
+
+// YouTube is implemented by youtube.Service
+type YouTube interface {
+	FindChannel(ctx ctx.Context, url string) (youtube.ChannelInfo, error)
+	GetStreamInfo(ctx ctx.Context, videoId string) (youtube.StreamInfo, error)
+	PollStreams(ctx ctx.Context, channels <-chan youtube.ChannelInfo) <-chan youtube.StreamInfo
+}
+
+// Storage is implemented by db.DB
+type Storage interface {
+	GetChat(ctx ctx.Context, id int64) (db.Chat, error)
+	AddChat(ctx ctx.Context, c db.Chat) error
+	SetChatTimeZone(ctx ctx.Context, id int64, timeZone string) error
+	SetChatEnabled(ctx ctx.Context, id int64, enabled bool) error
+	MigrateChat(ctx ctx.Context, fromId, toId int64) error
+	PurgeDisabledChats(ctx ctx.Context, disabledBefore time.Time) (int64, error)
+	SetChatTelegramChannel(ctx ctx.Context, id int64, telegramChannelId *int64) error
+	TelegramChannelLinked(ctx ctx.Context, telegramChannelId int64) (bool, error)
+	UnlinkTelegramChannel(ctx ctx.Context, telegramChannelId int64) error
+	SetChatThread(ctx ctx.Context, id int64, threadId *int) error
+	SetChatCalendarToken(ctx ctx.Context, id int64, token string) error
+	GetChatByCalendarToken(ctx ctx.Context, token string) (db.Chat, error)
+
+	GetChannel(ctx ctx.Context, id string) (db.Channel, error)
+	ChannelExists(ctx ctx.Context, id string) (bool, error)
+	AddChannel(ctx ctx.Context, c db.Channel) error
+	PollChannels(ctx ctx.Context, leaseExpiring bool) <-chan db.Channel
+	HandleConfirmSubscription(w http.ResponseWriter, r *http.Request)
+
+	AddSubscription(ctx ctx.Context, userId int64, channelId string, threadId *int) error
+	GetSubscribedChannels(ctx ctx.Context, chatId int64) ([]db.Channel, error)
+	GetSubscribedChats(ctx ctx.Context, channelId string) ([]db.Chat, error)
+	RemoveSubscription(ctx ctx.Context, chatId int64, channelId string) error
+
+	MarkDone(ctx ctx.Context, streamId string, state db.StreamState) (bool, error)
+	GetStreamState(ctx ctx.Context, streamId string) (db.StreamState, error)
+	SaveStream(ctx ctx.Context, s db.Stream) error
+	GetCalendarStreams(ctx ctx.Context, chatId int64, since time.Time, limit int) ([]db.Stream, error)
+	ClaimDelivery(
+		ctx ctx.Context,
+		streamId string,
+		state db.StreamState,
+		chatId int64,
+		target db.DeliveryTarget,
+	) (bool, error)
+	CompleteDelivery(
+		ctx ctx.Context,
+		streamId string,
+		state db.StreamState,
+		chatId int64,
+		target db.DeliveryTarget,
+		status db.DeliveryStatus,
+		messageId *int,
+	) error
+	GetDeliveryStats(ctx ctx.Context, streamId string) ([]db.DeliveryStats, error)
+
+	SetChatTarget(ctx ctx.Context, t db.ChatTarget) error
+	RemoveChatTarget(ctx ctx.Context, chatId int64, target db.DeliveryTarget) (bool, error)
+	GetSubscribedTargets(ctx ctx.Context, channelId string, target db.DeliveryTarget) ([]db.ChatTarget, error)
+
+	AddOutboxMessage(ctx ctx.Context, m db.OutboxMessage) error
+	ClaimOutboxMessages(ctx ctx.Context, lease time.Duration, limit int) ([]db.OutboxMessage, error)
+	RemoveOutboxMessage(ctx ctx.Context, id int64) error
+
+	GetStats(ctx ctx.Context) (db.Stats, error)
+	ListEnabledChats(ctx ctx.Context) ([]db.Chat, error)
+	ListChats(ctx ctx.Context, limit, offset int) ([]db.Chat, error)
+	ListChannels(ctx ctx.Context, limit, offset int) ([]db.Channel, error)
+	ListActiveChannels(ctx ctx.Context) ([]db.Channel, error)
+	ListStreams(ctx ctx.Context, limit, offset int) ([]db.DoneStream, error)
+	GetStream(ctx ctx.Context, id string) (db.DoneStream, error)
+
+	SetWebhook(ctx ctx.Context, w *db.Webhook) error
+	GetWebhook(ctx ctx.Context, id int64) (db.Webhook, error)
+	ListWebhooks(ctx ctx.Context, limit, offset int) ([]db.Webhook, error)
+	GetChannelWebhooks(ctx ctx.Context, channelId string) ([]db.Webhook, error)
+	GetChatWebhooks(ctx ctx.Context, chatId int64) ([]db.Webhook, error)
+	RemoveWebhook(ctx ctx.Context, chatId int64, channelId string) error
+	AddDeadLetter(ctx ctx.Context, l db.DeadLetter) error
+	GetDeadLetter(ctx ctx.Context, id int64) (db.DeadLetter, error)
+	ListDeadLetters(ctx ctx.Context, limit, offset int) ([]db.DeadLetter, error)
+	RemoveDeadLetter(ctx ctx.Context, id int64) error
+}
+
+// Locks is implemented by mutex.Builder
+type Locks interface {
+	Stream(streamId string) mutex.Mutex
+}
+
+// TimeZones is implemented by timezone.Service
+type TimeZones interface {
+	GetTimeZone(ctx ctx.Context, lat, lng string) (string, error)
+}
+
+// Telegram is the part of tele.Bot used outside of update handlers
+type Telegram interface {
+	Send(to tele.Recipient, what interface{}, opts ...interface{}) (*tele.Message, error)
+	ChatMemberOf(chat, user tele.Recipient) (*tele.ChatMember, error)
+	ChatByID(id int64) (*tele.Chat, error)
+	ChatByUsername(name string) (*tele.Chat, error)
+}
@@ -0,0 +1,217 @@
+package bot
+
+import (
+	ctx "context"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	tele "gopkg.in/telebot.v3"
+	"math"
+	"sync"
+	"time"
+	"youtube-stream-notifier-bot/tracing"
+)
+
+const (
+	// Telegram allows about 30 messages per second in total
+	globalSendRate  = 30
+	globalSendBurst = 30
+	// and about 1 message per second to a private chat and 20 messages per minute to a group
+	privateChatSendInterval = time.Second
+	groupChatSendInterval   = time.Minute / 20
+	sendMaxAttempts         = 5
+	sendInitialBackoff      = time.Second
+	sendMaxBackoff          = time.Minute
+	// Stale per chat pacing entries are dropped when there are more of them than this
+	pacingCleanupSize = 10000
+)
+
+var errDispatcherStopped = errors.New("dispatcher is stopped")
+
+// clock is the time source of the dispatcher, tests replace it to check the pacing without waiting
+type clock interface {
+	Now() time.Time
+	// Sleep returns errDispatcherStopped if ctx is done before the duration passes
+	Sleep(ctx ctx.Context, duration time.Duration) error
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) Sleep(ctx ctx.Context, duration time.Duration) error {
+	return sleep(ctx, duration)
+}
+
+// Dispatcher sends messages respecting Telegram rate limits.
+// Send blocks until the message is delivered, permanently rejected or the context is cancelled.
+type Dispatcher struct {
+	bot    Telegram
+	clock  clock
+	bucket *tokenBucket
+	mu     sync.Mutex
+	// Earliest time the next message can be sent to a chat
+	nextSend map[int64]time.Time
+}
+
+func NewDispatcher(bot Telegram) *Dispatcher {
+	return newDispatcher(bot, systemClock{})
+}
+
+func newDispatcher(bot Telegram, clock clock) *Dispatcher {
+	return &Dispatcher{
+		bot:      bot,
+		clock:    clock,
+		bucket:   newTokenBucket(globalSendRate, globalSendBurst, clock),
+		nextSend: make(map[int64]time.Time),
+	}
+}
+
+// Send delivers the message to the chat, retrying on flood control and transient errors.
+// Returns errDispatcherStopped if the context is cancelled before the message is sent.
+func (d *Dispatcher) Send(ctx ctx.Context, chatId int64, threadId int, text string) (*tele.Message, error) {
+	ctx, span := tracing.Start(ctx, "telegram send", tracing.ChatId.Int64(chatId))
+	message, err := d.send(ctx, chatId, threadId, text)
+	tracing.End(span, err)
+	return message, err
+}
+
+func (d *Dispatcher) send(ctx ctx.Context, chatId int64, threadId int, text string) (*tele.Message, error) {
+	span := trace.SpanFromContext(ctx)
+	backoff := sendInitialBackoff
+	var lastErr error
+	for attempt := 0; attempt < sendMaxAttempts; attempt++ {
+		err := d.waitChat(ctx, chatId)
+		if err != nil {
+			return nil, err
+		}
+		err = d.bucket.wait(ctx)
+		if err != nil {
+			return nil, err
+		}
+		span.AddEvent("attempt", trace.WithAttributes(attribute.Int("attempt", attempt+1)))
+		message, err := d.bot.Send(tele.ChatID(chatId), text, &tele.SendOptions{ThreadID: threadId})
+		if err == nil {
+			return message, nil
+		}
+		lastErr = err
+		var floodErr tele.FloodError
+		if errors.As(err, &floodErr) {
+			err := d.clock.Sleep(ctx, time.Duration(floodErr.RetryAfter)*time.Second)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if !isTransientSendError(err) {
+			return nil, err
+		}
+		err = d.clock.Sleep(ctx, backoff)
+		if err != nil {
+			return nil, err
+		}
+		backoff = time.Duration(math.Min(float64(backoff*2), float64(sendMaxBackoff)))
+	}
+	return nil, errors.Wrapf(lastErr, "unable to send message after %v attempts", sendMaxAttempts)
+}
+
+// waitChat reserves the next send slot for the chat and waits for it
+func (d *Dispatcher) waitChat(ctx ctx.Context, chatId int64) error {
+	interval := privateChatSendInterval
+	// Groups and channels have negative ids
+	if chatId < 0 {
+		interval = groupChatSendInterval
+	}
+	now := d.clock.Now()
+	d.mu.Lock()
+	if len(d.nextSend) > pacingCleanupSize {
+		for id, next := range d.nextSend {
+			if next.Before(now) {
+				delete(d.nextSend, id)
+			}
+		}
+	}
+	next, ok := d.nextSend[chatId]
+	if !ok || next.Before(now) {
+		next = now
+	}
+	d.nextSend[chatId] = next.Add(interval)
+	d.mu.Unlock()
+	return d.clock.Sleep(ctx, next.Sub(now))
+}
+
+// isTransientSendError reports whether the send may succeed if retried later
+func isTransientSendError(err error) bool {
+	failure, _ := classifySendError(err)
+	if failure != sendFailureOther {
+		return false
+	}
+	var teleErr *tele.Error
+	if errors.As(err, &teleErr) {
+		return teleErr.Code >= 500
+	}
+	// Network errors and unknown API errors
+	return true
+}
+
+func sleep(ctx ctx.Context, duration time.Duration) error {
+	if duration <= 0 {
+		select {
+		case <-ctx.Done():
+			return errDispatcherStopped
+		default:
+			return nil
+		}
+	}
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return errDispatcherStopped
+	case <-timer.C:
+		return nil
+	}
+}
+
+type tokenBucket struct {
+	mu     sync.Mutex
+	clock  clock
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64, clock clock) *tokenBucket {
+	return &tokenBucket{
+		clock:  clock,
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   clock.Now(),
+	}
+}
+
+// wait takes a token, waiting for it to become available
+func (b *tokenBucket) wait(ctx ctx.Context) error {
+	for {
+		b.mu.Lock()
+		now := b.clock.Now()
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+		if b.tokens >= 1 {
+			b.tokens--
+			b.mu.Unlock()
+			return nil
+		}
+		// Rounded up, so a fraction of a nanosecond does not make a busy loop
+		delay := time.Duration(math.Ceil((1 - b.tokens) / b.rate * float64(time.Second)))
+		b.mu.Unlock()
+		err := b.clock.Sleep(ctx, delay)
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,1155 @@
+package bot
+
+import (
+	ctx "context"
+	tele "gopkg.in/telebot.v3"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"time"
+	"youtube-stream-notifier-bot/db"
+	"youtube-stream-notifier-bot/mutex"
+	"youtube-stream-notifier-bot/youtube"
+)
+
+type fakeYouTube struct {
+	// Channels by url passed to /add
+	channels map[string]youtube.ChannelInfo
+	// Streams by video id
+	streams map[string]youtube.StreamInfo
+}
+
+func newFakeYouTube() *fakeYouTube {
+	return &fakeYouTube{
+		channels: make(map[string]youtube.ChannelInfo),
+		streams:  make(map[string]youtube.StreamInfo),
+	}
+}
+
+func (f *fakeYouTube) FindChannel(_ ctx.Context, url string) (youtube.ChannelInfo, error) {
+	channel, ok := f.channels[url]
+	if !ok {
+		return youtube.ChannelInfo{}, youtube.ErrBadUrl
+	}
+	return channel, nil
+}
+
+func (f *fakeYouTube) GetStreamInfo(_ ctx.Context, videoId string) (youtube.StreamInfo, error) {
+	stream, ok := f.streams[videoId]
+	if !ok {
+		return youtube.StreamInfo{}, youtube.ErrNotStream
+	}
+	return stream, nil
+}
+
+func (f *fakeYouTube) PollStreams(_ ctx.Context, channels <-chan youtube.ChannelInfo) <-chan youtube.StreamInfo {
+	streams := make(chan youtube.StreamInfo)
+	go func() {
+		defer close(streams)
+		for channel := range channels {
+			for _, stream := range f.streams {
+				if stream.Channel.Id == channel.Id {
+					streams <- stream
+				}
+			}
+		}
+	}()
+	return streams
+}
+
+type deliveryId struct {
+	streamId string
+	state    db.StreamState
+	chatId   int64
+	target   db.DeliveryTarget
+}
+
+// fakeStorage keeps everything in memory and mimics the semantics of db.DB
+type fakeStorage struct {
+	mu            sync.Mutex
+	chats         map[int64]db.Chat
+	channels      map[string]db.Channel
+	subscriptions []db.Subscription
+	streams       map[string]db.StreamState
+	deliveries    map[deliveryId]db.Delivery
+	outbox        []db.OutboxMessage
+	webhooks      []db.Webhook
+	deadLetters   []db.DeadLetter
+	targets       []db.ChatTarget
+	streamDetails map[string]db.Stream
+	lastId        int64
+}
+
+func newFakeStorage() *fakeStorage {
+	return &fakeStorage{
+		chats:         make(map[int64]db.Chat),
+		channels:      make(map[string]db.Channel),
+		streams:       make(map[string]db.StreamState),
+		deliveries:    make(map[deliveryId]db.Delivery),
+		streamDetails: make(map[string]db.Stream),
+	}
+}
+
+func (f *fakeStorage) GetChat(_ ctx.Context, id int64) (db.Chat, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	chat, ok := f.chats[id]
+	if !ok {
+		return db.Chat{}, db.ErrNotFound
+	}
+	return chat, nil
+}
+
+func (f *fakeStorage) AddChat(_ ctx.Context, c db.Chat) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if chat, ok := f.chats[c.Id]; ok {
+		chat.Enabled = c.Enabled
+		chat.DisabledAt = c.DisabledAt
+		f.chats[c.Id] = chat
+		return nil
+	}
+	f.chats[c.Id] = c
+	return nil
+}
+
+func (f *fakeStorage) updateChat(id int64, update func(chat *db.Chat)) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	chat, ok := f.chats[id]
+	if !ok {
+		return nil
+	}
+	update(&chat)
+	f.chats[id] = chat
+	return nil
+}
+
+func (f *fakeStorage) SetChatTimeZone(_ ctx.Context, id int64, timeZone string) error {
+	return f.updateChat(
+		id, func(chat *db.Chat) {
+			chat.TimeZone = &timeZone
+		},
+	)
+}
+
+func (f *fakeStorage) SetChatEnabled(_ ctx.Context, id int64, enabled bool) error {
+	return f.updateChat(
+		id, func(chat *db.Chat) {
+			chat.Enabled = enabled
+			chat.DisabledAt = nil
+			if !enabled {
+				now := time.Now()
+				chat.DisabledAt = &now
+			}
+		},
+	)
+}
+
+// MigrateChat mirrors db.DB: the settings of an existing new chat win, rows that would be duplicated stay
+// with the old chat and are removed with it
+func (f *fakeStorage) MigrateChat(_ ctx.Context, fromId, toId int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	chat, ok := f.chats[fromId]
+	if !ok {
+		return db.ErrNotFound
+	}
+	migrated := chat
+	migrated.Id = toId
+	if existing, ok := f.chats[toId]; ok {
+		migrated.TimeZone = coalesce(existing.TimeZone, chat.TimeZone)
+		migrated.TelegramChannelId = coalesce(existing.TelegramChannelId, chat.TelegramChannelId)
+		migrated.ThreadId = coalesce(existing.ThreadId, chat.ThreadId)
+		migrated.CalendarToken = coalesce(existing.CalendarToken, chat.CalendarToken)
+	}
+	f.chats[toId] = migrated
+	subscribed := make(map[string]bool)
+	for _, sub := range f.subscriptions {
+		if sub.ChatId == toId {
+			subscribed[sub.ChannelId] = true
+		}
+	}
+	for i, sub := range f.subscriptions {
+		if sub.ChatId == fromId && !subscribed[sub.ChannelId] {
+			f.subscriptions[i].ChatId = toId
+		}
+	}
+	for id, delivery := range f.deliveries {
+		if id.chatId != fromId {
+			continue
+		}
+		movedId := id
+		movedId.chatId = toId
+		if _, ok := f.deliveries[movedId]; ok {
+			continue
+		}
+		delete(f.deliveries, id)
+		delivery.ChatId = toId
+		f.deliveries[movedId] = delivery
+	}
+	targets := make(map[db.DeliveryTarget]bool)
+	for _, target := range f.targets {
+		if target.ChatId == toId {
+			targets[target.Target] = true
+		}
+	}
+	for i, target := range f.targets {
+		if target.ChatId == fromId && !targets[target.Target] {
+			f.targets[i].ChatId = toId
+		}
+	}
+	webhooks := make(map[string]bool)
+	for _, webhook := range f.webhooks {
+		if webhook.ChatId == toId {
+			webhooks[webhook.ChannelId] = true
+		}
+	}
+	for i, webhook := range f.webhooks {
+		if webhook.ChatId == fromId && !webhooks[webhook.ChannelId] {
+			f.webhooks[i].ChatId = toId
+		}
+	}
+	for i := range f.outbox {
+		if f.outbox[i].ChatId == fromId {
+			f.outbox[i].ChatId = toId
+		}
+	}
+	f.removeChat(fromId)
+	return nil
+}
+
+func coalesce[T any](values ...*T) *T {
+	for _, value := range values {
+		if value != nil {
+			return value
+		}
+	}
+	return nil
+}
+
+// removeChat removes the chat with the rows that reference it, like the cascades of the schema.
+// The caller holds the lock.
+func (f *fakeStorage) removeChat(id int64) {
+	delete(f.chats, id)
+	var subscriptions []db.Subscription
+	for _, sub := range f.subscriptions {
+		if sub.ChatId != id {
+			subscriptions = append(subscriptions, sub)
+		}
+	}
+	f.subscriptions = subscriptions
+	for deliveryId := range f.deliveries {
+		if deliveryId.chatId == id {
+			delete(f.deliveries, deliveryId)
+		}
+	}
+	var targets []db.ChatTarget
+	for _, target := range f.targets {
+		if target.ChatId != id {
+			targets = append(targets, target)
+		}
+	}
+	f.targets = targets
+	var channelIds []string
+	for _, webhook := range f.webhooks {
+		if webhook.ChatId == id {
+			channelIds = append(channelIds, webhook.ChannelId)
+		}
+	}
+	for _, channelId := range channelIds {
+		f.removeWebhook(id, channelId)
+	}
+	var outbox []db.OutboxMessage
+	for _, message := range f.outbox {
+		if message.ChatId != id {
+			outbox = append(outbox, message)
+		}
+	}
+	f.outbox = outbox
+}
+
+func (f *fakeStorage) PurgeDisabledChats(_ ctx.Context, disabledBefore time.Time) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var purged int64
+	for id, chat := range f.chats {
+		if !chat.Enabled && chat.DisabledAt != nil && chat.DisabledAt.Before(disabledBefore) {
+			f.removeChat(id)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+func (f *fakeStorage) SetChatTelegramChannel(_ ctx.Context, id int64, telegramChannelId *int64) error {
+	return f.updateChat(
+		id, func(chat *db.Chat) {
+			chat.TelegramChannelId = telegramChannelId
+		},
+	)
+}
+
+func (f *fakeStorage) SetChatCalendarToken(_ ctx.Context, id int64, token string) error {
+	return f.updateChat(
+		id, func(chat *db.Chat) {
+			chat.CalendarToken = &token
+		},
+	)
+}
+
+func (f *fakeStorage) GetChatByCalendarToken(_ ctx.Context, token string) (db.Chat, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, chat := range f.chats {
+		if chat.CalendarToken != nil && *chat.CalendarToken == token {
+			return chat, nil
+		}
+	}
+	return db.Chat{}, db.ErrNotFound
+}
+
+func (f *fakeStorage) TelegramChannelLinked(_ ctx.Context, telegramChannelId int64) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, chat := range f.chats {
+		if chat.TelegramChannelId != nil && *chat.TelegramChannelId == telegramChannelId {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (f *fakeStorage) UnlinkTelegramChannel(_ ctx.Context, telegramChannelId int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for id, chat := range f.chats {
+		if chat.TelegramChannelId != nil && *chat.TelegramChannelId == telegramChannelId {
+			chat.TelegramChannelId = nil
+			f.chats[id] = chat
+		}
+	}
+	return nil
+}
+
+func (f *fakeStorage) SetChatThread(_ ctx.Context, id int64, threadId *int) error {
+	return f.updateChat(
+		id, func(chat *db.Chat) {
+			chat.ThreadId = threadId
+		},
+	)
+}
+
+func (f *fakeStorage) GetChannel(_ ctx.Context, id string) (db.Channel, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	channel, ok := f.channels[id]
+	if !ok {
+		return db.Channel{}, db.ErrNotFound
+	}
+	return channel, nil
+}
+
+func (f *fakeStorage) ChannelExists(_ ctx.Context, id string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.channels[id]
+	return ok, nil
+}
+
+func (f *fakeStorage) AddChannel(_ ctx.Context, c db.Channel) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.channels[c.Id] = c
+	return nil
+}
+
+func (f *fakeStorage) PollChannels(_ ctx.Context, _ bool) <-chan db.Channel {
+	channels := make(chan db.Channel)
+	close(channels)
+	return channels
+}
+
+func (f *fakeStorage) HandleConfirmSubscription(w http.ResponseWriter, _ *http.Request) {
+	w.WriteHeader(http.StatusNotFound)
+}
+
+func (f *fakeStorage) AddSubscription(_ ctx.Context, userId int64, channelId string, threadId *int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, sub := range f.subscriptions {
+		if sub.ChatId == userId && sub.ChannelId == channelId {
+			f.subscriptions[i].ThreadId = threadId
+			return nil
+		}
+	}
+	f.subscriptions = append(
+		f.subscriptions, db.Subscription{
+			Id:        int64(len(f.subscriptions) + 1),
+			ChatId:    userId,
+			ChannelId: channelId,
+			ThreadId:  threadId,
+		},
+	)
+	return nil
+}
+
+func (f *fakeStorage) GetSubscribedChannels(_ ctx.Context, chatId int64) ([]db.Channel, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var channels []db.Channel
+	for _, sub := range f.subscriptions {
+		if sub.ChatId == chatId {
+			channel := f.channels[sub.ChannelId]
+			channel.SubscriptionThreadId = sub.ThreadId
+			channels = append(channels, channel)
+		}
+	}
+	return channels, nil
+}
+
+func (f *fakeStorage) GetSubscribedChats(_ ctx.Context, channelId string) ([]db.Chat, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var chats []db.Chat
+	for _, sub := range f.subscriptions {
+		chat, ok := f.chats[sub.ChatId]
+		if sub.ChannelId == channelId && ok && chat.Enabled {
+			chat.SubscriptionThreadId = sub.ThreadId
+			chats = append(chats, chat)
+		}
+	}
+	sort.Slice(
+		chats, func(i, j int) bool {
+			return chats[i].Id < chats[j].Id
+		},
+	)
+	return chats, nil
+}
+
+func (f *fakeStorage) GetStats(_ ctx.Context) (db.Stats, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	stats := db.Stats{
+		Chats:         len(f.chats),
+		Channels:      len(f.channels),
+		Subscriptions: len(f.subscriptions),
+	}
+	for _, chat := range f.chats {
+		if chat.Enabled {
+			stats.EnabledChats++
+		}
+	}
+	return stats, nil
+}
+
+func (f *fakeStorage) ListEnabledChats(_ ctx.Context) ([]db.Chat, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var chats []db.Chat
+	for _, chat := range f.chats {
+		if chat.Enabled {
+			chats = append(chats, chat)
+		}
+	}
+	sort.Slice(
+		chats, func(i, j int) bool {
+			return chats[i].Id < chats[j].Id
+		},
+	)
+	return chats, nil
+}
+
+func (f *fakeStorage) ListChats(_ ctx.Context, limit, offset int) ([]db.Chat, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	chats := []db.Chat{}
+	for _, chat := range f.chats {
+		chats = append(chats, chat)
+	}
+	sort.Slice(
+		chats, func(i, j int) bool {
+			return chats[i].Id < chats[j].Id
+		},
+	)
+	return page(chats, limit, offset), nil
+}
+
+func (f *fakeStorage) ListChannels(_ ctx.Context, limit, offset int) ([]db.Channel, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return page(f.sortedChannels(false), limit, offset), nil
+}
+
+func (f *fakeStorage) ListActiveChannels(_ ctx.Context) ([]db.Channel, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.sortedChannels(true), nil
+}
+
+func (f *fakeStorage) sortedChannels(subscribedOnly bool) []db.Channel {
+	subscribed := make(map[string]bool)
+	for _, sub := range f.subscriptions {
+		subscribed[sub.ChannelId] = true
+	}
+	channels := []db.Channel{}
+	for _, channel := range f.channels {
+		if !subscribedOnly || subscribed[channel.Id] {
+			channels = append(channels, channel)
+		}
+	}
+	sort.Slice(
+		channels, func(i, j int) bool {
+			return channels[i].Id < channels[j].Id
+		},
+	)
+	return channels
+}
+
+func (f *fakeStorage) ListStreams(_ ctx.Context, limit, offset int) ([]db.DoneStream, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	streams := []db.DoneStream{}
+	for id, state := range f.streams {
+		streams = append(streams, db.DoneStream{Id: id, State: state})
+	}
+	sort.Slice(
+		streams, func(i, j int) bool {
+			return streams[i].Id < streams[j].Id
+		},
+	)
+	return page(streams, limit, offset), nil
+}
+
+func (f *fakeStorage) GetStream(_ ctx.Context, id string) (db.DoneStream, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	state, ok := f.streams[id]
+	if !ok {
+		return db.DoneStream{}, db.ErrNotFound
+	}
+	return db.DoneStream{Id: id, State: state}, nil
+}
+
+func (f *fakeStorage) SetWebhook(_ ctx.Context, w *db.Webhook) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, webhook := range f.webhooks {
+		if webhook.ChatId == w.ChatId && webhook.ChannelId == w.ChannelId {
+			w.Id = webhook.Id
+			f.webhooks[i] = *w
+			return nil
+		}
+	}
+	f.lastId++
+	w.Id = f.lastId
+	f.webhooks = append(f.webhooks, *w)
+	return nil
+}
+
+func (f *fakeStorage) GetWebhook(_ ctx.Context, id int64) (db.Webhook, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, webhook := range f.webhooks {
+		if webhook.Id == id {
+			return webhook, nil
+		}
+	}
+	return db.Webhook{}, db.ErrNotFound
+}
+
+func (f *fakeStorage) ListWebhooks(_ ctx.Context, limit, offset int) ([]db.Webhook, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return page(append([]db.Webhook{}, f.webhooks...), limit, offset), nil
+}
+
+func (f *fakeStorage) GetChannelWebhooks(_ ctx.Context, channelId string) ([]db.Webhook, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var webhooks []db.Webhook
+	for _, webhook := range f.webhooks {
+		chat, ok := f.chats[webhook.ChatId]
+		if webhook.ChannelId != channelId || !ok || !chat.Enabled {
+			continue
+		}
+		for _, sub := range f.subscriptions {
+			if sub.ChatId == webhook.ChatId && sub.ChannelId == channelId {
+				webhooks = append(webhooks, webhook)
+				break
+			}
+		}
+	}
+	return webhooks, nil
+}
+
+func (f *fakeStorage) GetChatWebhooks(_ ctx.Context, chatId int64) ([]db.Webhook, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var webhooks []db.Webhook
+	for _, webhook := range f.webhooks {
+		if webhook.ChatId == chatId {
+			webhooks = append(webhooks, webhook)
+		}
+	}
+	return webhooks, nil
+}
+
+func (f *fakeStorage) RemoveWebhook(_ ctx.Context, chatId int64, channelId string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.removeWebhook(chatId, channelId) {
+		return db.ErrNotFound
+	}
+	return nil
+}
+
+// removeWebhook removes the webhook with its dead letters, the caller holds the lock
+func (f *fakeStorage) removeWebhook(chatId int64, channelId string) bool {
+	for i, webhook := range f.webhooks {
+		if webhook.ChatId == chatId && webhook.ChannelId == channelId {
+			f.webhooks = append(f.webhooks[:i], f.webhooks[i+1:]...)
+			var letters []db.DeadLetter
+			for _, letter := range f.deadLetters {
+				if letter.WebhookId != webhook.Id {
+					letters = append(letters, letter)
+				}
+			}
+			f.deadLetters = letters
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeStorage) AddDeadLetter(_ ctx.Context, l db.DeadLetter) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lastId++
+	l.Id = f.lastId
+	f.deadLetters = append(f.deadLetters, l)
+	return nil
+}
+
+func (f *fakeStorage) GetDeadLetter(_ ctx.Context, id int64) (db.DeadLetter, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, letter := range f.deadLetters {
+		if letter.Id == id {
+			return letter, nil
+		}
+	}
+	return db.DeadLetter{}, db.ErrNotFound
+}
+
+func (f *fakeStorage) ListDeadLetters(_ ctx.Context, limit, offset int) ([]db.DeadLetter, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	letters := []db.DeadLetter{}
+	for i := len(f.deadLetters) - 1; i >= 0; i-- {
+		letters = append(letters, f.deadLetters[i])
+	}
+	return page(letters, limit, offset), nil
+}
+
+func (f *fakeStorage) RemoveDeadLetter(_ ctx.Context, id int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var letters []db.DeadLetter
+	for _, letter := range f.deadLetters {
+		if letter.Id != id {
+			letters = append(letters, letter)
+		}
+	}
+	f.deadLetters = letters
+	return nil
+}
+
+func page[T any](items []T, limit, offset int) []T {
+	if offset >= len(items) {
+		return []T{}
+	}
+	items = items[offset:]
+	if limit < len(items) {
+		items = items[:limit]
+	}
+	return items
+}
+
+func (f *fakeStorage) RemoveSubscription(_ ctx.Context, chatId int64, channelId string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var subscriptions []db.Subscription
+	for _, sub := range f.subscriptions {
+		if sub.ChatId != chatId || sub.ChannelId != channelId {
+			subscriptions = append(subscriptions, sub)
+		}
+	}
+	f.subscriptions = subscriptions
+	f.removeWebhook(chatId, channelId)
+	return nil
+}
+
+func (f *fakeStorage) MarkDone(_ ctx.Context, streamId string, state db.StreamState) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.streams[streamId].Reached(state) {
+		return false, nil
+	}
+	f.streams[streamId] = state
+	return true, nil
+}
+
+func (f *fakeStorage) GetStreamState(_ ctx.Context, streamId string) (db.StreamState, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.streams[streamId], nil
+}
+
+func (f *fakeStorage) ClaimDelivery(
+	_ ctx.Context,
+	streamId string,
+	state db.StreamState,
+	chatId int64,
+	target db.DeliveryTarget,
+) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := deliveryId{streamId: streamId, state: state, chatId: chatId, target: target}
+	delivery, ok := f.deliveries[id]
+	if ok && delivery.Status != db.DeliveryStatusFailed {
+		return false, nil
+	}
+	f.deliveries[id] = db.Delivery{
+		StreamId: streamId,
+		State:    state,
+		ChatId:   chatId,
+		Target:   target,
+		Status:   db.DeliveryStatusPending,
+	}
+	return true, nil
+}
+
+func (f *fakeStorage) CompleteDelivery(
+	_ ctx.Context,
+	streamId string,
+	state db.StreamState,
+	chatId int64,
+	target db.DeliveryTarget,
+	status db.DeliveryStatus,
+	messageId *int,
+) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := deliveryId{streamId: streamId, state: state, chatId: chatId, target: target}
+	delivery, ok := f.deliveries[id]
+	if !ok {
+		return nil
+	}
+	delivery.Status = status
+	delivery.MessageId = messageId
+	f.deliveries[id] = delivery
+	return nil
+}
+
+func (f *fakeStorage) GetDeliveryStats(_ ctx.Context, streamId string) ([]db.DeliveryStats, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	counts := make(map[db.DeliveryStats]int)
+	for _, delivery := range f.deliveries {
+		if delivery.StreamId == streamId {
+			counts[db.DeliveryStats{Target: delivery.Target, State: delivery.State, Status: delivery.Status}]++
+		}
+	}
+	var stats []db.DeliveryStats
+	for stat, count := range counts {
+		stat.Count = count
+		stats = append(stats, stat)
+	}
+	return stats, nil
+}
+
+func (f *fakeStorage) SaveStream(_ ctx.Context, s db.Stream) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	saved, ok := f.streamDetails[s.Id]
+	if !ok {
+		f.streamDetails[s.Id] = s
+		return nil
+	}
+	if s.ScheduledStart == nil {
+		s.ScheduledStart = saved.ScheduledStart
+	}
+	if saved.ActualStart != nil {
+		s.ActualStart = saved.ActualStart
+	}
+	if s.Title == saved.Title && equalTimes(s.ScheduledStart, saved.ScheduledStart) && equalTimes(s.ActualStart, saved.ActualStart) {
+		return nil
+	}
+	s.Sequence = saved.Sequence + 1
+	f.streamDetails[s.Id] = s
+	return nil
+}
+
+func equalTimes(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+func (f *fakeStorage) GetCalendarStreams(_ ctx.Context, chatId int64, since time.Time, limit int) ([]db.Stream, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var streams []db.Stream
+	for _, s := range f.streamDetails {
+		start := s.ScheduledStart
+		if s.ActualStart != nil {
+			start = s.ActualStart
+		}
+		if start == nil || start.Before(since) {
+			continue
+		}
+		for _, sub := range f.subscriptions {
+			if sub.ChatId == chatId && sub.ChannelId == s.ChannelId {
+				s.ChannelTitle = f.channels[s.ChannelId].Title
+				streams = append(streams, s)
+				break
+			}
+		}
+	}
+	return page(streams, limit, 0), nil
+}
+
+func (f *fakeStorage) SetChatTarget(_ ctx.Context, t db.ChatTarget) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, target := range f.targets {
+		if target.ChatId == t.ChatId && target.Target == t.Target {
+			f.targets[i] = t
+			return nil
+		}
+	}
+	f.targets = append(f.targets, t)
+	return nil
+}
+
+func (f *fakeStorage) RemoveChatTarget(_ ctx.Context, chatId int64, target db.DeliveryTarget) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, t := range f.targets {
+		if t.ChatId == chatId && t.Target == target {
+			f.targets = append(f.targets[:i], f.targets[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (f *fakeStorage) GetSubscribedTargets(_ ctx.Context, channelId string, target db.DeliveryTarget) ([]db.ChatTarget, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var targets []db.ChatTarget
+	for _, t := range f.targets {
+		chat, ok := f.chats[t.ChatId]
+		if t.Target != target || !ok || !chat.Enabled {
+			continue
+		}
+		for _, sub := range f.subscriptions {
+			if sub.ChatId == t.ChatId && sub.ChannelId == channelId {
+				targets = append(targets, t)
+				break
+			}
+		}
+	}
+	return targets, nil
+}
+
+func (f *fakeStorage) AddOutboxMessage(_ ctx.Context, m db.OutboxMessage) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lastId++
+	m.Id = f.lastId
+	f.outbox = append(f.outbox, m)
+	return nil
+}
+
+func (f *fakeStorage) ClaimOutboxMessages(_ ctx.Context, lease time.Duration, limit int) ([]db.OutboxMessage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	var messages []db.OutboxMessage
+	for i, message := range f.outbox {
+		if len(messages) == limit {
+			break
+		}
+		if message.ClaimedUntil != nil && !message.ClaimedUntil.Before(now) {
+			continue
+		}
+		claimedUntil := now.Add(lease)
+		f.outbox[i].ClaimedUntil = &claimedUntil
+		messages = append(messages, f.outbox[i])
+	}
+	return messages, nil
+}
+
+func (f *fakeStorage) RemoveOutboxMessage(_ ctx.Context, id int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, message := range f.outbox {
+		if message.Id == id {
+			f.outbox = append(f.outbox[:i], f.outbox[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// fakeClock advances only when the dispatcher sleeps
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Sleep(ctx ctx.Context, duration time.Duration) error {
+	if ctx.Err() != nil {
+		return errDispatcherStopped
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if duration > 0 {
+		c.now = c.now.Add(duration)
+	}
+	return nil
+}
+
+// scriptedTelegram fails the attempts with the given errors in order and records the time of every attempt
+type scriptedTelegram struct {
+	*fakeTelegram
+	clock    *fakeClock
+	errs     []error
+	attempts []time.Time
+	// Called after every attempt
+	onAttempt func(attempt int)
+}
+
+func (f *scriptedTelegram) Send(to tele.Recipient, what interface{}, opts ...interface{}) (*tele.Message, error) {
+	f.attempts = append(f.attempts, f.clock.Now())
+	if f.onAttempt != nil {
+		defer f.onAttempt(len(f.attempts))
+	}
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		if err != nil {
+			return nil, err
+		}
+	}
+	return f.fakeTelegram.Send(to, what, opts...)
+}
+
+// telegramError returns the error telebot makes of the Bot API response.
+// Flood and migration errors can't be made directly, they keep the API error in an unexported field.
+func telegramError(response string) error {
+	server := httptest.NewServer(
+		http.HandlerFunc(func(writer http.ResponseWriter, _ *http.Request) {
+			_, _ = writer.Write([]byte(response))
+		}),
+	)
+	defer server.Close()
+	bot, err := tele.NewBot(tele.Settings{URL: server.URL, Token: "token", Offline: true})
+	if err != nil {
+		panic(err)
+	}
+	_, err = bot.Send(tele.ChatID(1), "text")
+	return err
+}
+
+type fakeTimeZones struct {
+	zone string
+}
+
+func (f *fakeTimeZones) GetTimeZone(_ ctx.Context, _, _ string) (string, error) {
+	return f.zone, nil
+}
+
+type sentMessage struct {
+	chatId   string
+	threadId int
+	text     string
+}
+
+// fakeTelegram records sent messages and fails sends to chats listed in errs
+type fakeTelegram struct {
+	mu     sync.Mutex
+	sent   []sentMessage
+	errs   map[string]error
+	roles  map[int64]tele.MemberStatus
+	chats  map[string]*tele.Chat
+	nextId int
+}
+
+func newFakeTelegram() *fakeTelegram {
+	return &fakeTelegram{
+		errs:  make(map[string]error),
+		roles: make(map[int64]tele.MemberStatus),
+		chats: make(map[string]*tele.Chat),
+	}
+}
+
+func (f *fakeTelegram) Send(to tele.Recipient, what interface{}, opts ...interface{}) (*tele.Message, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err, ok := f.errs[to.Recipient()]; ok {
+		return nil, err
+	}
+	message := sentMessage{chatId: to.Recipient(), text: what.(string)}
+	for _, opt := range opts {
+		if options, ok := opt.(*tele.SendOptions); ok {
+			message.threadId = options.ThreadID
+		}
+	}
+	f.sent = append(f.sent, message)
+	f.nextId++
+	return &tele.Message{ID: f.nextId}, nil
+}
+
+func (f *fakeTelegram) messages() []sentMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	messages := make([]sentMessage, len(f.sent))
+	copy(messages, f.sent)
+	sort.Slice(
+		messages, func(i, j int) bool {
+			return messages[i].chatId < messages[j].chatId
+		},
+	)
+	return messages
+}
+
+func (f *fakeTelegram) ChatMemberOf(_, user tele.Recipient) (*tele.ChatMember, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	u := user.(*tele.User)
+	role, ok := f.roles[u.ID]
+	if !ok {
+		role = tele.Member
+	}
+	return &tele.ChatMember{User: u, Role: role}, nil
+}
+
+func (f *fakeTelegram) ChatByID(id int64) (*tele.Chat, error) {
+	return f.ChatByUsername(tele.ChatID(id).Recipient())
+}
+
+func (f *fakeTelegram) ChatByUsername(name string) (*tele.Chat, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	chat, ok := f.chats[name]
+	if !ok {
+		return nil, tele.ErrChatNotFound
+	}
+	return chat, nil
+}
+
+// fakeContext implements the parts of tele.Context used by the handlers,
+// calling any other method panics on the nil embedded interface
+type fakeContext struct {
+	tele.Context
+	chat     *tele.Chat
+	sender   *tele.User
+	message  *tele.Message
+	callback *tele.Callback
+	member   *tele.ChatMemberUpdate
+	data     string
+	sent     []interface{}
+	response *tele.CallbackResponse
+	store    map[string]interface{}
+}
+
+func (c *fakeContext) Get(key string) interface{} {
+	return c.store[key]
+}
+
+func (c *fakeContext) Set(key string, value interface{}) {
+	if c.store == nil {
+		c.store = make(map[string]interface{})
+	}
+	c.store[key] = value
+}
+
+func (c *fakeContext) Chat() *tele.Chat {
+	return c.chat
+}
+
+func (c *fakeContext) Sender() *tele.User {
+	return c.sender
+}
+
+func (c *fakeContext) Message() *tele.Message {
+	return c.message
+}
+
+func (c *fakeContext) Callback() *tele.Callback {
+	return c.callback
+}
+
+func (c *fakeContext) ChatMember() *tele.ChatMemberUpdate {
+	return c.member
+}
+
+func (c *fakeContext) Data() string {
+	return c.data
+}
+
+func (c *fakeContext) Send(what interface{}, _ ...interface{}) error {
+	c.sent = append(c.sent, what)
+	return nil
+}
+
+func (c *fakeContext) Respond(response ...*tele.CallbackResponse) error {
+	if len(response) > 0 {
+		c.response = response[0]
+	}
+	return nil
+}
+
+type testService struct {
+	*Service
+	youtube  *fakeYouTube
+	db       *fakeStorage
+	telegram *fakeTelegram
+}
+
+func newTestService() testService {
+	yt := newFakeYouTube()
+	storage := newFakeStorage()
+	telegram := newFakeTelegram()
+	service := NewService(
+		yt,
+		storage,
+		mutex.NewBuilder(mutex.NewMemoryLocker()),
+		&fakeTimeZones{zone: "Europe/Amsterdam"},
+		telegram,
+		&tele.User{ID: 1, Username: "notifier_bot"},
+		nil,
+		youtube.HubYouTubeURL,
+		nil,
+		false,
+		4,
+		[]int64{testOperatorId},
+	)
+	return testService{
+		Service:  service,
+		youtube:  yt,
+		db:       storage,
+		telegram: telegram,
+	}
+}
@@ -0,0 +1,81 @@
+package bot
+
+import (
+	ctx "context"
+	"sync"
+	"time"
+	"youtube-stream-notifier-bot/db"
+	"youtube-stream-notifier-bot/logging"
+	"youtube-stream-notifier-bot/mutex"
+	"youtube-stream-notifier-bot/youtube"
+)
+
+const (
+	defaultNotificationWorkers = 32
+	// Stream lock is extended while its notifications are being sent
+	streamLockExtendInterval = time.Minute
+)
+
+// notifyJob is a notification about the stream for a single chat
+type notifyJob struct {
+	ctx    ctx.Context
+	stream youtube.StreamInfo
+	chat   db.Chat
+	done   func()
+}
+
+// startNotificationWorkers starts the bounded pool that processes notification jobs.
+// Workers live as long as the process, so jobs queued during shutdown still reach the outbox.
+func (s *Service) startNotificationWorkers(workers int) {
+	if workers <= 0 {
+		workers = defaultNotificationWorkers
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range s.jobs {
+				s.notifyChatAboutStream(job.ctx, job.chat, job.stream)
+				job.done()
+			}
+		}()
+	}
+}
+
+// fanOut queues a job for every chat and waits until all of them are completed
+func (s *Service) fanOut(ctx ctx.Context, stream youtube.StreamInfo, chats []db.Chat) {
+	var wg sync.WaitGroup
+	wg.Add(len(chats))
+	for _, chat := range chats {
+		s.jobs <- notifyJob{
+			ctx:    ctx,
+			stream: stream,
+			chat:   chat,
+			done:   wg.Done,
+		}
+	}
+	wg.Wait()
+}
+
+// keepLocked extends the lock until the returned function is called
+func keepLocked(lock mutex.Mutex) func() {
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(streamLockExtendInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				ok, err := lock.Extend()
+				if err != nil {
+					logger().Warn("unable to extend lock", "lock", lock.Name(), logging.Err(err))
+				} else if !ok {
+					logger().Warn("unable to extend lock, it is not held anymore", "lock", lock.Name())
+				}
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+	}
+}
@@ -0,0 +1,94 @@
+package bot
+
+import (
+	ctx "context"
+	"fmt"
+	"github.com/pkg/errors"
+	tele "gopkg.in/telebot.v3"
+	"youtube-stream-notifier-bot/db"
+	"youtube-stream-notifier-bot/templates"
+)
+
+func isGroup(chat *tele.Chat) bool {
+	return chat != nil && (chat.Type == tele.ChatGroup || chat.Type == tele.ChatSuperGroup)
+}
+
+// AdminOnly restricts the handler to chat administrators when it is called from a group.
+// Private chats are always allowed.
+func (s *Service) AdminOnly(next tele.HandlerFunc) tele.HandlerFunc {
+	return func(context tele.Context) error {
+		allowed, err := s.canManage(context)
+		if err != nil {
+			return err
+		}
+		if !allowed && context.Callback() != nil {
+			return context.Respond(&tele.CallbackResponse{Text: templates.AdminOnly})
+		}
+		if !allowed {
+			return context.Send(templates.AdminOnly)
+		}
+		return next(context)
+	}
+}
+
+func (s *Service) canManage(context tele.Context) (bool, error) {
+	chat := context.Chat()
+	if !isGroup(chat) || s.groupMembersCanManage {
+		return true, nil
+	}
+	// Anonymous administrators send messages on behalf of the group itself
+	message := context.Message()
+	if context.Callback() == nil && message != nil && message.SenderChat != nil && message.SenderChat.ID == chat.ID {
+		return true, nil
+	}
+	sender := context.Sender()
+	if sender == nil {
+		return false, nil
+	}
+	member, err := s.bot.ChatMemberOf(chat, sender)
+	if err != nil {
+		return false, errors.Wrapf(err, "cannot get chat member %v of chat %v", sender.ID, chat.ID)
+	}
+	return member.Role == tele.Administrator || member.Role == tele.Creator, nil
+}
+
+// OnAddedToGroup greets the group. Chat creation itself happens in OnMyChatMember,
+// both updates arrive together and are handled concurrently.
+func (s *Service) OnAddedToGroup(context tele.Context) error {
+	return context.Send(fmt.Sprintf(templates.GroupHello, s.me.Username))
+}
+
+// OnMyChatMember tracks the bot membership in groups and linked Telegram channels:
+// the chat is created or enabled when the bot joins and disabled when it leaves or is kicked.
+func (s *Service) OnMyChatMember(context tele.Context) error {
+	update := context.ChatMember()
+	if update == nil || update.NewChatMember == nil {
+		return nil
+	}
+	ctx := updateContext(context)
+	if isTelegramChannel(update.Chat) {
+		return s.onTelegramChannelMember(ctx, update)
+	}
+	if !isGroup(update.Chat) {
+		return nil
+	}
+	switch update.NewChatMember.Role {
+	case tele.Member, tele.Administrator, tele.Creator, tele.Restricted:
+		return s.enableChat(ctx, update.Chat.ID)
+	case tele.Left, tele.Kicked:
+		err := s.db.SetChatEnabled(ctx, update.Chat.ID, false)
+		if err != nil {
+			return errors.Wrapf(err, "cannot disable chat %v", update.Chat.ID)
+		}
+	}
+	return nil
+}
+
+// enableChat creates the chat or enables the existing one in a single statement
+func (s *Service) enableChat(ctx ctx.Context, id int64) error {
+	err := s.db.AddChat(ctx, db.Chat{Id: id, Enabled: true})
+	if err != nil {
+		return errors.Wrapf(err, "cannot enable chat %v", id)
+	}
+	return nil
+}
@@ -1,46 +1,85 @@
 package bot
 
 import (
+	ctx "context"
 	"encoding/xml"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/trace"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"time"
+	"youtube-stream-notifier-bot/logging"
+	"youtube-stream-notifier-bot/metrics"
+	"youtube-stream-notifier-bot/tracing"
 	"youtube-stream-notifier-bot/youtube"
 )
 
-func (s *Service) getFeedHandler(streams chan youtube.StreamInfo) func(
+// Results of incoming feed notifications in metrics
+const (
+	feedResultStream  = "stream"
+	feedResultIgnored = "ignored"
+	feedResultInvalid = "invalid"
+	feedResultError   = "error"
+)
+
+// streamEvent is the stream along with the context carrying the trace of its receipt
+type streamEvent struct {
+	ctx    ctx.Context
+	stream youtube.StreamInfo
+}
+
+func (s *Service) getFeedHandler(streams chan streamEvent) func(
 	writer http.ResponseWriter,
 	request *http.Request,
 ) {
 	return func(writer http.ResponseWriter, request *http.Request) {
+		receivedAt := time.Now()
+		traceCtx, span := tracing.Start(request.Context(), "feed receive")
+		defer span.End()
 		var feed youtube.Feed
 		body, err := ioutil.ReadAll(request.Body)
 		if err != nil {
-			log.Printf("unable to read feed body: %v", err.Error())
+			tracing.Fail(span, err)
+			logger().Error("unable to read feed body", logging.Err(err))
+			metrics.FeedNotifications.WithLabelValues(feedResultError).Inc()
 			writer.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 		err = xml.Unmarshal(body, &feed)
 		if err != nil {
-			log.Printf("unable to decode incoming feed: %v; source: %v", err.Error(), string(body))
+			tracing.Fail(span, err)
+			logger().Warn("unable to decode incoming feed", logging.Err(err), "body", string(body))
+			metrics.FeedNotifications.WithLabelValues(feedResultInvalid).Inc()
 			writer.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 		videoId := feed.Entry.VideoId
 		if len(videoId) == 0 {
-			log.Printf("videoId is missing, payload: %v", string(body))
+			logger().Warn("video id is missing in feed", "body", string(body))
+			metrics.FeedNotifications.WithLabelValues(feedResultInvalid).Inc()
 			return
 		}
-		info, err := s.youtube.GetStreamInfo(videoId)
+		span.SetAttributes(tracing.StreamId.String(videoId), tracing.ChannelId.String(feed.Entry.ChannelId))
+		info, err := s.youtube.GetStreamInfo(traceCtx, videoId)
 		if err != nil && errors.Is(err, youtube.ErrNotStream) {
+			metrics.FeedNotifications.WithLabelValues(feedResultIgnored).Inc()
 			return
 		}
 		if err != nil {
-			log.Printf("unable to get stream info: %v; videoId: %v", err.Error(), videoId)
+			tracing.Fail(span, err)
+			logger().Error("unable to get stream info", logging.StreamId, videoId, logging.Err(err))
+			metrics.FeedNotifications.WithLabelValues(feedResultError).Inc()
 			writer.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		streams <- info
+		metrics.FeedNotifications.WithLabelValues(feedResultStream).Inc()
+		info.ReceivedAt = receivedAt
+		// The request context is cancelled when the handler returns, only the trace is passed on
+		select {
+		case streams <- streamEvent{ctx: trace.ContextWithSpan(ctx.Background(), span), stream: info}:
+		case <-s.stopping:
+			// The hub retries failed deliveries
+			writer.WriteHeader(http.StatusServiceUnavailable)
+		}
 	}
 }
@@ -0,0 +1,150 @@
+package bot
+
+import (
+	ctx "context"
+	"crypto/tls"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+	"youtube-stream-notifier-bot/logging"
+)
+
+const (
+	readinessTimeout = time.Second * 5
+	// Time the hub has to confirm a new subscription
+	leaseConfirmationGrace = time.Minute * 10
+)
+
+const (
+	checkStatusOK          = "ok"
+	checkStatusUnavailable = "unavailable"
+)
+
+// readinessCheck returns an error if the dependency is not usable
+type readinessCheck struct {
+	name  string
+	check func(ctx ctx.Context) error
+}
+
+type readinessResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// healthHandler reports that the process is alive
+func healthHandler(writer http.ResponseWriter, _ *http.Request) {
+	writer.Header().Set("Content-Type", "text/plain")
+	_, err := writer.Write([]byte(checkStatusOK))
+	if err != nil {
+		logger().Warn("unable to write health response", logging.Err(err))
+	}
+}
+
+// readinessHandler runs the checks in parallel and responds with 503 if any of them fails
+func readinessHandler(checks []readinessCheck) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		ctx, cancel := ctx.WithTimeout(request.Context(), readinessTimeout)
+		defer cancel()
+		response := readinessResponse{Status: checkStatusOK, Checks: make(map[string]string, len(checks))}
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		wg.Add(len(checks))
+		for _, check := range checks {
+			check := check
+			go func() {
+				defer wg.Done()
+				err := runCheck(ctx, check)
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					response.Status = checkStatusUnavailable
+					response.Checks[check.name] = err.Error()
+					return
+				}
+				response.Checks[check.name] = checkStatusOK
+			}()
+		}
+		wg.Wait()
+		writer.Header().Set("Content-Type", "application/json")
+		if response.Status != checkStatusOK {
+			writer.WriteHeader(http.StatusServiceUnavailable)
+		}
+		err := json.NewEncoder(writer).Encode(response)
+		if err != nil {
+			logger().Warn("unable to write readiness response", logging.Err(err))
+		}
+	}
+}
+
+// runCheck stops waiting for the check when the context is done,
+// since not every dependency client accepts a context
+func runCheck(ctx ctx.Context, check readinessCheck) error {
+	result := make(chan error, 1)
+	go func() {
+		result <- check.check(ctx)
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "check timed out")
+	}
+}
+
+// leasesCheck fails if any subscribed channel has no current WebSub lease
+func leasesCheck(countExpired func(ctx ctx.Context, grace time.Duration) (int, error)) func(ctx ctx.Context) error {
+	return func(ctx ctx.Context) error {
+		expired, err := countExpired(ctx, leaseConfirmationGrace)
+		if err != nil {
+			return err
+		}
+		if expired > 0 {
+			return errors.Errorf("%v channels have expired leases", expired)
+		}
+		return nil
+	}
+}
+
+// CheckHealth requests the liveness endpoint of a bot running with the config, for container health checks
+func CheckHealth(parent ctx.Context, config Config) error {
+	s, err := newServer(config, nil)
+	if err != nil {
+		return err
+	}
+	host, port, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return errors.Wrap(err, "invalid listen address")
+	}
+	if ip := net.ParseIP(host); len(host) == 0 || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+	scheme := "http"
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if s.tls {
+		scheme = "https"
+		// The certificate is issued for the public domain, autocert also needs it as the server name
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		if len(config.AutocertDomains) > 0 {
+			transport.TLSClientConfig.ServerName = config.AutocertDomains[0]
+		}
+	}
+	requestCtx, cancel := ctx.WithTimeout(parent, readinessTimeout)
+	defer cancel()
+	healthURL := scheme + "://" + net.JoinHostPort(host, port) + "/healthz"
+	request, err := http.NewRequestWithContext(requestCtx, http.MethodGet, healthURL, nil)
+	if err != nil {
+		return errors.Wrap(err, "unable to create health request")
+	}
+	response, err := (&http.Client{Transport: transport}).Do(request)
+	if err != nil {
+		return errors.Wrap(err, "health request failed")
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return errors.Errorf("health check responded with %v", response.Status)
+	}
+	return nil
+}
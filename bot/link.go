@@ -0,0 +1,123 @@
+package bot
+
+import (
+	ctx "context"
+	"fmt"
+	"github.com/pkg/errors"
+	tele "gopkg.in/telebot.v3"
+	"strconv"
+	"strings"
+	"youtube-stream-notifier-bot/db"
+	"youtube-stream-notifier-bot/templates"
+)
+
+// LinkTelegramChannel links a Telegram channel to the current private chat.
+// Subscriptions are still managed from the private chat, but notifications are posted to the channel.
+func (s *Service) LinkTelegramChannel(context tele.Context) error {
+	chat := context.Chat()
+	if chat.Type != tele.ChatPrivate {
+		return context.Send(templates.LinkPrivateOnly)
+	}
+	ctx := updateContext(context)
+	_, err := s.db.GetChat(ctx, chat.ID)
+	if err != nil && errors.Is(err, db.ErrNotFound) {
+		return context.Send(templates.UserNotStarted)
+	}
+	if err != nil {
+		return err
+	}
+	data := strings.TrimSpace(context.Data())
+	if len(data) == 0 {
+		return context.Send(templates.EmptyLink, tele.ModeMarkdownV2)
+	}
+	channel, err := s.findTelegramChannel(data)
+	if err != nil {
+		return err
+	}
+	if !isTelegramChannel(channel) {
+		return context.Send(fmt.Sprintf(templates.LinkNotChannel, data))
+	}
+	botMember, err := s.bot.ChatMemberOf(channel, s.me)
+	if err != nil {
+		return errors.Wrapf(err, "cannot get bot membership in channel %v", channel.ID)
+	}
+	if botMember.Role != tele.Administrator || !botMember.CanPostMessages {
+		return context.Send(fmt.Sprintf(templates.LinkBotNotAdmin, data))
+	}
+	senderMember, err := s.bot.ChatMemberOf(channel, context.Sender())
+	if err != nil {
+		return errors.Wrapf(err, "cannot get sender membership in channel %v", channel.ID)
+	}
+	if senderMember.Role != tele.Administrator && senderMember.Role != tele.Creator {
+		return context.Send(fmt.Sprintf(templates.LinkSenderNotAdmin, data))
+	}
+	linked, err := s.db.TelegramChannelLinked(ctx, channel.ID)
+	if err != nil {
+		return errors.Wrapf(err, "cannot check if channel %v is linked", channel.ID)
+	}
+	if linked {
+		return context.Send(fmt.Sprintf(templates.LinkAlreadyLinked, data))
+	}
+	err = s.db.SetChatTelegramChannel(ctx, chat.ID, &channel.ID)
+	if err != nil {
+		return errors.Wrapf(err, "cannot link channel %v to chat %v", channel.ID, chat.ID)
+	}
+	return context.Send(fmt.Sprintf(templates.LinkSuccess, data))
+}
+
+func (s *Service) UnlinkTelegramChannel(context tele.Context) error {
+	ctx := updateContext(context)
+	id := context.Chat().ID
+	chat, err := s.db.GetChat(ctx, id)
+	if err != nil && errors.Is(err, db.ErrNotFound) {
+		return context.Send(templates.UserNotStarted)
+	}
+	if err != nil {
+		return err
+	}
+	if chat.TelegramChannelId == nil {
+		return context.Send(templates.NotLinked)
+	}
+	err = s.db.SetChatTelegramChannel(ctx, id, nil)
+	if err != nil {
+		return errors.Wrapf(err, "cannot unlink channel from chat %v", id)
+	}
+	return context.Send(templates.UnlinkSuccess)
+}
+
+// findTelegramChannel accepts a channel username (with or without @) or a numeric chat id
+func (s *Service) findTelegramChannel(data string) (*tele.Chat, error) {
+	id, err := strconv.ParseInt(data, 10, 64)
+	if err == nil {
+		return s.bot.ChatByID(id)
+	}
+	if !strings.HasPrefix(data, "@") {
+		data = "@" + data
+	}
+	return s.bot.ChatByUsername(data)
+}
+
+func isTelegramChannel(chat *tele.Chat) bool {
+	return chat != nil && (chat.Type == tele.ChatChannel || chat.Type == tele.ChatChannelPrivate)
+}
+
+// onTelegramChannelMember unlinks the channel when the bot loses the ability to post there
+func (s *Service) onTelegramChannelMember(ctx ctx.Context, update *tele.ChatMemberUpdate) error {
+	member := update.NewChatMember
+	if member.Role == tele.Administrator && member.CanPostMessages {
+		return nil
+	}
+	err := s.db.UnlinkTelegramChannel(ctx, update.Chat.ID)
+	if err != nil {
+		return errors.Wrapf(err, "cannot unlink channel %v", update.Chat.ID)
+	}
+	return nil
+}
+
+// deliveryTarget returns the Telegram chat where notifications for the chat are sent
+func deliveryTarget(chat db.Chat) int64 {
+	if chat.TelegramChannelId != nil {
+		return *chat.TelegramChannelId
+	}
+	return chat.Id
+}
@@ -0,0 +1,104 @@
+package bot
+
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme/autocert"
+	"net/http"
+	"net/url"
+)
+
+const (
+	defaultListenAddress = ":42069"
+	// Let's Encrypt validates the domain with the TLS-ALPN challenge on the standard HTTPS port
+	autocertListenAddress   = ":443"
+	defaultAutocertCacheDir = "./certs"
+)
+
+// server is the HTTP server of the bot, it serves HTTPS when certificates are configured
+type server struct {
+	*http.Server
+	certFile string
+	keyFile  string
+	tls      bool
+}
+
+func newServer(config Config, handler http.Handler) (*server, error) {
+	hasCertificate := len(config.TLSCertFile) > 0 || len(config.TLSKeyFile) > 0
+	if hasCertificate && (len(config.TLSCertFile) == 0 || len(config.TLSKeyFile) == 0) {
+		return nil, errors.New("both tlsCertFile and tlsKeyFile are required")
+	}
+	if hasCertificate && len(config.AutocertDomains) > 0 {
+		return nil, errors.New("tlsCertFile and autocertDomains cannot be used together")
+	}
+	s := &server{
+		Server:   &http.Server{Addr: config.ListenAddress, Handler: handler},
+		certFile: config.TLSCertFile,
+		keyFile:  config.TLSKeyFile,
+		tls:      hasCertificate,
+	}
+	if len(config.AutocertDomains) > 0 {
+		cacheDir := config.AutocertCacheDir
+		if len(cacheDir) == 0 {
+			cacheDir = defaultAutocertCacheDir
+		}
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(cacheDir),
+			HostPolicy: autocert.HostWhitelist(config.AutocertDomains...),
+			Email:      config.AutocertEmail,
+		}
+		s.TLSConfig = manager.TLSConfig()
+		s.tls = true
+	}
+	if len(s.Addr) == 0 {
+		s.Addr = defaultListenAddress
+		if len(config.AutocertDomains) > 0 {
+			s.Addr = autocertListenAddress
+		}
+	}
+	return s, nil
+}
+
+// serve blocks until the server is shut down
+func (s *server) serve() error {
+	if s.tls {
+		// Certificate files are empty with autocert, certificates come from TLSConfig
+		return s.ListenAndServeTLS(s.certFile, s.keyFile)
+	}
+	return s.ListenAndServe()
+}
+
+// callbackURL returns the base URL the WebSub hub calls back, nil means polling mode.
+// Without callbackURL the plain HTTP URL of the host is used.
+func callbackURL(config Config) (*string, error) {
+	if len(config.CallbackURL) == 0 {
+		if config.Host == nil {
+			return nil, nil
+		}
+		base := "http://" + *config.Host
+		return &base, nil
+	}
+	parsed, err := url.Parse(config.CallbackURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid callbackURL")
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || len(parsed.Host) == 0 {
+		return nil, errors.Errorf("callbackURL must be an absolute http or https URL: %v", config.CallbackURL)
+	}
+	return &config.CallbackURL, nil
+}
+
+// calendarURL returns the base URL of the calendar links, nil disables calendars
+func calendarURL(config Config, callback *string) (*string, error) {
+	if len(config.CalendarURL) == 0 {
+		return callback, nil
+	}
+	parsed, err := url.Parse(config.CalendarURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid calendarURL")
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || len(parsed.Host) == 0 {
+		return nil, errors.Errorf("calendarURL must be an absolute http or https URL: %v", config.CalendarURL)
+	}
+	return &config.CalendarURL, nil
+}
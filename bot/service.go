@@ -5,43 +5,73 @@ import (
 	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	tele "gopkg.in/telebot.v3"
 	"io/ioutil"
-	"log"
 	"math/rand"
 	"net/http"
 	"net/url"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 	"youtube-stream-notifier-bot/db"
-	"youtube-stream-notifier-bot/mutex"
+	"youtube-stream-notifier-bot/logging"
+	"youtube-stream-notifier-bot/metrics"
 	"youtube-stream-notifier-bot/templates"
-	"youtube-stream-notifier-bot/timezone"
+	"youtube-stream-notifier-bot/tracing"
 	"youtube-stream-notifier-bot/youtube"
 )
 
 type Service struct {
-	youtube       *youtube.Service
-	db            *db.DB
-	mb            *mutex.Builder
-	tz            *timezone.Service
-	bot           *tele.Bot
-	subscribeHost *string
-	lc            locationCache
+	youtube YouTube
+	db      Storage
+	mb      Locks
+	tz      TimeZones
+	bot     Telegram
+	// The bot user, used in group greetings and membership checks
+	me         *tele.User
+	dispatcher *Dispatcher
+	// Base URL the hub calls back, nil in polling mode
+	callbackURL *string
+	// WebSub hub subscribe URL
+	hubURL string
+	// Base URL of the calendar links, nil if calendars are disabled
+	calendarURL *string
+	// Allow any group member to manage subscriptions, not only administrators
+	groupMembersCanManage bool
+	// Telegram users allowed to use operator commands
+	operators map[int64]bool
+	lc        *locationCache
+	jobs      chan notifyJob
+	// Every stream is delivered to all sinks, Telegram is one of them
+	sinks    []Sink
+	webhooks *webhookSink
+	// Notifications are sent with this context, it is cancelled when the shutdown deadline is reached
+	deliveryCtx  ctx.Context
+	stopDelivery ctx.CancelFunc
+	// Closed when the shutdown starts, consumers stop taking new streams
+	stopping  chan struct{}
+	consumers sync.WaitGroup
 }
 
-type locationCache map[string]*time.Location
+type locationCache struct {
+	mu        sync.Mutex
+	locations map[string]*time.Location
+}
 
-func (lc locationCache) get(timeZone string) (*time.Location, error) {
-	if l, ok := lc[timeZone]; ok {
+func (lc *locationCache) get(timeZone string) (*time.Location, error) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if l, ok := lc.locations[timeZone]; ok {
 		return l, nil
 	}
 	location, err := time.LoadLocation(timeZone)
 	if err != nil {
 		return nil, err
 	}
-	lc[timeZone] = location
+	lc.locations[timeZone] = location
 	return location, nil
 }
 
@@ -57,35 +87,71 @@ const (
 )
 
 func NewService(
-	youtube *youtube.Service,
-	db *db.DB,
-	mb *mutex.Builder,
-	tz *timezone.Service,
-	bot *tele.Bot,
-	subscribeHost *string,
+	youtube YouTube,
+	db Storage,
+	mb Locks,
+	tz TimeZones,
+	bot Telegram,
+	me *tele.User,
+	callbackURL *string,
+	hubURL string,
+	calendarURL *string,
+	groupMembersCanManage bool,
+	notificationWorkers int,
+	operatorIds []int64,
 ) *Service {
-	return &Service{
-		youtube:       youtube,
-		db:            db,
-		mb:            mb,
-		tz:            tz,
-		bot:           bot,
-		subscribeHost: subscribeHost,
-		lc:            make(map[string]*time.Location),
-	}
+	deliveryCtx, stopDelivery := ctx.WithCancel(ctx.Background())
+	operators := make(map[int64]bool)
+	for _, id := range operatorIds {
+		operators[id] = true
+	}
+	service := &Service{
+		youtube:               youtube,
+		db:                    db,
+		mb:                    mb,
+		tz:                    tz,
+		bot:                   bot,
+		me:                    me,
+		dispatcher:            NewDispatcher(bot),
+		callbackURL:           callbackURL,
+		hubURL:                hubURL,
+		calendarURL:           calendarURL,
+		groupMembersCanManage: groupMembersCanManage,
+		operators:             operators,
+		lc:                    &locationCache{locations: make(map[string]*time.Location)},
+		jobs:                  make(chan notifyJob),
+		deliveryCtx:           deliveryCtx,
+		stopDelivery:          stopDelivery,
+		stopping:              make(chan struct{}),
+	}
+	service.webhooks = newWebhookSink(db, service.consume)
+	service.sinks = []Sink{
+		&telegramSink{service},
+		newDiscordSink(db),
+		newSlackSink(db),
+		service.webhooks,
+	}
+	service.startNotificationWorkers(notificationWorkers)
+	return service
 }
 
 func (s *Service) Start(context tele.Context) error {
+	ctx := updateContext(context)
 	id := context.Chat().ID
-	_, err := s.db.GetChat(id)
+	chat, err := s.db.GetChat(ctx, id)
 	if err != nil && !errors.Is(err, db.ErrNotFound) {
 		return err
 	}
 	if err != nil {
-		err := s.addChat(context, id)
+		err := s.addChat(ctx, context, id)
 		if err != nil {
 			return err
 		}
+	} else if !chat.Enabled {
+		err := s.db.SetChatEnabled(ctx, id, true)
+		if err != nil {
+			return errors.Wrapf(err, "cannot enable chat %v", id)
+		}
 	}
 	err = context.Send(templates.Hello)
 	if err != nil {
@@ -94,8 +160,9 @@ func (s *Service) Start(context tele.Context) error {
 	return nil
 }
 
-func (s *Service) addChat(context tele.Context, id int64) error {
+func (s *Service) addChat(ctx ctx.Context, context tele.Context, id int64) error {
 	err := s.db.AddChat(
+		ctx,
 		db.Chat{
 			Id:      id,
 			Enabled: true,
@@ -104,7 +171,7 @@ func (s *Service) addChat(context tele.Context, id int64) error {
 	if err != nil {
 		sendErr := context.Send(templates.InitializationError)
 		if sendErr != nil {
-			log.Printf("During sending initialization error message occured error: %v", sendErr.Error())
+			logger().Error("unable to send initialization error message", logging.ChatId, id, logging.Err(sendErr))
 		}
 		return err
 	}
@@ -112,8 +179,9 @@ func (s *Service) addChat(context tele.Context, id int64) error {
 }
 
 func (s *Service) AddSubscription(context tele.Context) error {
+	ctx := updateContext(context)
 	id := context.Chat().ID
-	_, err := s.db.GetChat(id)
+	_, err := s.db.GetChat(ctx, id)
 	if err != nil && errors.Is(err, db.ErrNotFound) {
 		err := context.Send(templates.UserNotStarted)
 		if err != nil {
@@ -128,7 +196,7 @@ func (s *Service) AddSubscription(context tele.Context) error {
 	if len(data) == 0 {
 		return context.Send(templates.EmptyAdd, tele.ModeMarkdownV2)
 	}
-	channel, err := s.youtube.FindChannel(ctx.Background(), data)
+	channel, err := s.youtube.FindChannel(ctx, data)
 	if err != nil && errors.Is(err, youtube.ErrBadUrl) {
 		err := context.Send(err.Error())
 		if err != nil {
@@ -146,12 +214,36 @@ func (s *Service) AddSubscription(context tele.Context) error {
 	if err != nil {
 		return err
 	}
-	exists, err := s.db.ChannelExists(channel.Id)
+	threadId := messageThread(context)
+	err = s.subscribeChat(ctx, id, channel, threadId)
+	if err != nil {
+		return err
+	}
+	return context.Send(templates.AddSuccess, threadOptions(threadId))
+}
+
+// subscribeChat subscribes the chat to the channel, the channel is added if it is new
+func (s *Service) subscribeChat(ctx ctx.Context, chatId int64, channel youtube.ChannelInfo, threadId *int) error {
+	err := s.ensureChannel(ctx, channel)
+	if err != nil {
+		return err
+	}
+	err = s.db.AddSubscription(ctx, chatId, channel.Id, threadId)
+	if err != nil {
+		return errors.Wrap(err, "cannot add user-channel link")
+	}
+	return nil
+}
+
+// ensureChannel adds the channel if it is new
+func (s *Service) ensureChannel(ctx ctx.Context, channel youtube.ChannelInfo) error {
+	exists, err := s.db.ChannelExists(ctx, channel.Id)
 	if err != nil {
 		return errors.Wrapf(err, "cannot check if channel %v exists", channel.Id)
 	}
 	if !exists {
 		err := s.db.AddChannel(
+			ctx,
 			db.Channel{
 				Id:         channel.Id,
 				Title:      channel.Title,
@@ -162,16 +254,12 @@ func (s *Service) AddSubscription(context tele.Context) error {
 			return errors.Wrap(err, "cannot add channel to db")
 		}
 	}
-	err = s.db.AddSubscription(id, channel.Id)
-	if err != nil {
-		return errors.Wrap(err, "cannot add user-channel link")
-	}
-	return context.Send(templates.AddSuccess)
+	return nil
 }
 
 func (s *Service) ListSubscribedChannels(context tele.Context) error {
 	id := context.Chat().ID
-	subscriptions, err := s.db.GetSubscribedChannels(id)
+	subscriptions, err := s.db.GetSubscribedChannels(updateContext(context), id)
 	if err != nil {
 		return errors.Wrap(err, "cannot get added channels")
 	}
@@ -188,7 +276,7 @@ func (s *Service) ListSubscribedChannels(context tele.Context) error {
 
 func (s *Service) ShowRemoveSubscription(context tele.Context) error {
 	id := context.Chat().ID
-	channels, err := s.db.GetSubscribedChannels(id)
+	channels, err := s.db.GetSubscribedChannels(updateContext(context), id)
 	if err != nil {
 		return errors.Wrap(err, "cannot get added channels")
 	}
@@ -214,11 +302,12 @@ func (s *Service) OnLocation(context tele.Context) error {
 		return errors.New("location is empty")
 	}
 
-	zone, err := s.tz.GetTimeZone(fmt.Sprintf("%f", location.Lat), fmt.Sprintf("%f", location.Lng))
+	ctx := updateContext(context)
+	zone, err := s.tz.GetTimeZone(ctx, fmt.Sprintf("%f", location.Lat), fmt.Sprintf("%f", location.Lng))
 	if err != nil {
 		return errors.Wrapf(err, "error on getting timezone by location lat: %v, lng: %v", location.Lat, location.Lng)
 	}
-	err = s.db.SetChatTimeZone(context.Chat().ID, zone)
+	err = s.db.SetChatTimeZone(ctx, context.Chat().ID, zone)
 	if err != nil {
 		return err
 	}
@@ -230,7 +319,7 @@ func (s *Service) ProcessCallback(context tele.Context) error {
 	data := context.Callback().Data
 	submatch := removeCallbackPattern.FindStringSubmatch(data)
 	if submatch != nil {
-		err := s.RemoveSubscription(chatId, submatch[removePatternIdIndex])
+		err := s.RemoveSubscription(updateContext(context), chatId, submatch[removePatternIdIndex])
 		if err != nil {
 			return err
 		}
@@ -239,56 +328,80 @@ func (s *Service) ProcessCallback(context tele.Context) error {
 	return errors.New("couldn't get channel data from remove callback")
 }
 
-func (s *Service) RemoveSubscription(chatId int64, channelId string) error {
-	return s.db.RemoveSubscription(chatId, channelId)
+func (s *Service) RemoveSubscription(ctx ctx.Context, chatId int64, channelId string) error {
+	return s.db.RemoveSubscription(ctx, chatId, channelId)
 }
 
 func (s *Service) StartPollingMode(ctx ctx.Context) {
 	dbChannels := s.db.PollChannels(ctx, false)
 	channels := transformChannels(dbChannels)
-	streams := s.youtube.PollStreams(channels)
-	go func() {
-		for stream := range streams {
-			s.notifyAboutStream(stream)
+	streams := s.youtube.PollStreams(ctx, channels)
+	s.consume(func() {
+		for {
+			select {
+			case <-s.stopping:
+				return
+			case stream, ok := <-streams:
+				if !ok {
+					return
+				}
+				s.notifyAboutStream(s.deliveryCtx, stream)
+			}
 		}
-	}()
+	})
 }
 
 func (s *Service) StartSubscriptionMode(ctx ctx.Context, router *mux.Router) error {
-	if s.subscribeHost == nil {
-		return errors.New("Subscribe host is not specified")
+	if s.callbackURL == nil {
+		return errors.New("Callback URL is not specified")
+	}
+	callback := feedCallbackURL(*s.callbackURL)
+	parsed, err := url.Parse(callback)
+	if err != nil {
+		return errors.Wrapf(err, "invalid callback URL %v", callback)
 	}
 	channels := s.db.PollChannels(ctx, true)
-	go startSubscriptionRenewal(*s.subscribeHost, channels)
-	router.Methods(http.MethodGet).Path("/video").HandlerFunc(s.db.HandleConfirmSubscription)
-	streams := make(chan youtube.StreamInfo)
-	router.Methods(http.MethodPost).Path("/video").HandlerFunc(s.getFeedHandler(streams))
-	go func() {
-		for stream := range streams {
-			s.notifyAboutStream(stream)
+	go startSubscriptionRenewal(s.hubURL, callback, channels)
+	// The path prefix of the callback URL is served as is, it is not expected to be stripped by a proxy
+	router.Methods(http.MethodGet).Path(parsed.Path).HandlerFunc(s.db.HandleConfirmSubscription)
+	streams := make(chan streamEvent)
+	router.Methods(http.MethodPost).Path(parsed.Path).HandlerFunc(s.getFeedHandler(streams))
+	s.consume(func() {
+		for {
+			select {
+			case <-s.stopping:
+				return
+			case event := <-streams:
+				// Notification continues the trace of the feed
+				s.notifyAboutStream(trace.ContextWithSpan(s.deliveryCtx, trace.SpanFromContext(event.ctx)), event.stream)
+			}
 		}
-	}()
+	})
 	return nil
 }
 
-func startSubscriptionRenewal(subscriptionHost string, channels <-chan db.Channel) {
+// feedCallbackURL appends the feed path to the callback base URL
+func feedCallbackURL(base string) string {
+	return strings.TrimSuffix(base, "/") + youtube.HubCallbackPath
+}
+
+func startSubscriptionRenewal(hubURL string, callback string, channels <-chan db.Channel) {
 	for channel := range channels {
-		err := subscribe(subscriptionHost, channel.Id)
+		err := subscribe(hubURL, callback, channel.Id)
 		if err != nil {
-			log.Printf("error when trying to subscribe to channel: %v", err.Error())
+			logger().Error("unable to subscribe to channel", logging.ChannelId, channel.Id, logging.Err(err))
 		}
 	}
 }
 
-func subscribe(subscriptionHost string, channelId string) error {
+func subscribe(hubURL string, callback string, channelId string) error {
 	topic := fmt.Sprintf(youtube.HubTopicFormat, channelId)
-	callback := fmt.Sprintf(youtube.HubSubscribePathURLFormat, subscriptionHost)
 	values := url.Values{}
 	values.Set(youtube.HubTopic, topic)
 	values.Set(youtube.HubCallback, callback)
 	values.Set(youtube.HubVerify, youtube.HubVerifyAsync)
 	values.Set(youtube.HubMode, youtube.HubModeSubscribe)
-	response, err := subscribeClient.PostForm(youtube.HubYouTubeURL, values)
+	response, err := subscribeClient.PostForm(hubURL, values)
 	if err != nil {
 		return errors.Wrapf(err, "unable to make subscribe request")
 	}
@@ -296,7 +409,7 @@ func subscribe(subscriptionHost string, channelId string) error {
 	defer func() {
 		err := body.Close()
 		if err != nil {
-			log.Printf("error when closing the body: %v", err.Error())
+			logger().Warn("unable to close subscribe response body", logging.Err(err))
 		}
 	}()
 	code := response.StatusCode
@@ -324,46 +437,112 @@ func transformChannels(dbChannels <-chan db.Channel) <-chan youtube.ChannelInfo
 	return channels
 }
 
-func (s *Service) notifyAboutStream(stream youtube.StreamInfo) {
+func (s *Service) notifyAboutStream(ctx ctx.Context, stream youtube.StreamInfo) {
+	ctx, span := tracing.Start(
+		ctx,
+		"notify stream",
+		tracing.StreamId.String(stream.Id),
+		tracing.ChannelId.String(stream.Channel.Id),
+		attribute.String("state", string(db.StreamStateOf(stream.IsUpcoming))),
+	)
+	defer span.End()
+	l := logger().With(logging.StreamId, stream.Id, logging.ChannelId, stream.Channel.Id)
 	lock := s.mb.Stream(stream.Id)
+	_, lockSpan := tracing.Start(ctx, "lock stream")
+	lockStart := time.Now()
 	err := lock.Lock()
+	metrics.StreamLockWait.Observe(time.Since(lockStart).Seconds())
+	tracing.End(lockSpan, err)
 	if err != nil {
-		// TODO: debug log
-		fmt.Println(err.Error())
+		metrics.StreamLockFailures.Inc()
+		l.Warn("unable to lock stream", logging.Err(err))
 		return
 	}
 	defer func() {
 		_, err := lock.Unlock()
 		if err != nil {
-			log.Println(err.Error())
+			l.Error("unable to unlock stream", logging.Err(err))
 		}
 	}()
-	if s.isDone(stream) {
+	stopExtending := keepLocked(lock)
+	defer stopExtending()
+	s.saveStream(ctx, stream)
+	if s.isDone(ctx, stream) {
+		span.AddEvent("already done")
 		return
 	}
-	chats, err := s.db.GetSubscribedChats(stream.Channel.Id)
-	if err != nil {
-		fmt.Println(err.Error())
+	if !s.notifySinks(ctx, stream) {
 		return
 	}
-	for _, chat := range chats {
-		s.notifyChatAboutStream(chat, stream)
+	// The stream is marked as done even if the delivery was stopped, the rest of the chats are in the outbox
+	_, err = s.db.MarkDone(detach(ctx), stream.Id, db.StreamStateOf(stream.IsUpcoming))
+	if err != nil {
+		l.Error("unable to mark stream as done", logging.Err(err))
 	}
-	err = s.db.MarkDone(stream.Id, stream.IsUpcoming)
+}
+
+// notifySinks notifies all sinks in parallel and reports whether all of them succeeded
+func (s *Service) notifySinks(ctx ctx.Context, stream youtube.StreamInfo) bool {
+	var wg sync.WaitGroup
+	errs := make([]error, len(s.sinks))
+	wg.Add(len(s.sinks))
+	for i, sink := range s.sinks {
+		i, sink := i, sink
+		go func() {
+			defer wg.Done()
+			errs[i] = sink.Notify(ctx, stream)
+		}()
+	}
+	wg.Wait()
+	ok := true
+	for _, err := range errs {
+		if err != nil {
+			tracing.Fail(trace.SpanFromContext(ctx), err)
+			logger().Error(
+				"unable to notify about stream",
+				logging.StreamId, stream.Id,
+				logging.ChannelId, stream.Channel.Id,
+				logging.Err(err),
+			)
+			ok = false
+		}
+	}
+	return ok
+}
+
+func (s *Service) logDeliveryStats(ctx ctx.Context, streamId string) {
+	stats, err := s.db.GetDeliveryStats(ctx, streamId)
 	if err != nil {
-		log.Println(err.Error())
+		logger().Error("unable to get delivery stats", logging.StreamId, streamId, logging.Err(err))
+		return
+	}
+	attrs := []any{logging.StreamId, streamId}
+	for _, stat := range stats {
+		attrs = append(attrs, fmt.Sprintf("%v_%v_%v", stat.Target, stat.State, stat.Status), stat.Count)
 	}
+	logger().Info("stream delivered", attrs...)
 }
 
-func (s *Service) notifyChatAboutStream(chat db.Chat, stream youtube.StreamInfo) {
-	lock := s.mb.LockStreamChat(stream.Id, chat.Id)
+func (s *Service) notifyChatAboutStream(ctx ctx.Context, chat db.Chat, stream youtube.StreamInfo) {
+	ctx, span := tracing.Start(ctx, "notify chat", tracing.ChatId.Int64(chat.Id))
+	defer span.End()
+	key := deliveryKey{streamId: stream.Id, state: db.StreamStateOf(stream.IsUpcoming)}
 	// Stream is marked as done only when all chats are notified.
-	// So in case of a sudden shutdown we need to mark chats as notified.
-	// We do not need to unlock this lock.
-	err := lock.Lock()
+	// So in case of a sudden shutdown the delivery log tells which chats were already notified.
+	// Stopped delivery still claims the chat, the notification goes to the outbox.
+	claimed, err := s.db.ClaimDelivery(detach(ctx), key.streamId, key.state, chat.Id, db.DeliveryTargetTelegram)
 	if err != nil {
-		// TODO: debug log
-		fmt.Println(err.Error())
+		tracing.Fail(span, err)
+		logger().Error(
+			"unable to claim delivery",
+			logging.StreamId, stream.Id,
+			logging.ChatId, chat.Id,
+			logging.Err(err),
+		)
+		return
+	}
+	if !claimed {
+		span.AddEvent("already claimed")
 		return
 	}
 	var message string
@@ -373,7 +552,7 @@ func (s *Service) notifyChatAboutStream(chat db.Chat, stream youtube.StreamInfo)
 		if chat.TimeZone != nil {
 			location, err := s.lc.get(*chat.TimeZone)
 			if err != nil {
-				log.Printf("Unable to get location for time zone: %v", *chat.TimeZone)
+				logger().Warn("unable to get location for time zone", logging.ChatId, chat.Id, "time_zone", *chat.TimeZone)
 				location = time.UTC
 			}
 			scheduledStartTime = stream.ScheduledStart.In(location).Format(time.RFC850)
@@ -388,32 +567,19 @@ func (s *Service) notifyChatAboutStream(chat db.Chat, stream youtube.StreamInfo)
 	} else {
 		message = fmt.Sprintf(templates.Live, stream.Channel.Title, videoURL)
 	}
-	// TODO: Disable chat if bot blocked
-	_, err = s.bot.Send(tele.ChatID(chat.Id), message)
-	if err != nil {
-		fmt.Println(err.Error())
+	result := s.sendToChat(ctx, chat, message, &key)
+	span.SetAttributes(attribute.String("status", string(result.status)))
+	if result.status == db.DeliveryStatusSent && !stream.ReceivedAt.IsZero() {
+		metrics.DispatchLatency.Observe(time.Since(stream.ReceivedAt).Seconds())
 	}
+	s.completeDelivery(ctx, key, result)
 }
 
-func (s *Service) isDone(stream youtube.StreamInfo) bool {
-	if stream.IsUpcoming {
-		isUpcomingDone, err := s.db.IsUpcomingDone(stream.Id)
-		if err != nil {
-			fmt.Println(err.Error())
-			return true
-		}
-		if isUpcomingDone {
-			return true
-		}
-	} else {
-		isLiveDone, err := s.db.IsLiveDone(stream.Id)
-		if err != nil {
-			fmt.Println(err.Error())
-			return true
-		}
-		if isLiveDone {
-			return true
-		}
+func (s *Service) isDone(ctx ctx.Context, stream youtube.StreamInfo) bool {
+	state, err := s.db.GetStreamState(ctx, stream.Id)
+	if err != nil {
+		logger().Error("unable to get stream state", logging.StreamId, stream.Id, logging.Err(err))
+		return true
 	}
-	return false
+	return state.Reached(db.StreamStateOf(stream.IsUpcoming))
 }
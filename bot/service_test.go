@@ -0,0 +1,1300 @@
+package bot
+
+import (
+	ctx "context"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	tele "gopkg.in/telebot.v3"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"youtube-stream-notifier-bot/db"
+	"youtube-stream-notifier-bot/templates"
+	"youtube-stream-notifier-bot/youtube"
+)
+
+const (
+	testChannelURL = "https://www.youtube.com/channel/UCTSRIY3GLFYIpkR2QwyeklA"
+	testChannelId  = "UCTSRIY3GLFYIpkR2QwyeklA"
+	testChatId     = int64(100)
+	testUserId     = int64(200)
+	testOperatorId = int64(300)
+)
+
+var testChannel = youtube.ChannelInfo{Id: testChannelId, Title: "Test channel"}
+
+func privateContext(data string) *fakeContext {
+	return &fakeContext{
+		chat:    &tele.Chat{ID: testChatId, Type: tele.ChatPrivate},
+		sender:  &tele.User{ID: testUserId},
+		message: &tele.Message{Payload: data},
+		data:    data,
+	}
+}
+
+func (ts testService) startChat(id int64) {
+	err := ts.db.AddChat(ctx.Background(), db.Chat{Id: id, Enabled: true})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (ts testService) subscribe(chatId int64) {
+	err := ts.db.AddChannel(ctx.Background(), db.Channel{Id: testChannel.Id, Title: testChannel.Title})
+	if err != nil {
+		panic(err)
+	}
+	err = ts.db.AddSubscription(ctx.Background(), chatId, testChannel.Id, nil)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func TestAddSubscription(t *testing.T) {
+	ts := newTestService()
+	ts.startChat(testChatId)
+	ts.youtube.channels[testChannelURL] = testChannel
+	context := privateContext(testChannelURL)
+
+	err := ts.AddSubscription(context)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	channels, _ := ts.db.GetSubscribedChannels(ctx.Background(), testChatId)
+	if len(channels) != 1 || channels[0].Id != testChannelId {
+		t.Fatalf("expected subscription to %v, got %v", testChannelId, channels)
+	}
+	if len(context.sent) != 1 || context.sent[0] != templates.AddSuccess {
+		t.Fatalf("expected success message, got %v", context.sent)
+	}
+}
+
+func TestAddSubscriptionNotStarted(t *testing.T) {
+	ts := newTestService()
+	context := privateContext(testChannelURL)
+
+	err := ts.AddSubscription(context)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(context.sent) != 1 || context.sent[0] != templates.UserNotStarted {
+		t.Fatalf("expected not started message, got %v", context.sent)
+	}
+}
+
+func TestAddSubscriptionEmpty(t *testing.T) {
+	ts := newTestService()
+	ts.startChat(testChatId)
+	context := privateContext("")
+
+	err := ts.AddSubscription(context)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(context.sent) != 1 || context.sent[0] != templates.EmptyAdd {
+		t.Fatalf("expected empty add message, got %v", context.sent)
+	}
+}
+
+func TestAddSubscriptionBadUrl(t *testing.T) {
+	ts := newTestService()
+	ts.startChat(testChatId)
+	context := privateContext("not a url")
+
+	err := ts.AddSubscription(context)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	channels, _ := ts.db.GetSubscribedChannels(ctx.Background(), testChatId)
+	if len(channels) != 0 {
+		t.Fatalf("expected no subscriptions, got %v", channels)
+	}
+}
+
+func TestAddSubscriptionInGroupRequiresAdmin(t *testing.T) {
+	ts := newTestService()
+	groupId := int64(-100)
+	ts.startChat(groupId)
+	ts.youtube.channels[testChannelURL] = testChannel
+	context := privateContext(testChannelURL)
+	context.chat = &tele.Chat{ID: groupId, Type: tele.ChatSuperGroup}
+	handler := ts.AdminOnly(ts.AddSubscription)
+
+	err := handler(context)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(context.sent) != 1 || context.sent[0] != templates.AdminOnly {
+		t.Fatalf("expected admin only message, got %v", context.sent)
+	}
+
+	ts.telegram.roles[testUserId] = tele.Administrator
+	err = handler(context)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	channels, _ := ts.db.GetSubscribedChannels(ctx.Background(), groupId)
+	if len(channels) != 1 {
+		t.Fatalf("expected administrator to subscribe, got %v", channels)
+	}
+}
+
+func TestJoinGroupUpdatesConcurrently(t *testing.T) {
+	ts := newTestService()
+	group := &tele.Chat{ID: -100, Type: tele.ChatGroup}
+	zone := "Europe/Amsterdam"
+	_ = ts.db.AddChat(ctx.Background(), db.Chat{Id: group.ID, TimeZone: &zone})
+	_ = ts.db.SetChatEnabled(ctx.Background(), group.ID, false)
+	added := &fakeContext{chat: group}
+	member := &fakeContext{
+		chat: group,
+		member: &tele.ChatMemberUpdate{
+			Chat:          group,
+			NewChatMember: &tele.ChatMember{Role: tele.Member},
+		},
+	}
+
+	// Telegram sends both updates when the bot joins, telebot handles them in parallel
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		errs[0] = ts.OnAddedToGroup(added)
+	}()
+	go func() {
+		defer wg.Done()
+		errs[1] = ts.OnMyChatMember(member)
+	}()
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	chat, _ := ts.db.GetChat(ctx.Background(), group.ID)
+	if !chat.Enabled || chat.DisabledAt != nil || chat.TimeZone == nil {
+		t.Fatalf("expected rejoined group to be enabled with its settings, got %+v", chat)
+	}
+	if len(added.sent) != 1 {
+		t.Fatalf("expected group greeting, got %v", added.sent)
+	}
+}
+
+func TestDisableChatOperatorOnly(t *testing.T) {
+	ts := newTestService()
+	groupId := int64(-100)
+	ts.startChat(groupId)
+	context := privateContext(fmt.Sprint(groupId))
+	handler := ts.OperatorOnly(ts.DisableChat)
+
+	err := handler(context)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	chat, _ := ts.db.GetChat(ctx.Background(), groupId)
+	if !chat.Enabled || len(context.sent) != 0 {
+		t.Fatalf("expected command of non-operator to be ignored, got %v", context.sent)
+	}
+
+	context.sender = &tele.User{ID: testOperatorId}
+	err = handler(context)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	chat, _ = ts.db.GetChat(ctx.Background(), groupId)
+	if chat.Enabled {
+		t.Fatal("expected chat to be disabled")
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	ts := newTestService()
+	ts.startChat(-100)
+	ts.startChat(-200)
+	err := ts.db.AddChat(ctx.Background(), db.Chat{Id: -300, Enabled: false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	context := privateContext("Maintenance tonight")
+	context.sender = &tele.User{ID: testOperatorId}
+
+	err = ts.Broadcast(context)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	shutdownCtx, cancel := ctx.WithTimeout(ctx.Background(), time.Second*5)
+	defer cancel()
+	err = ts.Shutdown(shutdownCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := ts.telegram.messages()
+	if len(messages) != 3 {
+		t.Fatalf("expected broadcast to 2 enabled chats and a report, got %v", messages)
+	}
+	report := messages[2]
+	if report.chatId != tele.ChatID(testChatId).Recipient() || report.text != fmt.Sprintf(templates.BroadcastDone, 2, 0) {
+		t.Fatalf("unexpected report: %v", report)
+	}
+}
+
+func TestProcessCallbackRemovesSubscription(t *testing.T) {
+	ts := newTestService()
+	ts.startChat(testChatId)
+	ts.subscribe(testChatId)
+	data := fmt.Sprintf("\f/remove id:%v;t:%v", testChannel.Id, testChannel.Title)
+	context := privateContext(data)
+	context.callback = &tele.Callback{Data: data}
+
+	err := ts.ProcessCallback(context)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	channels, _ := ts.db.GetSubscribedChannels(ctx.Background(), testChatId)
+	if len(channels) != 0 {
+		t.Fatalf("expected subscription to be removed, got %v", channels)
+	}
+	expected := fmt.Sprintf(templates.RemoveSuccess, testChannel.Title)
+	if len(context.sent) != 1 || context.sent[0] != expected {
+		t.Fatalf("expected remove message, got %v", context.sent)
+	}
+}
+
+func TestProcessCallbackUnknownData(t *testing.T) {
+	ts := newTestService()
+	context := privateContext("unknown")
+	context.callback = &tele.Callback{Data: "unknown"}
+
+	err := ts.ProcessCallback(context)
+	if err == nil {
+		t.Fatal("expected error for unknown callback data")
+	}
+}
+
+func TestNotifyAboutStream(t *testing.T) {
+	ts := newTestService()
+	ts.startChat(testChatId)
+	ts.startChat(testChatId + 1)
+	ts.subscribe(testChatId)
+	ts.subscribe(testChatId + 1)
+	stream := youtube.StreamInfo{Id: "video", Channel: testChannel, Title: "Live"}
+
+	ts.notifyAboutStream(ctx.Background(), stream)
+	// Notifications are sent only once
+	ts.notifyAboutStream(ctx.Background(), stream)
+
+	messages := ts.telegram.messages()
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 notifications, got %v", messages)
+	}
+	expected := fmt.Sprintf(templates.Live, testChannel.Title, "https://youtube.com/watch?v=video")
+	for _, message := range messages {
+		if message.text != expected {
+			t.Fatalf("unexpected notification: %v", message.text)
+		}
+	}
+	state, _ := ts.db.GetStreamState(ctx.Background(), stream.Id)
+	if state != db.StreamStateLive {
+		t.Fatalf("expected stream to be marked as live, got %v", state)
+	}
+	stats, _ := ts.db.GetDeliveryStats(ctx.Background(), stream.Id)
+	if len(stats) != 1 || stats[0].Status != db.DeliveryStatusSent || stats[0].Count != 2 {
+		t.Fatalf("expected 2 sent deliveries, got %v", stats)
+	}
+}
+
+func TestClassifySendError(t *testing.T) {
+	migratedErr := telegramError(
+		`{"ok":false,"error_code":400,"description":"Bad Request: group chat was upgraded to a supergroup chat",` +
+			`"parameters":{"migrate_to_chat_id":-1001}}`,
+	)
+	tests := []struct {
+		name           string
+		err            error
+		wantFailure    sendFailure
+		wantMigratedTo int64
+	}{
+		{name: "blocked", err: tele.ErrBlockedByUser, wantFailure: sendFailureBlocked},
+		{name: "deactivated", err: tele.ErrUserIsDeactivated, wantFailure: sendFailureBlocked},
+		{name: "not started", err: tele.ErrNotStartedByUser, wantFailure: sendFailureBlocked},
+		{name: "kicked from group", err: tele.ErrKickedFromGroup, wantFailure: sendFailureKicked},
+		{name: "kicked from supergroup", err: tele.ErrKickedFromSuperGroup, wantFailure: sendFailureKicked},
+		{name: "kicked from channel", err: tele.ErrKickedFromChannel, wantFailure: sendFailureKicked},
+		{name: "chat not found", err: tele.ErrChatNotFound, wantFailure: sendFailureChatNotFound},
+		{name: "migrated", err: migratedErr, wantFailure: sendFailureMigrated, wantMigratedTo: -1001},
+		{name: "wrapped", err: errors.Wrap(tele.ErrBlockedByUser, "unable to send"), wantFailure: sendFailureBlocked},
+		{name: "other api error", err: tele.NewError(400, "Bad Request: message is too long"), wantFailure: sendFailureOther},
+		{name: "network error", err: errors.New("connection reset by peer"), wantFailure: sendFailureOther},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			failure, migratedTo := classifySendError(test.err)
+			if failure != test.wantFailure || migratedTo != test.wantMigratedTo {
+				t.Fatalf("expected %v %v, got %v %v", test.wantFailure, test.wantMigratedTo, failure, migratedTo)
+			}
+		})
+	}
+}
+
+func TestNotifyMigratedGroup(t *testing.T) {
+	ts := newTestService()
+	groupId, supergroupId := int64(-100), int64(-1001)
+	ts.startChat(groupId)
+	ts.subscribe(groupId)
+	ts.telegram.errs[tele.ChatID(groupId).Recipient()] = telegramError(
+		fmt.Sprintf(
+			`{"ok":false,"error_code":400,"description":"Bad Request: group chat was upgraded to a supergroup chat",`+
+				`"parameters":{"migrate_to_chat_id":%v}}`,
+			supergroupId,
+		),
+	)
+	stream := youtube.StreamInfo{Id: "video", Channel: testChannel, Title: "Live"}
+
+	ts.notifyAboutStream(ctx.Background(), stream)
+
+	messages := ts.telegram.messages()
+	if len(messages) != 1 || messages[0].chatId != tele.ChatID(supergroupId).Recipient() {
+		t.Fatalf("expected the notification to be sent to the supergroup, got %v", messages)
+	}
+	if _, err := ts.db.GetChat(ctx.Background(), groupId); !errors.Is(err, db.ErrNotFound) {
+		t.Fatalf("expected group to be migrated, got %v", err)
+	}
+	channels, _ := ts.db.GetSubscribedChannels(ctx.Background(), supergroupId)
+	if len(channels) != 1 {
+		t.Fatalf("expected subscription to be moved, got %v", channels)
+	}
+	delivery := ts.db.deliveries[deliveryId{stream.Id, db.StreamStateLive, supergroupId, db.DeliveryTargetTelegram}]
+	if delivery.Status != db.DeliveryStatusSent || delivery.MessageId == nil {
+		t.Fatalf("expected sent delivery for the supergroup, got %+v", delivery)
+	}
+}
+
+func TestMigrateChat(t *testing.T) {
+	ts := newTestService()
+	groupId, supergroupId := int64(-100), int64(-1001)
+	background := ctx.Background()
+	ts.startChat(groupId)
+	ts.subscribe(groupId)
+	_ = ts.db.AddChannel(background, db.Channel{Id: "UCother", Title: "Other"})
+	_ = ts.db.AddSubscription(background, groupId, "UCother", nil)
+	_ = ts.db.SetChatCalendarToken(background, groupId, "token")
+	_, _ = ts.db.ClaimDelivery(background, "video", db.StreamStateLive, groupId, db.DeliveryTargetTelegram)
+	_ = ts.db.SetChatTarget(background, db.ChatTarget{ChatId: groupId, Target: db.DeliveryTargetDiscord, URL: "discord"})
+	_ = ts.db.SetChatTarget(background, db.ChatTarget{ChatId: groupId, Target: db.DeliveryTargetSlack, URL: "group slack"})
+	_ = ts.db.SetWebhook(background, &db.Webhook{ChatId: groupId, ChannelId: testChannelId, URL: "group webhook"})
+	_ = ts.db.SetWebhook(background, &db.Webhook{ChatId: groupId, ChannelId: "UCother", URL: "other webhook"})
+	_ = ts.db.AddOutboxMessage(background, db.OutboxMessage{ChatId: groupId, Text: "queued"})
+	// The supergroup was already set up by a concurrent update
+	ts.startChat(supergroupId)
+	ts.subscribe(supergroupId)
+	_ = ts.db.SetChatTarget(background, db.ChatTarget{ChatId: supergroupId, Target: db.DeliveryTargetSlack, URL: "supergroup slack"})
+	_ = ts.db.SetWebhook(background, &db.Webhook{ChatId: supergroupId, ChannelId: testChannelId, URL: "supergroup webhook"})
+
+	err := ts.migrateChat(background, groupId, supergroupId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The service message and a failed send may both migrate the chat
+	err = ts.migrateChat(background, groupId, supergroupId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chat, _ := ts.db.GetChat(background, supergroupId)
+	if chat.CalendarToken == nil || *chat.CalendarToken != "token" {
+		t.Fatalf("expected calendar token to be moved, got %+v", chat)
+	}
+	channels, _ := ts.db.GetSubscribedChannels(background, supergroupId)
+	if len(channels) != 2 {
+		t.Fatalf("expected subscriptions to be merged, got %v", channels)
+	}
+	if _, ok := ts.db.deliveries[deliveryId{"video", db.StreamStateLive, supergroupId, db.DeliveryTargetTelegram}]; !ok {
+		t.Fatal("expected delivery to be moved")
+	}
+	urls := map[string]bool{}
+	for _, target := range ts.db.targets {
+		urls[fmt.Sprintf("%v %v", target.ChatId, target.URL)] = true
+	}
+	webhooks, _ := ts.db.GetChatWebhooks(background, supergroupId)
+	for _, webhook := range webhooks {
+		urls[fmt.Sprintf("%v %v", webhook.ChatId, webhook.URL)] = true
+	}
+	expected := []string{"-1001 discord", "-1001 supergroup slack", "-1001 supergroup webhook", "-1001 other webhook"}
+	for _, url := range expected {
+		if !urls[url] {
+			t.Fatalf("expected %v, got %v", url, urls)
+		}
+	}
+	if len(urls) != len(expected) || len(ts.db.webhooks) != 2 {
+		t.Fatalf("expected duplicates to be removed with the group, got %v", urls)
+	}
+	if len(ts.db.outbox) != 1 || ts.db.outbox[0].ChatId != supergroupId {
+		t.Fatalf("expected outbox message to be moved, got %+v", ts.db.outbox)
+	}
+}
+
+func TestNotifyAboutStreamSkipsUpcomingAfterLive(t *testing.T) {
+	ts := newTestService()
+	ts.startChat(testChatId)
+	ts.subscribe(testChatId)
+	live := youtube.StreamInfo{Id: "video", Channel: testChannel}
+	upcoming := youtube.StreamInfo{
+		Id:             "video",
+		Channel:        testChannel,
+		IsUpcoming:     true,
+		ScheduledStart: time.Now().Add(time.Hour),
+	}
+
+	ts.notifyAboutStream(ctx.Background(), live)
+	ts.notifyAboutStream(ctx.Background(), upcoming)
+
+	if messages := ts.telegram.messages(); len(messages) != 1 {
+		t.Fatalf("expected only live notification, got %v", messages)
+	}
+}
+
+func TestNotifyAboutStreamDisablesBlockedChat(t *testing.T) {
+	ts := newTestService()
+	ts.startChat(testChatId)
+	ts.subscribe(testChatId)
+	ts.telegram.errs[tele.ChatID(testChatId).Recipient()] = tele.ErrBlockedByUser
+
+	ts.notifyAboutStream(ctx.Background(), youtube.StreamInfo{Id: "video", Channel: testChannel})
+
+	chat, _ := ts.db.GetChat(ctx.Background(), testChatId)
+	if chat.Enabled {
+		t.Fatal("expected chat that blocked the bot to be disabled")
+	}
+}
+
+func TestFeedHandler(t *testing.T) {
+	ts := newTestService()
+	ts.startChat(testChatId)
+	ts.subscribe(testChatId)
+	ts.youtube.streams["video"] = youtube.StreamInfo{Id: "video", Channel: testChannel, Title: "Live"}
+	streams := make(chan streamEvent, 1)
+	handler := ts.getFeedHandler(streams)
+
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest(http.MethodPost, "/video", strings.NewReader(testFeed("video"))))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %v", recorder.Code)
+	}
+	event := <-streams
+	ts.notifyAboutStream(event.ctx, event.stream)
+	messages := ts.telegram.messages()
+	if len(messages) != 1 || messages[0].chatId != tele.ChatID(testChatId).Recipient() {
+		t.Fatalf("expected notification to chat %v, got %v", testChatId, messages)
+	}
+
+	// Regular videos are acknowledged and ignored
+	recorder = httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest(http.MethodPost, "/video", strings.NewReader(testFeed("regular"))))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %v", recorder.Code)
+	}
+	if len(streams) != 0 {
+		t.Fatal("expected regular video to be ignored")
+	}
+}
+
+func TestWebhookPoller(t *testing.T) {
+	poller := newWebhookPoller("secret")
+	dest := make(chan tele.Update, 1)
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		poller.Poll(nil, dest, stop)
+		close(stopped)
+	}()
+
+	request := httptest.NewRequest(http.MethodPost, telegramWebhookPath, strings.NewReader(`{"update_id":1}`))
+	recorder := httptest.NewRecorder()
+	poller.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("expected request without secret to be rejected, got %v", recorder.Code)
+	}
+
+	request = httptest.NewRequest(http.MethodPost, telegramWebhookPath, strings.NewReader(`{"update_id":2}`))
+	request.Header.Set(secretTokenHeader, "secret")
+	recorder = httptest.NewRecorder()
+	poller.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %v", recorder.Code)
+	}
+	update := <-dest
+	if update.ID != 2 {
+		t.Fatalf("unexpected update: %v", update.ID)
+	}
+	close(stop)
+	<-stopped
+}
+
+func TestCallbackURL(t *testing.T) {
+	host := "example.com:42069"
+	tests := []struct {
+		config   Config
+		expected string
+	}{
+		{config: Config{Host: &host}, expected: "http://example.com:42069/video"},
+		{config: Config{Host: &host, CallbackURL: "https://example.com/notifier/"}, expected: "https://example.com/notifier/video"},
+	}
+	for _, test := range tests {
+		callback, err := callbackURL(test.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := feedCallbackURL(*callback); actual != test.expected {
+			t.Fatalf("expected %v, got %v", test.expected, actual)
+		}
+	}
+	callback, err := callbackURL(Config{})
+	if err != nil || callback != nil {
+		t.Fatalf("expected polling mode without host, got %v, %v", callback, err)
+	}
+	_, err = callbackURL(Config{CallbackURL: "example.com/notifier"})
+	if err == nil {
+		t.Fatal("expected relative callback URL to be rejected")
+	}
+}
+
+func TestAPISubscriptions(t *testing.T) {
+	ts := newTestService()
+	ts.startChat(testChatId)
+	ts.youtube.channels[testChannelURL] = testChannel
+	router := mux.NewRouter()
+	ts.registerAPI(router, "token")
+	call := func(method, path, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, path, strings.NewReader(body))
+		request.Header.Set("Authorization", "Bearer token")
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		return recorder
+	}
+	path := fmt.Sprintf("/api/chats/%v/subscriptions", testChatId)
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	if recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("expected request without token to be rejected, got %v", recorder.Code)
+	}
+
+	recorder = call(http.MethodPost, path, fmt.Sprintf(`{"channel":"%v","threadId":7}`, testChannelId))
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("unexpected status: %v %v", recorder.Code, recorder.Body)
+	}
+	recorder = call(http.MethodGet, path, "")
+	var channels []apiChannel
+	err := json.NewDecoder(recorder.Body).Decode(&channels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(channels) != 1 || channels[0].Id != testChannelId || channels[0].Lease.Confirmed {
+		t.Fatalf("expected unconfirmed subscription to the channel, got %v", channels)
+	}
+	if channels[0].ThreadId == nil || *channels[0].ThreadId != 7 {
+		t.Fatalf("expected subscription thread 7, got %v", channels[0].ThreadId)
+	}
+
+	recorder = call(http.MethodPut, path+"/"+testChannelId+"/webhook", `{"url":"http://receiver:8080/events"}`)
+	var webhook apiWebhook
+	_ = json.NewDecoder(recorder.Body).Decode(&webhook)
+	if recorder.Code != http.StatusOK || webhook.ChatId != testChatId || len(webhook.Secret) == 0 {
+		t.Fatalf("expected webhook with generated secret, got %v %+v", recorder.Code, webhook)
+	}
+	recorder = call(http.MethodGet, path, "")
+	channels = nil
+	_ = json.NewDecoder(recorder.Body).Decode(&channels)
+	if channels[0].Webhook == nil || channels[0].Webhook.URL != webhook.URL || len(channels[0].Webhook.Secret) > 0 {
+		t.Fatalf("expected webhook without secret in the subscription, got %+v", channels[0].Webhook)
+	}
+	recorder = call(http.MethodPut, path+"/UCother/webhook", `{"url":"http://receiver:8080/events"}`)
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("expected webhook without subscription to be rejected, got %v", recorder.Code)
+	}
+
+	recorder = call(http.MethodDelete, path+"/"+testChannelId, "")
+	if recorder.Code != http.StatusNoContent {
+		t.Fatalf("unexpected status: %v", recorder.Code)
+	}
+	subscribed, _ := ts.db.GetSubscribedChannels(ctx.Background(), testChatId)
+	if len(subscribed) != 0 {
+		t.Fatalf("expected subscription to be removed, got %v", subscribed)
+	}
+
+	recorder = call(http.MethodGet, "/api/chats/42", "")
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("expected unknown chat to be not found, got %v", recorder.Code)
+	}
+}
+
+func TestAPIChannels(t *testing.T) {
+	ts := newTestService()
+	callback := "https://example.com"
+	ts.callbackURL = &callback
+	ts.startChat(testChatId)
+	ts.subscribe(testChatId)
+	router := mux.NewRouter()
+	ts.registerAPI(router, "token")
+	call := func(method, path string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, path, nil)
+		request.Header.Set("Authorization", "Bearer token")
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	recorder := call(http.MethodGet, "/api/channels/"+testChannelId)
+	var channel apiChannel
+	_ = json.NewDecoder(recorder.Body).Decode(&channel)
+	if recorder.Code != http.StatusOK || len(channel.Subscribers) != 1 || channel.Subscribers[0] != testChatId {
+		t.Fatalf("expected channel with its subscriber, got %v %+v", recorder.Code, channel)
+	}
+	recorder = call(http.MethodGet, "/api/channels/UCother")
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("expected unknown channel to be not found, got %v", recorder.Code)
+	}
+	recorder = call(http.MethodPost, "/api/channels/UCother/resubscribe")
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("expected resubscribe of unknown channel to be not found, got %v", recorder.Code)
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	ts := newTestService()
+	ts.webhooks.backoff = time.Millisecond
+	var mu sync.Mutex
+	var events []webhookEvent
+	requests := 0
+	accepting := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		// The first attempt fails and is retried
+		if requests == 1 {
+			writer.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(request.Body)
+		if request.Header.Get(signatureHeader) != signPayload("secret", body) {
+			writer.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var event webhookEvent
+		_ = json.Unmarshal(body, &event)
+		events = append(events, event)
+	}))
+	defer accepting.Close()
+	rejecting := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusGone)
+	}))
+	defer rejecting.Close()
+	rejectingChatId := testChatId + 1
+	for _, chatId := range []int64{testChatId, rejectingChatId} {
+		ts.startChat(chatId)
+		ts.subscribe(chatId)
+	}
+	accepted := db.Webhook{ChatId: testChatId, ChannelId: testChannelId, URL: accepting.URL, Secret: "secret"}
+	_ = ts.db.SetWebhook(ctx.Background(), &accepted)
+	rejected := db.Webhook{ChatId: rejectingChatId, ChannelId: testChannelId, URL: rejecting.URL, Secret: "secret"}
+	_ = ts.db.SetWebhook(ctx.Background(), &rejected)
+	scheduled := time.Date(2030, 1, 1, 18, 0, 0, 0, time.UTC)
+	stream := youtube.StreamInfo{
+		Id:             "video",
+		Channel:        testChannel,
+		Title:          "Upcoming",
+		IsUpcoming:     true,
+		ScheduledStart: scheduled,
+	}
+
+	ts.notifyAboutStream(ctx.Background(), stream)
+	// Shutdown waits for the background deliveries
+	err := ts.Shutdown(ctx.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 1 {
+		t.Fatalf("expected 1 accepted event, got %v", events)
+	}
+	event := events[0]
+	if event.Type != "stream.upcoming" || event.StreamId != stream.Id || !event.ScheduledStart.Equal(scheduled) {
+		t.Fatalf("unexpected event: %+v", event)
+	}
+	letters, _ := ts.db.ListDeadLetters(ctx.Background(), 10, 0)
+	if len(letters) != 1 || letters[0].WebhookId != rejected.Id || letters[0].Attempts != 1 {
+		t.Fatalf("expected rejected event to be dead lettered without retries, got %+v", letters)
+	}
+	for chatId, status := range map[int64]db.DeliveryStatus{
+		testChatId:      db.DeliveryStatusSent,
+		rejectingChatId: db.DeliveryStatusFailed,
+	} {
+		delivery := ts.db.deliveries[deliveryId{stream.Id, db.StreamStateUpcoming, chatId, db.DeliveryTargetWebhook}]
+		if delivery.Status != status {
+			t.Fatalf("expected %v webhook delivery for chat %v, got %+v", status, chatId, delivery)
+		}
+	}
+
+	// Delivery log prevents the second post of the same event
+	payload, _ := json.Marshal(events[0])
+	ts.webhooks.deliver(ctx.Background(), accepted, stream.Id, db.StreamStateUpcoming, payload)
+	if requests != 2 {
+		t.Fatalf("expected delivered event not to be posted again, got %v requests", requests)
+	}
+}
+
+func TestWebhookSinkStopped(t *testing.T) {
+	ts := newTestService()
+	ts.webhooks.backoff = time.Minute
+	ts.startChat(testChatId)
+	ts.subscribe(testChatId)
+	deliveryCtx, stop := ctx.WithCancel(ctx.Background())
+	unavailable := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		// Shutdown happens while the event waits for its retry
+		stop()
+		writer.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+	webhook := db.Webhook{ChatId: testChatId, ChannelId: testChannelId, URL: unavailable.URL, Secret: "secret"}
+	_ = ts.db.SetWebhook(ctx.Background(), &webhook)
+
+	ts.webhooks.deliver(deliveryCtx, webhook, "video", db.StreamStateLive, []byte("{}"))
+
+	letters, _ := ts.db.ListDeadLetters(ctx.Background(), 10, 0)
+	if len(letters) != 0 {
+		t.Fatalf("expected stopped event not to be dead lettered, got %+v", letters)
+	}
+	claimed, _ := ts.db.ClaimDelivery(ctx.Background(), "video", db.StreamStateLive, testChatId, db.DeliveryTargetWebhook)
+	if !claimed {
+		t.Fatal("expected stopped delivery to be claimed again by the next notification")
+	}
+}
+
+func TestWebhookCommand(t *testing.T) {
+	ts := newTestService()
+	ts.startChat(testChatId)
+	ts.subscribe(testChatId)
+
+	context := privateContext("https://example.com/events")
+	_ = ts.Webhook(context)
+	if context.sent[0] != templates.WebhookUsage {
+		t.Fatalf("expected usage without the channel, got %v", context.sent)
+	}
+	context = privateContext(testChannelId + " https://127.0.0.1/events")
+	_ = ts.Webhook(context)
+	if context.sent[0] != templates.WebhookInvalid {
+		t.Fatalf("expected local URL to be rejected, got %v", context.sent)
+	}
+	context = privateContext("UCother https://example.com/events")
+	_ = ts.Webhook(context)
+	if context.sent[0] != fmt.Sprintf(templates.ChannelNotFound, "UCother") {
+		t.Fatalf("expected channel without subscription to be rejected, got %v", context.sent)
+	}
+
+	// The url shown by /list is accepted as well as the channel id
+	context = privateContext("https://youtube.com/channel/" + testChannelId + " https://example.com/events")
+	_ = ts.Webhook(context)
+	webhooks, _ := ts.db.GetChatWebhooks(ctx.Background(), testChatId)
+	if len(webhooks) != 1 || webhooks[0].ChannelId != testChannelId || webhooks[0].URL != "https://example.com/events" {
+		t.Fatalf("expected webhook of the subscription, got %+v", webhooks)
+	}
+	if context.sent[0] != fmt.Sprintf(templates.WebhookSuccess, signatureHeader, webhooks[0].Secret) {
+		t.Fatalf("expected secret to be sent, got %v", context.sent)
+	}
+
+	// The secret is not posted to the group, the webhook is set only if the sender received it
+	groupId := int64(-100)
+	ts.startChat(groupId)
+	ts.subscribe(groupId)
+	sender := &tele.User{ID: testUserId}
+	ts.telegram.errs[sender.Recipient()] = &tele.Error{Code: 403, Description: "Forbidden: bot can't initiate conversation with a user"}
+	context = privateContext(testChannelId + " https://example.com/group")
+	context.chat = &tele.Chat{ID: groupId, Type: tele.ChatSuperGroup, Title: "Group"}
+	_ = ts.Webhook(context)
+	webhooks, _ = ts.db.GetChatWebhooks(ctx.Background(), groupId)
+	if context.sent[0] != templates.WebhookSecretNotSent || len(webhooks) != 0 {
+		t.Fatalf("expected no webhook without the private secret, got %v %+v", context.sent, webhooks)
+	}
+	delete(ts.telegram.errs, sender.Recipient())
+	context.sent = nil
+	_ = ts.Webhook(context)
+	webhooks, _ = ts.db.GetChatWebhooks(ctx.Background(), groupId)
+	if context.sent[0] != templates.WebhookSecretSent || len(webhooks) != 1 {
+		t.Fatalf("expected webhook with the secret sent privately, got %v %+v", context.sent, webhooks)
+	}
+	messages := ts.telegram.messages()
+	expected := fmt.Sprintf(templates.WebhookSecret, testChannelId, "Group", signatureHeader, webhooks[0].Secret)
+	if len(messages) != 1 || messages[0].chatId != sender.Recipient() || messages[0].text != expected {
+		t.Fatalf("expected the secret in a private message, got %v", messages)
+	}
+
+	err := ts.RemoveSubscription(ctx.Background(), testChatId, testChannelId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	webhooks, _ = ts.db.GetChatWebhooks(ctx.Background(), testChatId)
+	if len(webhooks) != 0 {
+		t.Fatalf("expected webhook to be removed with the subscription, got %+v", webhooks)
+	}
+	context = privateContext(testChannelId + " off")
+	_ = ts.Webhook(context)
+	if context.sent[0] != templates.WebhookNotSet {
+		t.Fatalf("expected missing webhook to be reported, got %v", context.sent)
+	}
+}
+
+func TestDiscordTarget(t *testing.T) {
+	ts := newTestService()
+	ts.startChat(testChatId)
+	ts.subscribe(testChatId)
+	var mu sync.Mutex
+	var messages []discordMessage
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		var message discordMessage
+		_ = json.NewDecoder(request.Body).Decode(&message)
+		messages = append(messages, message)
+		writer.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	handler := ts.SetChatTarget(db.DeliveryTargetDiscord)
+	context := privateContext("https://example.com/api/webhooks/1/token")
+	_ = handler(context)
+	if context.sent[0] != fmt.Sprintf(templates.ChatTargetInvalid, "Discord") {
+		t.Fatalf("expected URL outside of Discord to be rejected, got %v", context.sent)
+	}
+	// Test server is not a Discord URL, so the target is stored directly
+	_ = ts.db.SetChatTarget(ctx.Background(), db.ChatTarget{ChatId: testChatId, Target: db.DeliveryTargetDiscord, URL: server.URL})
+	stream := youtube.StreamInfo{Id: "video", Channel: testChannel, Title: "Live"}
+
+	ts.notifyAboutStream(ctx.Background(), stream)
+	// Delivery log prevents the second post even if the stream is notified again
+	err := newDiscordSink(ts.db).Notify(ctx.Background(), stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(messages) != 1 || len(messages[0].Embeds) != 1 {
+		t.Fatalf("expected 1 Discord message, got %v", messages)
+	}
+	embed := messages[0].Embeds[0]
+	if embed.Title != stream.Title || embed.URL != "https://youtube.com/watch?v=video" {
+		t.Fatalf("unexpected embed: %+v", embed)
+	}
+	if len(ts.telegram.messages()) != 1 {
+		t.Fatalf("expected Telegram to be notified as well, got %v", ts.telegram.messages())
+	}
+}
+
+func TestChatTargetRetryAfter(t *testing.T) {
+	ts := newTestService()
+	ts.startChat(testChatId)
+	ts.subscribe(testChatId)
+	var mu sync.Mutex
+	var requests []time.Time
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, time.Now())
+		if len(requests) == 1 {
+			writer.Header().Set("Retry-After", "0.3")
+			writer.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		writer.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	_ = ts.db.SetChatTarget(ctx.Background(), db.ChatTarget{ChatId: testChatId, Target: db.DeliveryTargetDiscord, URL: server.URL})
+	sink := newDiscordSink(ts.db)
+	sink.backoff = time.Millisecond
+
+	err := sink.Notify(ctx.Background(), youtube.StreamInfo{Id: "video", Channel: testChannel, Title: "Live"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(requests) != 2 {
+		t.Fatalf("expected the rate limited post to be retried once, got %v requests", len(requests))
+	}
+	if waited := requests[1].Sub(requests[0]); waited < 300*time.Millisecond {
+		t.Fatalf("expected the retry to wait for Retry-After, waited %v", waited)
+	}
+	delivery := ts.db.deliveries[deliveryId{"video", db.StreamStateLive, testChatId, db.DeliveryTargetDiscord}]
+	if delivery.Status != db.DeliveryStatusSent {
+		t.Fatalf("expected the delivery to be sent, got %v", delivery.Status)
+	}
+}
+
+func TestChatTargetRetryReleasesSlot(t *testing.T) {
+	ts := newTestService()
+	limitedChatId, otherChatId := testChatId, testChatId+1
+	var mu sync.Mutex
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, request.URL.Path)
+		if request.URL.Path == "/limited" && len(requests) == 1 {
+			writer.Header().Set("Retry-After", "0.3")
+			writer.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		writer.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	for chatId, path := range map[int64]string{limitedChatId: "/limited", otherChatId: "/other"} {
+		ts.startChat(chatId)
+		ts.subscribe(chatId)
+		_ = ts.db.SetChatTarget(ctx.Background(), db.ChatTarget{ChatId: chatId, Target: db.DeliveryTargetDiscord, URL: server.URL + path})
+	}
+	sink := newDiscordSink(ts.db)
+	sink.slots = make(chan struct{}, 1)
+	sink.backoff = time.Millisecond
+	// The limited target is posted first and waits for its retry without the only slot
+	limited := db.ChatTarget{ChatId: limitedChatId, Target: db.DeliveryTargetDiscord, URL: server.URL + "/limited"}
+	key := deliveryKey{streamId: "video", state: db.StreamStateLive}
+	done := make(chan struct{})
+	go func() {
+		sink.notifyTarget(ctx.Background(), limited, key, []byte("{}"))
+		close(done)
+	}()
+	for {
+		mu.Lock()
+		started := len(requests) > 0
+		mu.Unlock()
+		if started {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	err := sink.Notify(ctx.Background(), youtube.StreamInfo{Id: "video", Channel: testChannel, Title: "Live"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	if len(requests) != 3 || requests[1] != "/other" || requests[2] != "/limited" {
+		t.Fatalf("expected the other target to be posted while the limited one waits, got %v", requests)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"", 0},
+		{"2", 2 * time.Second},
+		{"1.5", 1500 * time.Millisecond},
+		{"-1", 0},
+		{"3600", maxRetryAfter},
+		{"soon", 0},
+		{time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 0},
+		{time.Now().Add(time.Hour).UTC().Format(http.TimeFormat), maxRetryAfter},
+	}
+	for _, test := range tests {
+		actual := parseRetryAfter(test.value)
+		if actual != test.expected {
+			t.Errorf("parseRetryAfter(%q) = %v, expected %v", test.value, actual, test.expected)
+		}
+	}
+}
+
+func TestCalendar(t *testing.T) {
+	ts := newTestService()
+	base := "https://example.com/notifier/"
+	ts.calendarURL = &base
+	ts.startChat(testChatId)
+	ts.subscribe(testChatId)
+	router := mux.NewRouter()
+	ts.registerCalendar(router)
+	context := privateContext("")
+	err := ts.Calendar(context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chat, _ := ts.db.GetChat(ctx.Background(), testChatId)
+	link := "https://example.com/notifier" + fmt.Sprintf(calendarPathFormat, *chat.CalendarToken)
+	if context.sent[0] != fmt.Sprintf(templates.CalendarLink, link) {
+		t.Fatalf("unexpected reply: %v", context.sent)
+	}
+	stream := youtube.StreamInfo{
+		Id:             "video",
+		Channel:        testChannel,
+		Title:          "Upcoming",
+		IsUpcoming:     true,
+		ScheduledStart: time.Date(2030, 1, 1, 18, 0, 0, 0, time.UTC),
+	}
+	ts.notifyAboutStream(ctx.Background(), stream)
+	// Rescheduled stream is already notified, but the calendar event is updated
+	stream.ScheduledStart = stream.ScheduledStart.Add(time.Hour)
+	ts.notifyAboutStream(ctx.Background(), stream)
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, strings.TrimPrefix(link, "https://example.com/notifier"), nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %v", recorder.Code)
+	}
+	calendar := recorder.Body.String()
+	for _, line := range []string{"UID:video@youtube.com", "SEQUENCE:1", "DTSTART:20300101T190000Z", "SUMMARY:Test channel: Upcoming"} {
+		if !strings.Contains(calendar, line+"\r\n") {
+			t.Fatalf("expected %v in calendar:\n%v", line, calendar)
+		}
+	}
+	if strings.Count(calendar, "BEGIN:VEVENT") != 1 {
+		t.Fatalf("expected a single event:\n%v", calendar)
+	}
+
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, fmt.Sprintf(calendarPathFormat, "0123abcd"), nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("expected unknown token to be not found, got %v", recorder.Code)
+	}
+}
+
+func testFeed(videoId string) string {
+	return fmt.Sprintf(
+		`<?xml version="1.0" encoding="UTF-8"?>
+<feed xmlns:yt="http://www.youtube.com/xml/schemas/2015" xmlns="http://www.w3.org/2005/Atom">
+  <title>YouTube video feed</title>
+  <entry>
+    <id>yt:video:%[1]v</id>
+    <yt:videoId>%[1]v</yt:videoId>
+    <yt:channelId>%[2]v</yt:channelId>
+    <title>Video</title>
+  </entry>
+</feed>`, videoId, testChannelId,
+	)
+}
+
+func TestShutdownWaitsForConsumers(t *testing.T) {
+	ts := newTestService()
+	finished := make(chan struct{})
+	ts.consume(func() {
+		<-ts.stopping
+		close(finished)
+	})
+
+	err := ts.Shutdown(ctx.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	select {
+	case <-finished:
+	default:
+		t.Fatal("expected shutdown to wait for the consumer")
+	}
+}
+
+func TestShutdownReleasesFeedHandlers(t *testing.T) {
+	ts := newTestService()
+	ts.startChat(testChatId)
+	ts.subscribe(testChatId)
+	ts.youtube.streams["video"] = youtube.StreamInfo{Id: "video", Channel: testChannel, Title: "Live"}
+	// Nobody takes the stream, like a consumer busy with another notification
+	handler := ts.getFeedHandler(make(chan streamEvent))
+	recorder := httptest.NewRecorder()
+	handled := make(chan struct{})
+	go func() {
+		handler(recorder, httptest.NewRequest(http.MethodPost, "/video", strings.NewReader(testFeed("video"))))
+		close(handled)
+	}()
+
+	// The HTTP server is stopped after the service, it waits for this handler
+	err := ts.Shutdown(ctx.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	select {
+	case <-handled:
+	case <-time.After(time.Second):
+		t.Fatal("expected feed handler to return once shutdown starts")
+	}
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected the hub to be asked to retry, got %v", recorder.Code)
+	}
+}
+
+func TestDispatcher(t *testing.T) {
+	floodErr := telegramError(`{"ok":false,"error_code":429,"description":"Too Many Requests: retry after 7","parameters":{"retry_after":7}}`)
+	transientErr := errors.New("connection reset by peer")
+	var distinctChats []int64
+	var burst []time.Duration
+	for i := 1; i <= globalSendBurst+1; i++ {
+		distinctChats = append(distinctChats, int64(i))
+		burst = append(burst, 0)
+	}
+	// The message over the burst waits for the next token
+	burst[globalSendBurst] = time.Second / globalSendRate
+	tests := []struct {
+		name string
+		// One message for every chat, sent one after another
+		chats []int64
+		errs  []error
+		// Dispatcher is stopped after this attempt
+		stopAfter int
+		// Times of the attempts since the first one
+		want    []time.Duration
+		wantErr error
+	}{
+		{name: "private chat pacing", chats: []int64{1, 1, 1}, want: []time.Duration{0, time.Second, 2 * time.Second}},
+		{name: "group pacing", chats: []int64{-1, -1, -1}, want: []time.Duration{0, 3 * time.Second, 6 * time.Second}},
+		{name: "chats are paced separately", chats: []int64{1, -1, 2}, want: []time.Duration{0, 0, 0}},
+		{name: "global token bucket", chats: distinctChats, want: burst},
+		{name: "flood retry after", chats: []int64{1}, errs: []error{floodErr}, want: []time.Duration{0, 7 * time.Second}},
+		{
+			name:    "transient errors give up after max attempts",
+			chats:   []int64{1},
+			errs:    []error{transientErr, transientErr, transientErr, transientErr, transientErr, transientErr},
+			want:    []time.Duration{0, time.Second, 3 * time.Second, 7 * time.Second, 15 * time.Second},
+			wantErr: transientErr,
+		},
+		{
+			name:    "permanent errors are not retried",
+			chats:   []int64{1},
+			errs:    []error{tele.ErrBlockedByUser},
+			want:    []time.Duration{0},
+			wantErr: tele.ErrBlockedByUser,
+		},
+		{
+			name:      "stopped during flood wait",
+			chats:     []int64{1},
+			errs:      []error{floodErr},
+			stopAfter: 1,
+			want:      []time.Duration{0},
+			wantErr:   errDispatcherStopped,
+		},
+		{
+			name:      "stopped before the next message",
+			chats:     []int64{1, 2},
+			stopAfter: 1,
+			want:      []time.Duration{0},
+			wantErr:   errDispatcherStopped,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			start := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+			clock := &fakeClock{now: start}
+			telegram := &scriptedTelegram{fakeTelegram: newFakeTelegram(), clock: clock, errs: test.errs}
+			sendCtx, stop := ctx.WithCancel(ctx.Background())
+			defer stop()
+			telegram.onAttempt = func(attempt int) {
+				if attempt == test.stopAfter {
+					stop()
+				}
+			}
+			dispatcher := newDispatcher(telegram, clock)
+
+			var err error
+			for _, chatId := range test.chats {
+				_, err = dispatcher.Send(sendCtx, chatId, 0, "message")
+			}
+
+			if !errors.Is(err, test.wantErr) || (test.wantErr == nil && err != nil) {
+				t.Fatalf("expected error %v, got %v", test.wantErr, err)
+			}
+			if len(telegram.attempts) != len(test.want) {
+				t.Fatalf("expected %v attempts, got %v", len(test.want), len(telegram.attempts))
+			}
+			for i, attempt := range telegram.attempts {
+				// The token bucket may wait a few extra nanoseconds because of rounding
+				if diff := attempt.Sub(start) - test.want[i]; diff < 0 || diff > time.Millisecond {
+					t.Fatalf("expected attempt %v after %v, got %v", i+1, test.want[i], attempt.Sub(start))
+				}
+			}
+		})
+	}
+}
+
+func TestResumeOutbox(t *testing.T) {
+	ts := newTestService()
+	failingChatId := testChatId + 1
+	disabledChatId := testChatId + 2
+	ts.startChat(testChatId)
+	ts.startChat(failingChatId)
+	_ = ts.db.AddChat(ctx.Background(), db.Chat{Id: disabledChatId})
+	ts.telegram.errs[tele.ChatID(failingChatId).Recipient()] = &tele.Error{Code: 400, Description: "Bad Request: message is too long"}
+	streamId, state := "video", db.StreamStateLive
+	_, _ = ts.db.ClaimDelivery(ctx.Background(), streamId, state, testChatId, db.DeliveryTargetTelegram)
+	for _, chatId := range []int64{testChatId, failingChatId, disabledChatId} {
+		_ = ts.db.AddOutboxMessage(
+			ctx.Background(),
+			db.OutboxMessage{ChatId: chatId, Text: "message", StreamId: &streamId, State: &state},
+		)
+	}
+	// Claimed by another process that is still sending it
+	claimedUntil := time.Now().Add(time.Minute)
+	_ = ts.db.AddOutboxMessage(ctx.Background(), db.OutboxMessage{ChatId: testChatId, Text: "claimed", ClaimedUntil: &claimedUntil})
+
+	ts.resumeOutbox()
+	// The message failed to send is not taken again until its lease expires
+	ts.resumeOutbox()
+	err := ts.Shutdown(ctx.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages := ts.telegram.messages()
+	if len(messages) != 1 || messages[0].chatId != tele.ChatID(testChatId).Recipient() || messages[0].text != "message" {
+		t.Fatalf("expected only the unclaimed message to the enabled chat to be sent, got %v", messages)
+	}
+	delivery := ts.db.deliveries[deliveryId{streamId, state, testChatId, db.DeliveryTargetTelegram}]
+	if delivery.Status != db.DeliveryStatusSent {
+		t.Fatalf("expected delivery to be completed, got %+v", delivery)
+	}
+	var kept []int64
+	for _, message := range ts.db.outbox {
+		kept = append(kept, message.ChatId)
+	}
+	if len(kept) != 2 || kept[0] != failingChatId || kept[1] != testChatId {
+		t.Fatalf("expected failed and claimed messages to stay in the outbox, got chats %v", kept)
+	}
+}
+
+func TestResumeOutboxInBatches(t *testing.T) {
+	ts := newTestService()
+	count := outboxBatchSize + 1
+	for i := 0; i < count; i++ {
+		chatId := testChatId + int64(i)
+		ts.startChat(chatId)
+		_ = ts.db.AddOutboxMessage(ctx.Background(), db.OutboxMessage{ChatId: chatId, Text: "message"})
+	}
+
+	ts.resumeOutbox()
+
+	if len(ts.telegram.messages()) != count {
+		t.Fatalf("expected all %v messages to be sent, got %v", count, len(ts.telegram.messages()))
+	}
+	if len(ts.db.outbox) != 0 {
+		t.Fatalf("expected the outbox to be empty, got %v messages", len(ts.db.outbox))
+	}
+}
+
+func TestShutdownStopsDeliveryOnDeadline(t *testing.T) {
+	ts := newTestService()
+	ts.consume(func() {
+		// Stands for a notification that can't be sent until the delivery is stopped
+		<-ts.deliveryCtx.Done()
+	})
+	deadline, cancel := ctx.WithTimeout(ctx.Background(), time.Millisecond*10)
+	defer cancel()
+
+	err := ts.Shutdown(deadline)
+	if err == nil {
+		t.Fatal("expected deadline error")
+	}
+	if ts.deliveryCtx.Err() == nil {
+		t.Fatal("expected delivery to be stopped")
+	}
+}
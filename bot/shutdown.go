@@ -0,0 +1,37 @@
+package bot
+
+import (
+	ctx "context"
+)
+
+// consume runs the stream consumer that the shutdown waits for
+func (s *Service) consume(consumer func()) {
+	s.consumers.Add(1)
+	go func() {
+		defer s.consumers.Done()
+		consumer()
+	}()
+}
+
+// Shutdown stops taking new streams and waits for the notifications in flight.
+// When ctx is done the remaining notifications are saved to the outbox instead of being sent.
+// Feed handlers answer 503 once it starts, so the HTTP server is stopped after it.
+func (s *Service) Shutdown(ctx ctx.Context) error {
+	close(s.stopping)
+	done := make(chan struct{})
+	go func() {
+		s.consumers.Wait()
+		close(done)
+	}()
+	defer s.stopDelivery()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	logger().Warn("shutdown deadline is reached, saving remaining notifications to the outbox")
+	s.stopDelivery()
+	// Saving to the outbox does not wait for Telegram, so this does not take long
+	<-done
+	return ctx.Err()
+}
@@ -0,0 +1,33 @@
+package bot
+
+import (
+	ctx "context"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"youtube-stream-notifier-bot/youtube"
+)
+
+// Sink delivers stream notifications to the subscribers of one kind
+type Sink interface {
+	// Notify returns when the notifications are sent or handed over for a later delivery.
+	// An error means the stream must not be marked as done, so it is notified again.
+	Notify(ctx ctx.Context, stream youtube.StreamInfo) error
+}
+
+// telegramSink notifies the chats subscribed to the channel
+type telegramSink struct {
+	s *Service
+}
+
+func (t *telegramSink) Notify(ctx ctx.Context, stream youtube.StreamInfo) error {
+	chats, err := t.s.db.GetSubscribedChats(ctx, stream.Channel.Id)
+	if err != nil {
+		return errors.Wrap(err, "unable to get subscribed chats")
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int("chats", len(chats)))
+	// Chats are notified in parallel, each chat is claimed in the delivery log
+	t.s.fanOut(ctx, stream, chats)
+	t.s.logDeliveryStats(detach(ctx), stream.Id)
+	return nil
+}
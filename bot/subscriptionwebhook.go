@@ -0,0 +1,145 @@
+package bot
+
+import (
+	ctx "context"
+	"fmt"
+	"github.com/pkg/errors"
+	tele "gopkg.in/telebot.v3"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+	"youtube-stream-notifier-bot/db"
+	"youtube-stream-notifier-bot/logging"
+	"youtube-stream-notifier-bot/templates"
+)
+
+const webhookOff = "off"
+
+var errNotSubscribed = errors.New("chat is not subscribed to the channel")
+
+// subscribed returns errNotSubscribed if the chat has not added the channel
+func (s *Service) subscribed(ctx ctx.Context, chatId int64, channelId string) error {
+	channels, err := s.db.GetSubscribedChannels(ctx, chatId)
+	if err != nil {
+		return errors.Wrap(err, "cannot get added channels")
+	}
+	for _, channel := range channels {
+		if channel.Id == channelId {
+			return nil
+		}
+	}
+	return errNotSubscribed
+}
+
+// setWebhook attaches the webhook to the chat subscription, the secret is generated if empty
+func (s *Service) setWebhook(ctx ctx.Context, chatId int64, channelId string, webhookURL string, secret string) (db.Webhook, error) {
+	err := s.subscribed(ctx, chatId, channelId)
+	if err != nil {
+		return db.Webhook{}, err
+	}
+	if len(secret) == 0 {
+		secret, err = newWebhookSecret()
+		if err != nil {
+			return db.Webhook{}, err
+		}
+	}
+	webhook := db.Webhook{
+		ChatId:    chatId,
+		ChannelId: channelId,
+		URL:       webhookURL,
+		Secret:    secret,
+		CreatedAt: time.Now(),
+	}
+	err = s.db.SetWebhook(ctx, &webhook)
+	if err != nil {
+		return db.Webhook{}, errors.Wrapf(err, "cannot set webhook of chat %v for channel %v", chatId, channelId)
+	}
+	return webhook, nil
+}
+
+// validWebhookURL accepts absolute http and https URLs.
+// Webhooks set by chats must use https and must not point to the network of the bot.
+// Host names are not resolved, so this only rejects the obvious cases.
+func validWebhookURL(rawURL string, public bool) bool {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || len(parsed.Hostname()) == 0 {
+		return false
+	}
+	if !public {
+		return parsed.Scheme == "http" || parsed.Scheme == "https"
+	}
+	if parsed.Scheme != "https" {
+		return false
+	}
+	host := strings.ToLower(parsed.Hostname())
+	ip := net.ParseIP(host)
+	if ip != nil {
+		return ip.IsGlobalUnicast() && !ip.IsPrivate()
+	}
+	return strings.Contains(host, ".") && !strings.HasSuffix(host, ".localhost") && !strings.HasSuffix(host, ".local")
+}
+
+// Webhook attaches a webhook to a subscription of the chat, "/webhook <channel> off" removes it.
+// The channel is its id or the url shown by /list. In groups the signing secret is sent to the sender privately,
+// the webhook is set only if it is delivered.
+func (s *Service) Webhook(context tele.Context) error {
+	ctx := updateContext(context)
+	id := context.Chat().ID
+	_, err := s.db.GetChat(ctx, id)
+	if err != nil && errors.Is(err, db.ErrNotFound) {
+		return context.Send(templates.UserNotStarted)
+	}
+	if err != nil {
+		return err
+	}
+	args := strings.Fields(context.Data())
+	if len(args) != 2 {
+		return context.Send(templates.WebhookUsage)
+	}
+	channelId := path.Base(args[0])
+	if args[1] == webhookOff {
+		err = s.db.RemoveWebhook(ctx, id, channelId)
+		if err != nil && errors.Is(err, db.ErrNotFound) {
+			return context.Send(templates.WebhookNotSet)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "cannot remove webhook of chat %v for channel %v", id, channelId)
+		}
+		return context.Send(templates.WebhookRemoved)
+	}
+	if !validWebhookURL(args[1], true) {
+		return context.Send(templates.WebhookInvalid)
+	}
+	err = s.subscribed(ctx, id, channelId)
+	if err != nil && errors.Is(err, errNotSubscribed) {
+		return context.Send(fmt.Sprintf(templates.ChannelNotFound, channelId))
+	}
+	if err != nil {
+		return err
+	}
+	secret, err := newWebhookSecret()
+	if err != nil {
+		return err
+	}
+	private := context.Chat().Type == tele.ChatPrivate
+	if !private {
+		_, err = s.bot.Send(
+			context.Sender(),
+			fmt.Sprintf(templates.WebhookSecret, channelId, context.Chat().Title, signatureHeader, secret),
+		)
+		if err != nil {
+			logger().Info("unable to send webhook secret privately", logging.ChatId, id, logging.Err(err))
+			return context.Send(templates.WebhookSecretNotSent)
+		}
+	}
+	_, err = s.setWebhook(ctx, id, channelId, args[1], secret)
+	if err != nil {
+		return err
+	}
+	if !private {
+		return context.Send(templates.WebhookSecretSent)
+	}
+	return context.Send(fmt.Sprintf(templates.WebhookSuccess, signatureHeader, secret))
+}
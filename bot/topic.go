@@ -0,0 +1,63 @@
+package bot
+
+import (
+	"github.com/pkg/errors"
+	tele "gopkg.in/telebot.v3"
+	"youtube-stream-notifier-bot/db"
+	"youtube-stream-notifier-bot/templates"
+)
+
+// messageThread returns the forum topic the message was sent to or nil for the General topic
+func messageThread(context tele.Context) *int {
+	message := context.Message()
+	if message == nil || !message.TopicMessage || message.ThreadID == 0 {
+		return nil
+	}
+	threadId := message.ThreadID
+	return &threadId
+}
+
+// threadOptions keeps the reply in the topic where the command was sent
+func threadOptions(threadId *int) *tele.SendOptions {
+	if threadId == nil {
+		return &tele.SendOptions{}
+	}
+	return &tele.SendOptions{ThreadID: *threadId}
+}
+
+// Here makes the current forum topic the default target for notifications of the chat.
+// Sent in the General topic it resets the target.
+func (s *Service) Here(context tele.Context) error {
+	ctx := updateContext(context)
+	id := context.Chat().ID
+	_, err := s.db.GetChat(ctx, id)
+	if err != nil && errors.Is(err, db.ErrNotFound) {
+		return context.Send(templates.UserNotStarted)
+	}
+	if err != nil {
+		return err
+	}
+	threadId := messageThread(context)
+	err = s.db.SetChatThread(ctx, id, threadId)
+	if err != nil {
+		return errors.Wrapf(err, "cannot set thread for chat %v", id)
+	}
+	if threadId == nil {
+		return context.Send(templates.HereGeneral)
+	}
+	return context.Send(templates.HereSuccess, threadOptions(threadId))
+}
+
+// deliveryThread returns the forum topic for the notification, subscription topic takes precedence
+func deliveryThread(chat db.Chat) int {
+	if chat.TelegramChannelId != nil {
+		return 0
+	}
+	if chat.SubscriptionThreadId != nil {
+		return *chat.SubscriptionThreadId
+	}
+	if chat.ThreadId != nil {
+		return *chat.ThreadId
+	}
+	return 0
+}
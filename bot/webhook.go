@@ -0,0 +1,127 @@
+package bot
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	tele "gopkg.in/telebot.v3"
+	"net/http"
+	"time"
+	"youtube-stream-notifier-bot/logging"
+)
+
+const (
+	UpdatesPolling = "polling"
+	UpdatesWebhook = "webhook"
+)
+
+const (
+	telegramWebhookPath = "/telegram"
+	secretTokenHeader   = "X-Telegram-Bot-Api-Secret-Token"
+	longPollTimeout     = time.Second * 10
+)
+
+// webhookPoller receives Telegram updates from the HTTP server router.
+// tele.Webhook is not used because it closes the stop channel owned by the bot, which panics on bot.Stop.
+type webhookPoller struct {
+	secret  string
+	updates chan tele.Update
+}
+
+func newWebhookPoller(secret string) *webhookPoller {
+	return &webhookPoller{
+		secret:  secret,
+		updates: make(chan tele.Update),
+	}
+}
+
+// Poll passes the updates received by ServeHTTP to the bot until it is stopped
+func (p *webhookPoller) Poll(_ *tele.Bot, dest chan tele.Update, stop chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case update := <-p.updates:
+			select {
+			case <-stop:
+				return
+			case dest <- update:
+			}
+		}
+	}
+}
+
+// ServeHTTP accepts an update sent by Telegram. Requests without the secret token are rejected.
+func (p *webhookPoller) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := r.Header.Get(secretTokenHeader)
+	if subtle.ConstantTimeCompare([]byte(token), []byte(p.secret)) != 1 {
+		logger().Warn("webhook request with invalid secret token", "remote_addr", r.RemoteAddr)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var update tele.Update
+	err := json.NewDecoder(r.Body).Decode(&update)
+	if err != nil {
+		logger().Warn("unable to decode webhook update", logging.Err(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	select {
+	case <-r.Context().Done():
+		// Telegram retries the update later
+		w.WriteHeader(http.StatusServiceUnavailable)
+	case p.updates <- update:
+	}
+}
+
+// webhookSecret returns the configured secret or derives it from the bot token,
+// so all replicas register the same secret without extra configuration
+func webhookSecret(config Config) string {
+	if len(config.TelegramWebhookSecret) > 0 {
+		return config.TelegramWebhookSecret
+	}
+	hash := sha256.Sum256([]byte(config.TelegramBotToken))
+	return hex.EncodeToString(hash[:])
+}
+
+// newPoller creates the poller for the configured updates mode
+func newPoller(config Config) (tele.Poller, error) {
+	switch config.TelegramUpdates {
+	case "", UpdatesPolling:
+		return &tele.LongPoller{Timeout: longPollTimeout}, nil
+	case UpdatesWebhook:
+		if len(config.TelegramWebhookURL) == 0 {
+			return nil, errors.New("telegramWebhookURL is required in webhook mode")
+		}
+		return newWebhookPoller(webhookSecret(config)), nil
+	}
+	return nil, errors.Errorf("unknown telegram updates mode: %v", config.TelegramUpdates)
+}
+
+// registerPoller makes Telegram deliver updates to the poller. The webhook is set on every start,
+// so all replicas agree on it, and is kept on shutdown so the remaining replicas receive updates.
+// Long polling only works without a webhook, so it is deleted.
+func registerPoller(bot *tele.Bot, poller tele.Poller, config Config, router *mux.Router) error {
+	webhook, ok := poller.(*webhookPoller)
+	if !ok {
+		err := bot.RemoveWebhook()
+		if err != nil {
+			return errors.Wrap(err, "unable to delete telegram webhook")
+		}
+		return nil
+	}
+	router.Methods(http.MethodPost).Path(telegramWebhookPath).Handler(webhook)
+	err := bot.SetWebhook(
+		&tele.Webhook{
+			SecretToken: webhook.secret,
+			Endpoint:    &tele.WebhookEndpoint{PublicURL: config.TelegramWebhookURL},
+		},
+	)
+	if err != nil {
+		return errors.Wrap(err, "unable to set telegram webhook")
+	}
+	return nil
+}
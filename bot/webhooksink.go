@@ -0,0 +1,315 @@
+package bot
+
+import (
+	"bytes"
+	ctx "context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"youtube-stream-notifier-bot/db"
+	"youtube-stream-notifier-bot/logging"
+	"youtube-stream-notifier-bot/metrics"
+	"youtube-stream-notifier-bot/youtube"
+)
+
+const (
+	signatureHeader = "X-Signature-256"
+	eventIdHeader   = "X-Event-Id"
+	webhookTimeout  = time.Second * 10
+	webhookAttempts = 5
+	// Delay before the first retry, it doubles with every attempt
+	webhookBackoff = time.Second * 2
+	// Limits the requests in flight, so a burst of streams does not open too many connections
+	webhookConcurrency = 8
+	// Response body kept in the dead letter error
+	maxWebhookErrorBody = 512
+	// Longer Retry-After values are capped, so a rate limited endpoint does not hold a request slot for long
+	maxRetryAfter = time.Minute
+)
+
+type webhookChannel struct {
+	Id    string `json:"id"`
+	Title string `json:"title"`
+}
+
+// webhookEvent is the JSON body posted to the webhooks
+type webhookEvent struct {
+	// stream.upcoming or stream.live
+	Type           string         `json:"type"`
+	StreamId       string         `json:"streamId"`
+	URL            string         `json:"url"`
+	Title          string         `json:"title"`
+	Channel        webhookChannel `json:"channel"`
+	State          db.StreamState `json:"state"`
+	ScheduledStart *time.Time     `json:"scheduledStart,omitempty"`
+	ActualStart    *time.Time     `json:"actualStart,omitempty"`
+}
+
+// webhookError is a failed attempt, permanent errors are not retried
+type webhookError struct {
+	err       error
+	permanent bool
+	// Delay requested by a 429 response
+	retryAfter time.Duration
+}
+
+func (e *webhookError) Error() string {
+	return e.err.Error()
+}
+
+// webhookSink posts signed stream events to the webhooks of the chat subscriptions.
+// Deliveries are claimed in the delivery log like Telegram ones, so every webhook gets the event once.
+// Failed requests are retried with backoff, events that are still not accepted become dead letters.
+type webhookSink struct {
+	db      Storage
+	client  *http.Client
+	backoff time.Duration
+	// Runs the delivery in the background, the shutdown waits for it
+	run   func(func())
+	slots chan struct{}
+}
+
+func newWebhookSink(db Storage, run func(func())) *webhookSink {
+	return &webhookSink{
+		db:      db,
+		client:  &http.Client{Timeout: webhookTimeout},
+		backoff: webhookBackoff,
+		run:     run,
+		slots:   make(chan struct{}, webhookConcurrency),
+	}
+}
+
+// Notify does not wait for the webhooks, so a slow endpoint does not delay other notifications
+func (w *webhookSink) Notify(ctx ctx.Context, stream youtube.StreamInfo) error {
+	webhooks, err := w.db.GetChannelWebhooks(ctx, stream.Channel.Id)
+	if err != nil {
+		return errors.Wrap(err, "unable to get channel webhooks")
+	}
+	if len(webhooks) == 0 {
+		return nil
+	}
+	state := db.StreamStateOf(stream.IsUpcoming)
+	payload, err := json.Marshal(
+		webhookEvent{
+			Type:           "stream." + string(state),
+			StreamId:       stream.Id,
+			URL:            videoURL(stream.Id),
+			Title:          stream.Title,
+			Channel:        webhookChannel{Id: stream.Channel.Id, Title: stream.Channel.Title},
+			State:          state,
+			ScheduledStart: optionalTime(stream.ScheduledStart),
+			ActualStart:    optionalTime(stream.ActualStart),
+		},
+	)
+	if err != nil {
+		return errors.Wrap(err, "unable to encode webhook event")
+	}
+	for _, webhook := range webhooks {
+		webhook := webhook
+		w.run(func() {
+			w.deliver(ctx, webhook, stream.Id, state, payload)
+		})
+	}
+	return nil
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// deliver retries the event until it is accepted, otherwise it is saved as a dead letter.
+// Events stopped by a shutdown are not dead letters, their failed delivery is claimed again
+// by the next notification about the stream.
+func (w *webhookSink) deliver(ctx ctx.Context, webhook db.Webhook, streamId string, state db.StreamState, payload []byte) {
+	l := logger().With(logging.StreamId, streamId, logging.ChatId, webhook.ChatId, "webhook_id", webhook.Id)
+	claimed, err := w.db.ClaimDelivery(detach(ctx), streamId, state, webhook.ChatId, db.DeliveryTargetWebhook)
+	if err != nil {
+		l.Error("unable to claim delivery", logging.Err(err))
+		return
+	}
+	if !claimed {
+		return
+	}
+	delay := w.backoff
+	attempts := 0
+	for attempts < webhookAttempts {
+		if attempts > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(retryDelay(err, delay)):
+			}
+			if ctx.Err() != nil {
+				err = errors.Wrap(ctx.Err(), "delivery is stopped")
+				break
+			}
+			delay *= 2
+		}
+		attempts++
+		err = w.post(ctx, webhook, eventId(webhook.Id, streamId, state), payload)
+		if err == nil {
+			metrics.WebhookDeliveries.WithLabelValues(metrics.WebhookDelivered).Inc()
+			w.complete(ctx, webhook, streamId, state, db.DeliveryStatusSent)
+			return
+		}
+		var webhookErr *webhookError
+		if errors.As(err, &webhookErr) && webhookErr.permanent {
+			break
+		}
+		metrics.WebhookDeliveries.WithLabelValues(metrics.WebhookRetried).Inc()
+		l.Warn("webhook delivery failed", "attempt", attempts, logging.Err(err))
+	}
+	if ctx.Err() != nil {
+		l.Info("webhook delivery is stopped", "attempts", attempts, logging.Err(err))
+		w.complete(ctx, webhook, streamId, state, db.DeliveryStatusFailed)
+		return
+	}
+	metrics.WebhookDeliveries.WithLabelValues(metrics.WebhookDeadLetter).Inc()
+	l.Error("webhook event is moved to dead letters", "attempts", attempts, logging.Err(err))
+	err = w.db.AddDeadLetter(
+		detach(ctx),
+		db.DeadLetter{
+			WebhookId: webhook.Id,
+			StreamId:  streamId,
+			State:     state,
+			Payload:   string(payload),
+			Error:     err.Error(),
+			Attempts:  attempts,
+			CreatedAt: time.Now(),
+		},
+	)
+	if err != nil {
+		l.Error("unable to save dead letter", logging.Err(err))
+	}
+	w.complete(ctx, webhook, streamId, state, db.DeliveryStatusFailed)
+}
+
+func (w *webhookSink) complete(ctx ctx.Context, webhook db.Webhook, streamId string, state db.StreamState, status db.DeliveryStatus) {
+	err := w.db.CompleteDelivery(detach(ctx), streamId, state, webhook.ChatId, db.DeliveryTargetWebhook, status, nil)
+	if err != nil {
+		logger().Error(
+			"unable to save delivery status",
+			logging.StreamId, streamId,
+			logging.ChatId, webhook.ChatId,
+			"webhook_id", webhook.Id,
+			logging.Err(err),
+		)
+	}
+}
+
+// eventId is the same for every attempt, so receivers can drop duplicates
+func eventId(webhookId int64, streamId string, state db.StreamState) string {
+	return fmt.Sprintf("%v:%v:%v", streamId, state, webhookId)
+}
+
+// post makes a single signed attempt
+func (w *webhookSink) post(ctx ctx.Context, webhook db.Webhook, id string, payload []byte) error {
+	select {
+	case w.slots <- struct{}{}:
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "delivery is stopped")
+	}
+	defer func() {
+		<-w.slots
+	}()
+	header := http.Header{}
+	header.Set(eventIdHeader, id)
+	header.Set(signatureHeader, signPayload(webhook.Secret, payload))
+	return postJSON(ctx, w.client, webhook.URL, payload, header)
+}
+
+// postJSON returns webhookError for unsuccessful responses, 4xx except 429 are permanent
+func postJSON(ctx ctx.Context, client *http.Client, url string, payload []byte, header http.Header) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return &webhookError{err: errors.Wrap(err, "invalid webhook request"), permanent: true}
+	}
+	for key, values := range header {
+		request.Header[key] = values
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := client.Do(request)
+	if err != nil {
+		return errors.Wrap(err, "webhook request failed")
+	}
+	defer response.Body.Close()
+	code := response.StatusCode
+	if code >= 200 && code <= 299 {
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(response.Body, maxWebhookErrorBody))
+	err = errors.Errorf("unexpected webhook status %v; body: %v", code, strings.TrimSpace(string(body)))
+	permanent := code >= 400 && code <= 499 && code != http.StatusTooManyRequests
+	webhookErr := &webhookError{err: err, permanent: permanent}
+	if code == http.StatusTooManyRequests {
+		webhookErr.retryAfter = parseRetryAfter(response.Header.Get("Retry-After"))
+	}
+	return webhookErr
+}
+
+// parseRetryAfter accepts seconds, fractional ones are sent by Discord, or an HTTP date
+func parseRetryAfter(value string) time.Duration {
+	if len(value) == 0 {
+		return 0
+	}
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err == nil {
+		if seconds <= 0 {
+			return 0
+		}
+		return time.Duration(math.Min(seconds*float64(time.Second), float64(maxRetryAfter)))
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0
+	}
+	return min(max(time.Until(date), 0), maxRetryAfter)
+}
+
+// retryDelay returns the backoff delay, or the Retry-After of a rate limited attempt if it is longer
+func retryDelay(err error, backoff time.Duration) time.Duration {
+	var webhookErr *webhookError
+	if errors.As(err, &webhookErr) && webhookErr.retryAfter > backoff {
+		return webhookErr.retryAfter
+	}
+	return backoff
+}
+
+// signPayload returns the HMAC-SHA256 of the payload in the format of the signature header
+func signPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// newWebhookSecret is used when the secret is not given on webhook creation
+func newWebhookSecret() (string, error) {
+	return randomHex(32)
+}
+
+// redeliver makes a single attempt to send the dead letter.
+// It is removed when the webhook accepts it and the failed delivery becomes sent.
+func (w *webhookSink) redeliver(ctx ctx.Context, letter db.DeadLetter) error {
+	webhook, err := w.db.GetWebhook(ctx, letter.WebhookId)
+	if err != nil {
+		return err
+	}
+	err = w.post(ctx, webhook, eventId(webhook.Id, letter.StreamId, letter.State), []byte(letter.Payload))
+	if err != nil {
+		return err
+	}
+	metrics.WebhookDeliveries.WithLabelValues(metrics.WebhookDelivered).Inc()
+	w.complete(ctx, webhook, letter.StreamId, letter.State, db.DeliveryStatusSent)
+	return w.db.RemoveDeadLetter(ctx, letter.Id)
+}
@@ -0,0 +1,28 @@
+// Command fakeyoutube is a local stand-in for YouTube Data API and the WebSub hub.
+// Point youtubeAPIURL to http://<addr>/ and hubURL to http://<addr>/subscribe in the bot config,
+// then trigger notifications with POST /push?videoId=<id>.
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"net/http"
+	"os"
+	"youtube-stream-notifier-bot/logging"
+)
+
+func main() {
+	addr := flag.String("addr", ":8085", "address to listen on")
+	fixturesPath := flag.String("fixtures", "./cmd/fakeyoutube/fixtures.json", "path to channel and video fixtures")
+	flag.Parse()
+
+	f, err := loadFixtures(*fixturesPath)
+	if err != nil {
+		slog.Error("unable to load fixtures", logging.Err(err))
+		os.Exit(1)
+	}
+	slog.Info("serving fixtures", "channels", len(f.Channels), "videos", len(f.Videos), "addr", *addr)
+	err = http.ListenAndServe(*addr, newServer(f).routes())
+	slog.Error("server stopped", logging.Err(err))
+	os.Exit(1)
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/pkg/errors"
+	ytApi "google.golang.org/api/youtube/v3"
+	"io/ioutil"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"youtube-stream-notifier-bot/logging"
+	"youtube-stream-notifier-bot/youtube"
+)
+
+const (
+	// The same lease the real hub grants
+	leaseSeconds   = 432000
+	requestTimeout = time.Second * 10
+	feedNamespace  = "http://www.w3.org/2005/Atom"
+	ytNamespace    = "http://www.youtube.com/xml/schemas/2015"
+)
+
+type fixtureChannel struct {
+	Id    string `json:"id"`
+	Title string `json:"title"`
+}
+
+type fixtureVideo struct {
+	Id        string `json:"id"`
+	ChannelId string `json:"channelId"`
+	Title     string `json:"title"`
+	// live, upcoming or none
+	LiveBroadcastContent string `json:"liveBroadcastContent"`
+	ScheduledStartTime   string `json:"scheduledStartTime,omitempty"`
+	ActualStartTime      string `json:"actualStartTime,omitempty"`
+}
+
+type fixtures struct {
+	Channels []fixtureChannel `json:"channels"`
+	Videos   []fixtureVideo   `json:"videos"`
+}
+
+func loadFixtures(path string) (fixtures, error) {
+	var f fixtures
+	file, err := os.ReadFile(path)
+	if err != nil {
+		return f, errors.Wrap(err, "unable to read fixtures")
+	}
+	err = json.Unmarshal(file, &f)
+	if err != nil {
+		return f, errors.Wrap(err, "unable to decode fixtures")
+	}
+	return f, nil
+}
+
+// server serves the subset of YouTube Data API used by the bot and acts as a WebSub hub
+type server struct {
+	channels map[string]fixtureChannel
+	videos   []fixtureVideo
+	client   http.Client
+	mu       sync.Mutex
+	// Verified callbacks by topic
+	subscriptions map[string]map[string]struct{}
+}
+
+func newServer(f fixtures) *server {
+	channels := make(map[string]fixtureChannel, len(f.Channels))
+	for _, channel := range f.Channels {
+		channels[channel.Id] = channel
+	}
+	return &server{
+		channels:      channels,
+		videos:        f.Videos,
+		client:        http.Client{Timeout: requestTimeout},
+		subscriptions: make(map[string]map[string]struct{}),
+	}
+}
+
+func (s *server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/youtube/v3/channels", s.listChannels)
+	mux.HandleFunc("/youtube/v3/videos", s.listVideos)
+	mux.HandleFunc("/youtube/v3/search", s.search)
+	mux.HandleFunc("/subscribe", s.subscribe)
+	mux.HandleFunc("/push", s.push)
+	return mux
+}
+
+func (s *server) listChannels(w http.ResponseWriter, r *http.Request) {
+	response := ytApi.ChannelListResponse{Kind: "youtube#channelListResponse"}
+	for _, id := range ids(r) {
+		channel, ok := s.channels[id]
+		if !ok {
+			continue
+		}
+		response.Items = append(response.Items, &ytApi.Channel{
+			Kind:    "youtube#channel",
+			Id:      channel.Id,
+			Snippet: &ytApi.ChannelSnippet{Title: channel.Title},
+		})
+	}
+	writeJSON(w, response)
+}
+
+func (s *server) listVideos(w http.ResponseWriter, r *http.Request) {
+	response := ytApi.VideoListResponse{Kind: "youtube#videoListResponse"}
+	for _, id := range ids(r) {
+		video, ok := s.findVideo(id)
+		if !ok {
+			continue
+		}
+		item := &ytApi.Video{
+			Kind: "youtube#video",
+			Id:   video.Id,
+			Snippet: &ytApi.VideoSnippet{
+				ChannelId:            video.ChannelId,
+				ChannelTitle:         s.channels[video.ChannelId].Title,
+				Title:                video.Title,
+				LiveBroadcastContent: video.LiveBroadcastContent,
+			},
+		}
+		if video.LiveBroadcastContent != "none" {
+			item.LiveStreamingDetails = &ytApi.VideoLiveStreamingDetails{
+				ScheduledStartTime: video.ScheduledStartTime,
+				ActualStartTime:    video.ActualStartTime,
+			}
+		}
+		response.Items = append(response.Items, item)
+	}
+	writeJSON(w, response)
+}
+
+func (s *server) search(w http.ResponseWriter, r *http.Request) {
+	channelId := r.FormValue("channelId")
+	eventType := r.FormValue("eventType")
+	response := ytApi.SearchListResponse{Kind: "youtube#searchListResponse"}
+	for _, video := range s.videos {
+		if video.ChannelId != channelId || (len(eventType) > 0 && video.LiveBroadcastContent != eventType) {
+			continue
+		}
+		response.Items = append(response.Items, &ytApi.SearchResult{
+			Kind: "youtube#searchResult",
+			Id:   &ytApi.ResourceId{Kind: "youtube#video", VideoId: video.Id},
+			Snippet: &ytApi.SearchResultSnippet{
+				ChannelId:            video.ChannelId,
+				ChannelTitle:         s.channels[video.ChannelId].Title,
+				Title:                video.Title,
+				LiveBroadcastContent: video.LiveBroadcastContent,
+			},
+		})
+	}
+	writeJSON(w, response)
+}
+
+// subscribe accepts the request and verifies the callback asynchronously like the real hub does
+func (s *server) subscribe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	mode := r.FormValue(youtube.HubMode)
+	topic := r.FormValue(youtube.HubTopic)
+	callback := r.FormValue(youtube.HubCallback)
+	if mode != youtube.HubModeSubscribe && mode != "unsubscribe" {
+		http.Error(w, "unsupported hub.mode", http.StatusBadRequest)
+		return
+	}
+	if youtube.HubTopicPattern.FindStringSubmatch(topic) == nil {
+		http.Error(w, "unsupported hub.topic", http.StatusBadRequest)
+		return
+	}
+	if _, err := url.ParseRequestURI(callback); err != nil {
+		http.Error(w, "invalid hub.callback", http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	go func() {
+		err := s.verify(mode, topic, callback)
+		if err != nil {
+			slog.Warn("unable to verify callback", "mode", mode, "callback", callback, "topic", topic, logging.Err(err))
+			return
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if mode == youtube.HubModeSubscribe {
+			if s.subscriptions[topic] == nil {
+				s.subscriptions[topic] = make(map[string]struct{})
+			}
+			s.subscriptions[topic][callback] = struct{}{}
+		} else {
+			delete(s.subscriptions[topic], callback)
+		}
+		slog.Info("verified callback", "mode", mode, "callback", callback, "topic", topic)
+	}()
+}
+
+func (s *server) verify(mode string, topic string, callback string) error {
+	challenge := strconv.FormatInt(rand.Int63(), 10)
+	callbackURL, err := url.Parse(callback)
+	if err != nil {
+		return err
+	}
+	query := callbackURL.Query()
+	query.Set(youtube.HubMode, mode)
+	query.Set(youtube.HubTopic, topic)
+	query.Set(youtube.HubChallenge, challenge)
+	query.Set(youtube.HubLeaseSeconds, strconv.Itoa(leaseSeconds))
+	callbackURL.RawQuery = query.Encode()
+	response, err := s.client.Get(callbackURL.String())
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return errors.Errorf("unexpected status code: %v", response.StatusCode)
+	}
+	if string(body) != challenge {
+		return errors.Errorf("challenge mismatch: %v", string(body))
+	}
+	return nil
+}
+
+// push sends the Atom notification about the video to every subscriber of its channel.
+// Usage: POST /push?videoId=<id>
+func (s *server) push(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	video, ok := s.findVideo(r.FormValue("videoId"))
+	if !ok {
+		http.Error(w, "unknown videoId", http.StatusNotFound)
+		return
+	}
+	body, err := feedOf(video, s.channels[video.ChannelId])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	topic := fmt.Sprintf(youtube.HubTopicFormat, video.ChannelId)
+	s.mu.Lock()
+	callbacks := make([]string, 0, len(s.subscriptions[topic]))
+	for callback := range s.subscriptions[topic] {
+		callbacks = append(callbacks, callback)
+	}
+	s.mu.Unlock()
+	delivered := 0
+	for _, callback := range callbacks {
+		response, err := s.client.Post(callback, "application/atom+xml", strings.NewReader(body))
+		if err != nil {
+			slog.Warn("unable to push", "video_id", video.Id, "callback", callback, logging.Err(err))
+			continue
+		}
+		response.Body.Close()
+		if response.StatusCode < 200 || response.StatusCode >= 300 {
+			slog.Warn("unexpected status code", "status", response.StatusCode, "video_id", video.Id, "callback", callback)
+			continue
+		}
+		delivered++
+	}
+	writeJSON(w, map[string]int{"subscribers": len(callbacks), "delivered": delivered})
+}
+
+func (s *server) findVideo(id string) (fixtureVideo, bool) {
+	for _, video := range s.videos {
+		if video.Id == id {
+			return video, true
+		}
+	}
+	return fixtureVideo{}, false
+}
+
+type feedLink struct {
+	Rel  string `xml:"rel,attr"`
+	Href string `xml:"href,attr"`
+}
+
+type feedEntry struct {
+	ID        string   `xml:"id"`
+	VideoId   string   `xml:"yt:videoId"`
+	ChannelId string   `xml:"yt:channelId"`
+	Title     string   `xml:"title"`
+	Link      feedLink `xml:"link"`
+	Author    struct {
+		Name string `xml:"name"`
+		URI  string `xml:"uri"`
+	} `xml:"author"`
+	Published string `xml:"published"`
+	Updated   string `xml:"updated"`
+}
+
+type feed struct {
+	XMLName xml.Name   `xml:"feed"`
+	Yt      string     `xml:"xmlns:yt,attr"`
+	Xmlns   string     `xml:"xmlns,attr"`
+	Link    []feedLink `xml:"link"`
+	Title   string     `xml:"title"`
+	Updated string     `xml:"updated"`
+	Entry   feedEntry  `xml:"entry"`
+}
+
+func feedOf(video fixtureVideo, channel fixtureChannel) (string, error) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	topic := fmt.Sprintf(youtube.HubTopicFormat, video.ChannelId)
+	f := feed{
+		Yt:    ytNamespace,
+		Xmlns: feedNamespace,
+		Link: []feedLink{
+			{Rel: "hub", Href: "https://pubsubhubbub.appspot.com"},
+			{Rel: "self", Href: topic},
+		},
+		Title:   "YouTube video feed",
+		Updated: now,
+		Entry: feedEntry{
+			ID:        "yt:video:" + video.Id,
+			VideoId:   video.Id,
+			ChannelId: video.ChannelId,
+			Title:     video.Title,
+			Link:      feedLink{Rel: "alternate", Href: "https://www.youtube.com/watch?v=" + video.Id},
+			Published: now,
+			Updated:   now,
+		},
+	}
+	f.Entry.Author.Name = channel.Title
+	f.Entry.Author.URI = "https://www.youtube.com/channel/" + video.ChannelId
+	body, err := xml.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return "", errors.Wrap(err, "unable to encode feed")
+	}
+	return xml.Header + string(body), nil
+}
+
+// ids returns comma separated id parameter values
+func ids(r *http.Request) []string {
+	var result []string
+	if err := r.ParseForm(); err != nil {
+		return result
+	}
+	for _, value := range r.Form["id"] {
+		result = append(result, strings.Split(value, ",")...)
+	}
+	return result
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		slog.Warn("unable to write response", logging.Err(err))
+	}
+}
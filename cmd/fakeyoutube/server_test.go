@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/pkg/errors"
+	ytApi "google.golang.org/api/youtube/v3"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+	"youtube-stream-notifier-bot/youtube"
+)
+
+const testChannelId = "UCTSRIY3GLFYIpkR2QwyeklA"
+
+func newTestServer(t *testing.T) (*server, *httptest.Server) {
+	f, err := loadFixtures("fixtures.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newServer(f)
+	httpServer := httptest.NewServer(s.routes())
+	t.Cleanup(httpServer.Close)
+	return s, httpServer
+}
+
+func TestVideos(t *testing.T) {
+	_, httpServer := newTestServer(t)
+	service, err := youtube.NewService(context.Background(), "key", httpServer.URL+"/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	live, err := service.GetStreamInfo(context.Background(), "liveVideo01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedLive := youtube.StreamInfo{
+		Id:          "liveVideo01",
+		Channel:     youtube.ChannelInfo{Id: testChannelId, Title: "Test channel"},
+		Title:       "Live stream",
+		ActualStart: time.Date(2024, 1, 1, 18, 0, 0, 0, time.UTC),
+	}
+	if live != expectedLive {
+		t.Fatalf("unexpected live stream: %+v", live)
+	}
+	upcoming, err := service.GetStreamInfo(context.Background(), "upcoming001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !upcoming.IsUpcoming || !upcoming.ScheduledStart.Equal(time.Date(2030, 1, 1, 18, 0, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected upcoming stream: %+v", upcoming)
+	}
+	_, err = service.GetStreamInfo(context.Background(), "regular0001")
+	if !errors.Is(err, youtube.ErrNotStream) {
+		t.Fatalf("expected regular video not to be a stream, got %v", err)
+	}
+
+	// Unknown ids are skipped like in the real API
+	response, err := http.Get(httpServer.URL + "/youtube/v3/videos?id=liveVideo01,unknown&id=regular0001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	var videos ytApi.VideoListResponse
+	err = json.NewDecoder(response.Body).Decode(&videos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(videos.Items) != 2 || videos.Items[0].Id != "liveVideo01" || videos.Items[1].Id != "regular0001" {
+		t.Fatalf("expected 2 known videos, got %v", len(videos.Items))
+	}
+	if videos.Items[1].LiveStreamingDetails != nil {
+		t.Fatal("expected no live streaming details for a regular video")
+	}
+}
+
+func TestFeed(t *testing.T) {
+	s, httpServer := newTestServer(t)
+	var mu sync.Mutex
+	var feeds []youtube.Feed
+	subscriber := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			_, _ = io.WriteString(w, r.URL.Query().Get(youtube.HubChallenge))
+			return
+		}
+		var feed youtube.Feed
+		body, _ := io.ReadAll(r.Body)
+		err := xml.Unmarshal(body, &feed)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		feeds = append(feeds, feed)
+	}))
+	defer subscriber.Close()
+	topic := fmt.Sprintf(youtube.HubTopicFormat, testChannelId)
+
+	response, err := http.PostForm(
+		httpServer.URL+"/subscribe",
+		url.Values{
+			youtube.HubMode:     {youtube.HubModeSubscribe},
+			youtube.HubTopic:    {topic},
+			youtube.HubCallback: {subscriber.URL},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusAccepted {
+		t.Fatalf("unexpected subscribe status: %v", response.StatusCode)
+	}
+	// The callback is verified asynchronously
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		s.mu.Lock()
+		_, verified := s.subscriptions[topic][subscriber.URL]
+		s.mu.Unlock()
+		if verified {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the callback to be verified")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	response, err = http.Post(httpServer.URL+"/push?videoId=upcoming001", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result map[string]int
+	_ = json.NewDecoder(response.Body).Decode(&result)
+	response.Body.Close()
+	if result["subscribers"] != 1 || result["delivered"] != 1 {
+		t.Fatalf("expected the feed to be delivered to the subscriber, got %v", result)
+	}
+	if len(feeds) != 1 {
+		t.Fatalf("expected 1 feed, got %v", len(feeds))
+	}
+	entry := feeds[0].Entry
+	if entry.VideoId != "upcoming001" || entry.ChannelId != testChannelId || entry.Title != "Upcoming stream" {
+		t.Fatalf("unexpected feed entry: %+v", entry)
+	}
+	if entry.Author.Name != "Test channel" || len(feeds[0].Link) != 2 || feeds[0].Link[1].Href != topic {
+		t.Fatalf("unexpected feed: %+v", feeds[0])
+	}
+
+	response, err = http.Post(httpServer.URL+"/push?videoId=unknown", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected unknown video to be not found, got %v", response.StatusCode)
+	}
+}
@@ -0,0 +1,111 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"github.com/pkg/errors"
+)
+
+// Stats is an overview of the stored data for operators
+type Stats struct {
+	Chats         int
+	EnabledChats  int
+	Channels      int
+	Subscriptions int
+}
+
+func (d *DB) GetStats(ctx context.Context) (Stats, error) {
+	var stats Stats
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	err := d.db.QueryRowContext(
+		ctx,
+		"SELECT "+
+			"(SELECT count(*) FROM chats), "+
+			"(SELECT count(*) FROM chats WHERE enabled), "+
+			"(SELECT count(*) FROM channels), "+
+			"(SELECT count(*) FROM subscriptions)",
+	).Scan(&stats.Chats, &stats.EnabledChats, &stats.Channels, &stats.Subscriptions)
+	if err != nil {
+		return Stats{}, errors.Wrap(err, "error during counting stats")
+	}
+	return stats, nil
+}
+
+func (d *DB) ListEnabledChats(ctx context.Context) ([]Chat, error) {
+	var chats []Chat
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	err := d.db.NewSelect().
+		Model(&chats).
+		Where("enabled = ?", true).
+		Order("id").
+		Scan(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return chats, nil
+}
+
+func (d *DB) ListChats(ctx context.Context, limit, offset int) ([]Chat, error) {
+	chats := []Chat{}
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	err := d.db.NewSelect().
+		Model(&chats).
+		Order("id").
+		Limit(limit).
+		Offset(offset).
+		Scan(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "error during querying chats")
+	}
+	return chats, nil
+}
+
+func (d *DB) ListChannels(ctx context.Context, limit, offset int) ([]Channel, error) {
+	channels := []Channel{}
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	err := d.db.NewSelect().
+		Model(&channels).
+		Order("id").
+		Limit(limit).
+		Offset(offset).
+		Scan(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "error during querying channels")
+	}
+	return channels, nil
+}
+
+// ListStreams returns the streams notifications were sent for, most recently updated first
+func (d *DB) ListStreams(ctx context.Context, limit, offset int) ([]DoneStream, error) {
+	streams := []DoneStream{}
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	err := d.db.NewSelect().
+		Model(&streams).
+		Order("updated_at DESC").
+		Limit(limit).
+		Offset(offset).
+		Scan(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "error during querying streams")
+	}
+	return streams, nil
+}
+
+func (d *DB) GetStream(ctx context.Context, id string) (DoneStream, error) {
+	ds := DoneStream{Id: id}
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	err := d.db.NewSelect().Model(&ds).WherePK().Scan(ctx)
+	if err != nil && errors.Is(err, sql.ErrNoRows) {
+		return DoneStream{}, ErrNotFound
+	}
+	if err != nil {
+		return DoneStream{}, errors.Wrap(err, "error during querying stream")
+	}
+	return ds, nil
+}
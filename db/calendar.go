@@ -0,0 +1,83 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// SaveStream adds the stream or updates its details.
+// The sequence is incremented only when the title or the start time changes.
+func (d *DB) SaveStream(ctx context.Context, s Stream) error {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	_, err := d.db.NewInsert().
+		Model(&s).
+		On("CONFLICT (id) DO UPDATE").
+		Set("title = EXCLUDED.title").
+		Set("scheduled_start = COALESCE(EXCLUDED.scheduled_start, stream.scheduled_start)").
+		Set("actual_start = COALESCE(stream.actual_start, EXCLUDED.actual_start)").
+		Set("sequence = stream.sequence + 1").
+		Set("updated_at = EXCLUDED.updated_at").
+		Where(
+			"stream.title IS DISTINCT FROM EXCLUDED.title " +
+				"OR (EXCLUDED.scheduled_start IS NOT NULL AND stream.scheduled_start IS DISTINCT FROM EXCLUDED.scheduled_start) " +
+				"OR (stream.actual_start IS NULL AND EXCLUDED.actual_start IS NOT NULL)",
+		).
+		Exec(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "error during saving stream %v", s.Id)
+	}
+	return nil
+}
+
+// GetCalendarStreams returns the streams of the channels the chat is subscribed to that start after since
+func (d *DB) GetCalendarStreams(ctx context.Context, chatId int64, since time.Time, limit int) ([]Stream, error) {
+	var streams []Stream
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	err := d.db.NewSelect().
+		Model(&streams).
+		ColumnExpr("stream.*").
+		ColumnExpr("c.title AS channel_title").
+		Join("JOIN channels AS c ON c.id = stream.channel_id").
+		Where("stream.channel_id IN (SELECT channel_id FROM subscriptions WHERE chat_id = ?)", chatId).
+		Where("COALESCE(stream.actual_start, stream.scheduled_start) >= ?", since).
+		OrderExpr("COALESCE(stream.actual_start, stream.scheduled_start) DESC").
+		Limit(limit).
+		Scan(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "error during querying calendar streams")
+	}
+	return streams, nil
+}
+
+func (d *DB) SetChatCalendarToken(ctx context.Context, id int64, token string) error {
+	c := Chat{Id: id, CalendarToken: &token}
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	_, err := d.db.NewUpdate().
+		Model(&c).
+		Column("calendar_token").
+		WherePK().
+		Exec(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "error during setting calendar token of chat %v", id)
+	}
+	return nil
+}
+
+func (d *DB) GetChatByCalendarToken(ctx context.Context, token string) (Chat, error) {
+	var c Chat
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	err := d.db.NewSelect().Model(&c).Where("calendar_token = ?", token).Scan(ctx)
+	if err != nil && errors.Is(err, sql.ErrNoRows) {
+		return Chat{}, ErrNotFound
+	}
+	if err != nil {
+		return Chat{}, errors.Wrap(err, "error during querying chat by calendar token")
+	}
+	return c, nil
+}
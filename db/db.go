@@ -3,13 +3,10 @@ package db
 import (
 	"context"
 	"database/sql"
-	"github.com/go-pg/pg/v10"
 	"github.com/pkg/errors"
 	"github.com/uptrace/bun"
 	"github.com/uptrace/bun/dialect/pgdialect"
 	"github.com/uptrace/bun/driver/pgdriver"
-	"github.com/uptrace/bun/extra/bundebug"
-	"log"
 	"time"
 )
 
@@ -34,20 +31,35 @@ func New(address, user, password, database string) *DB {
 	)
 	sqldb := sql.OpenDB(connector)
 	db := bun.NewDB(sqldb, pgdialect.New())
+	db.AddQueryHook(metricsHook{})
+	db.AddQueryHook(tracingHook{})
 	return &DB{db: db, timeout: defaultTimeout}
 }
 
+// SQL returns the underlying connection pool
+func (d *DB) SQL() *sql.DB {
+	return d.db.DB
+}
+
+func (d *DB) Ping(ctx context.Context) error {
+	return d.db.PingContext(ctx)
+}
+
+func (d *DB) Close() error {
+	return d.db.Close()
+}
+
 func (d *DB) SetTimeout(duration time.Duration) {
 	d.timeout = duration
 }
 
 func (d *DB) EnableDebug() {
-	d.db.AddQueryHook(bundebug.NewQueryHook(bundebug.WithVerbose(true)))
+	d.db.AddQueryHook(queryLogHook{})
 }
 
-func (d *DB) GetChat(id int64) (Chat, error) {
+func (d *DB) GetChat(ctx context.Context, id int64) (Chat, error) {
 	u := Chat{Id: id}
-	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
 	defer cancel()
 	err := d.db.NewSelect().Model(&u).WherePK().Scan(ctx)
 	if err != nil && errors.Is(err, sql.ErrNoRows) {
@@ -59,33 +71,222 @@ func (d *DB) GetChat(id int64) (Chat, error) {
 	return u, nil
 }
 
-func (d *DB) AddChat(u Chat) error {
-	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+// AddChat adds the chat, an existing chat keeps its settings and only gets the enabled state.
+// Concurrent updates about the same chat do not conflict with each other.
+func (d *DB) AddChat(ctx context.Context, u Chat) error {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
 	defer cancel()
-	_, err := d.db.NewInsert().Model(&u).Exec(ctx)
+	_, err := d.db.NewInsert().
+		Model(&u).
+		On("CONFLICT (id) DO UPDATE").
+		Set("enabled = EXCLUDED.enabled").
+		Set("disabled_at = EXCLUDED.disabled_at").
+		Exec(ctx)
 	if err != nil {
 		return errors.Wrap(err, "error during adding user")
 	}
 	return nil
 }
 
-func (d *DB) SetChatTimeZone(id int64, timeZone string) error {
+func (d *DB) SetChatTimeZone(ctx context.Context, id int64, timeZone string) error {
 	c := Chat{
 		Id:       id,
 		TimeZone: &timeZone,
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
 	defer cancel()
 	_, err := d.db.NewUpdate().Model(&c).Set("time_zone = ?time_zone").WherePK().Exec(ctx)
 	return err
 }
 
-func (d *DB) GetChannel(id string) (Channel, error) {
+func (d *DB) SetChatEnabled(ctx context.Context, id int64, enabled bool) error {
+	c := Chat{
+		Id:      id,
+		Enabled: enabled,
+	}
+	if !enabled {
+		now := time.Now()
+		c.DisabledAt = &now
+	}
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	_, err := d.db.NewUpdate().
+		Model(&c).
+		Set("enabled = ?enabled").
+		Set("disabled_at = ?disabled_at").
+		WherePK().
+		Exec(ctx)
+	return err
+}
+
+// MigrateChat moves the chat with its settings and subscriptions to the new id.
+// The new chat may already exist if the bot received updates from the supergroup before the migration,
+// in this case settings and subscriptions are merged into it.
+func (d *DB) MigrateChat(ctx context.Context, fromId, toId int64) error {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	return d.db.RunInTx(
+		ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+			c := Chat{Id: fromId}
+			err := tx.NewSelect().Model(&c).WherePK().For("UPDATE").Scan(ctx)
+			if err != nil && errors.Is(err, sql.ErrNoRows) {
+				return ErrNotFound
+			}
+			if err != nil {
+				return errors.Wrap(err, "error during querying migrated chat")
+			}
+			if c.CalendarToken != nil {
+				// The token is unique, it moves to the new chat
+				_, err = tx.NewUpdate().
+					Model((*Chat)(nil)).
+					Set("calendar_token = NULL").
+					Where("id = ?", fromId).
+					Exec(ctx)
+				if err != nil {
+					return errors.Wrap(err, "error during releasing calendar token")
+				}
+			}
+			c.Id = toId
+			_, err = tx.NewInsert().
+				Model(&c).
+				On("CONFLICT (id) DO UPDATE").
+				Set("time_zone = COALESCE(chat.time_zone, EXCLUDED.time_zone)").
+				Set("telegram_channel_id = COALESCE(chat.telegram_channel_id, EXCLUDED.telegram_channel_id)").
+				Set("thread_id = COALESCE(chat.thread_id, EXCLUDED.thread_id)").
+				Set("calendar_token = COALESCE(chat.calendar_token, EXCLUDED.calendar_token)").
+				Set("enabled = EXCLUDED.enabled").
+				Set("disabled_at = EXCLUDED.disabled_at").
+				Exec(ctx)
+			if err != nil {
+				return errors.Wrap(err, "error during adding migrated chat")
+			}
+			// Channels already added in the supergroup would be duplicated
+			_, err = tx.NewDelete().
+				Model((*Subscription)(nil)).
+				Where("chat_id = ?", fromId).
+				Where("channel_id IN (SELECT channel_id FROM subscriptions WHERE chat_id = ?)", toId).
+				Exec(ctx)
+			if err != nil {
+				return errors.Wrap(err, "error during removing duplicate subscriptions")
+			}
+			_, err = tx.NewUpdate().
+				Model((*Subscription)(nil)).
+				Set("chat_id = ?", toId).
+				Where("chat_id = ?", fromId).
+				Exec(ctx)
+			if err != nil {
+				return errors.Wrap(err, "error during moving subscriptions")
+			}
+			_, err = tx.NewUpdate().
+				Model((*Delivery)(nil)).
+				Set("chat_id = ?", toId).
+				Where("chat_id = ?", fromId).
+				Where(
+					"NOT EXISTS (SELECT 1 FROM deliveries d WHERE d.chat_id = ? "+
+						"AND d.stream_id = delivery.stream_id AND d.state = delivery.state AND d.target = delivery.target)",
+					toId,
+				).
+				Exec(ctx)
+			if err != nil {
+				return errors.Wrap(err, "error during moving deliveries")
+			}
+			_, err = tx.NewUpdate().
+				Model((*ChatTarget)(nil)).
+				Set("chat_id = ?", toId).
+				Where("chat_id = ?", fromId).
+				Where("NOT EXISTS (SELECT 1 FROM chat_targets t WHERE t.chat_id = ? AND t.target = chat_target.target)", toId).
+				Exec(ctx)
+			if err != nil {
+				return errors.Wrap(err, "error during moving chat targets")
+			}
+			// Webhooks of the removed duplicate subscriptions are left behind and removed with the chat
+			_, err = tx.NewUpdate().
+				Model((*Webhook)(nil)).
+				Set("chat_id = ?", toId).
+				Where("chat_id = ?", fromId).
+				Where("NOT EXISTS (SELECT 1 FROM webhooks w WHERE w.chat_id = ? AND w.channel_id = webhook.channel_id)", toId).
+				Exec(ctx)
+			if err != nil {
+				return errors.Wrap(err, "error during moving webhooks")
+			}
+			_, err = tx.NewUpdate().
+				Model((*OutboxMessage)(nil)).
+				Set("chat_id = ?", toId).
+				Where("chat_id = ?", fromId).
+				Exec(ctx)
+			if err != nil {
+				return errors.Wrap(err, "error during moving outbox messages")
+			}
+			_, err = tx.NewDelete().Model((*Chat)(nil)).Where("id = ?", fromId).Exec(ctx)
+			if err != nil {
+				return errors.Wrap(err, "error during removing migrated chat")
+			}
+			return nil
+		},
+	)
+}
+
+// PurgeDisabledChats removes chats disabled before the given time, subscriptions are removed by cascade
+func (d *DB) PurgeDisabledChats(ctx context.Context, disabledBefore time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	result, err := d.db.NewDelete().
+		Model((*Chat)(nil)).
+		Where("enabled = ?", false).
+		Where("disabled_at < ?", disabledBefore).
+		Exec(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (d *DB) SetChatTelegramChannel(ctx context.Context, id int64, telegramChannelId *int64) error {
+	c := Chat{
+		Id:                id,
+		TelegramChannelId: telegramChannelId,
+	}
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	_, err := d.db.NewUpdate().Model(&c).Set("telegram_channel_id = ?telegram_channel_id").WherePK().Exec(ctx)
+	return err
+}
+
+func (d *DB) TelegramChannelLinked(ctx context.Context, telegramChannelId int64) (bool, error) {
+	var c Chat
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	return d.db.NewSelect().Model(&c).Where("telegram_channel_id = ?", telegramChannelId).Exists(ctx)
+}
+
+func (d *DB) UnlinkTelegramChannel(ctx context.Context, telegramChannelId int64) error {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	_, err := d.db.NewUpdate().
+		Model((*Chat)(nil)).
+		Set("telegram_channel_id = NULL").
+		Where("telegram_channel_id = ?", telegramChannelId).
+		Exec(ctx)
+	return err
+}
+
+func (d *DB) SetChatThread(ctx context.Context, id int64, threadId *int) error {
+	c := Chat{
+		Id:       id,
+		ThreadId: threadId,
+	}
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	_, err := d.db.NewUpdate().Model(&c).Set("thread_id = ?thread_id").WherePK().Exec(ctx)
+	return err
+}
+
+func (d *DB) GetChannel(ctx context.Context, id string) (Channel, error) {
 	c := Channel{Id: id}
-	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
 	defer cancel()
 	err := d.db.NewSelect().Model(&c).WherePK().Scan(ctx)
-	if err != nil && errors.Is(err, pg.ErrNoRows) {
+	if err != nil && errors.Is(err, sql.ErrNoRows) {
 		return Channel{}, ErrNotFound
 	}
 	if err != nil {
@@ -94,15 +295,15 @@ func (d *DB) GetChannel(id string) (Channel, error) {
 	return c, nil
 }
 
-func (d *DB) ChannelExists(id string) (bool, error) {
+func (d *DB) ChannelExists(ctx context.Context, id string) (bool, error) {
 	c := Channel{Id: id}
-	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
 	defer cancel()
 	return d.db.NewSelect().Model(&c).WherePK().Exists(ctx)
 }
 
-func (d *DB) AddChannel(c Channel) error {
-	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+func (d *DB) AddChannel(ctx context.Context, c Channel) error {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
 	defer cancel()
 	_, err := d.db.NewInsert().Model(&c).Exec(ctx)
 	if err != nil {
@@ -111,49 +312,62 @@ func (d *DB) AddChannel(c Channel) error {
 	return nil
 }
 
-func (d *DB) AddSubscription(userId int64, channelId string) error {
+func (d *DB) AddSubscription(ctx context.Context, userId int64, channelId string, threadId *int) error {
 	sub := Subscription{
 		ChatId:    userId,
 		ChannelId: channelId,
+		ThreadId:  threadId,
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	queryCtx, cancel := context.WithTimeout(ctx, d.timeout)
 	defer cancel()
 	exists, err := d.db.
 		NewSelect().
 		Model(&sub).
 		Where("chat_id = ?", sub.ChatId).
 		Where("channel_id = ?", sub.ChannelId).
-		Exists(ctx)
+		Exists(queryCtx)
 	if err != nil {
 		return err
 	}
 	if exists {
-		return nil
+		queryCtx, cancel := context.WithTimeout(ctx, d.timeout)
+		defer cancel()
+		_, err = d.db.NewUpdate().
+			Model(&sub).
+			Set("thread_id = ?thread_id").
+			Where("chat_id = ?", sub.ChatId).
+			Where("channel_id = ?", sub.ChannelId).
+			Exec(queryCtx)
+		return err
 	}
-	ctx, cancel = context.WithTimeout(context.Background(), d.timeout)
+	queryCtx, cancel = context.WithTimeout(ctx, d.timeout)
 	defer cancel()
-	_, err = d.db.NewInsert().Model(&sub).Exec(ctx)
+	_, err = d.db.NewInsert().Model(&sub).Exec(queryCtx)
 	return err
 }
 
-func (d *DB) GetSubscribedChannels(chatId int64) ([]Channel, error) {
+func (d *DB) GetSubscribedChannels(ctx context.Context, chatId int64) ([]Channel, error) {
 	var channels []Channel
-	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
 	defer cancel()
 	err := d.db.NewSelect().
 		Model(&channels).
+		ColumnExpr("channel.*").
+		ColumnExpr("s.thread_id AS subscription_thread_id").
 		Join("LEFT JOIN subscriptions AS s ON s.channel_id = channel.id").
 		Where("s.chat_id = ?", chatId).
 		Scan(ctx)
 	return channels, err
 }
 
-func (d *DB) GetSubscribedChats(channelId string) ([]Chat, error) {
+func (d *DB) GetSubscribedChats(ctx context.Context, channelId string) ([]Chat, error) {
 	var chats []Chat
-	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
 	defer cancel()
 	err := d.db.NewSelect().
 		Model(&chats).
+		ColumnExpr("chat.*").
+		ColumnExpr("s.thread_id AS subscription_thread_id").
 		Join("LEFT JOIN subscriptions AS s ON s.chat_id = chat.id").
 		Where("s.channel_id = ?", channelId).
 		Where("chat.enabled = ?", true).
@@ -161,25 +375,41 @@ func (d *DB) GetSubscribedChats(channelId string) ([]Chat, error) {
 	return chats, err
 }
 
-func (d *DB) RemoveSubscription(chatId int64, channelId string) error {
+// RemoveSubscription removes the subscription with its webhook
+func (d *DB) RemoveSubscription(ctx context.Context, chatId int64, channelId string) error {
 	sub := Subscription{ChatId: chatId, ChannelId: channelId}
-	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
 	defer cancel()
-	_, err := d.db.NewDelete().
-		Model(&sub).
-		Where("chat_id = ?", chatId).
-		Where("channel_id = ?", channelId).
-		Exec(ctx)
-	return err
+	return d.db.RunInTx(
+		ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+			_, err := tx.NewDelete().
+				Model((*Webhook)(nil)).
+				Where("chat_id = ?", chatId).
+				Where("channel_id = ?", channelId).
+				Exec(ctx)
+			if err != nil {
+				return errors.Wrap(err, "error during removing subscription webhook")
+			}
+			_, err = tx.NewDelete().
+				Model(&sub).
+				Where("chat_id = ?", chatId).
+				Where("channel_id = ?", channelId).
+				Exec(ctx)
+			return err
+		},
+	)
 }
 
-func (d *DB) ListActiveChannels() ([]Channel, error) {
+// Channels are followed while they have chat subscriptions, webhooks belong to the subscriptions
+const followedChannel = "EXISTS (SELECT 1 FROM subscriptions s WHERE s.channel_id = channel.id)"
+
+func (d *DB) ListActiveChannels(ctx context.Context) ([]Channel, error) {
 	var channels []Channel
-	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
 	defer cancel()
 	err := d.db.NewSelect().
 		Model(&channels).
-		Where("EXISTS (SELECT 1 FROM subscriptions s WHERE s.channel_id = channel.id)").
+		Where(followedChannel).
 		Scan(ctx)
 	if err != nil {
 		return nil, err
@@ -187,13 +417,13 @@ func (d *DB) ListActiveChannels() ([]Channel, error) {
 	return channels, nil
 }
 
-func (d *DB) ListLeaseExpiringChannels() ([]Channel, error) {
+func (d *DB) ListLeaseExpiringChannels(ctx context.Context) ([]Channel, error) {
 	var channels []Channel
-	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
 	defer cancel()
 	err := d.db.NewSelect().
 		Model(&channels).
-		Where("EXISTS (SELECT 1 FROM subscriptions s WHERE s.channel_id = channel.id)").
+		Where(followedChannel).
 		Where(
 			"(last_update + (channel.lease_seconds || ' seconds')::interval) < (NOW() + interval '5 minutes') " +
 				"OR channel.lease_seconds IS NULL",
@@ -205,48 +435,74 @@ func (d *DB) ListLeaseExpiringChannels() ([]Channel, error) {
 	return channels, nil
 }
 
-func (d *DB) MarkDone(streamId string, isUpcoming bool) error {
-	ds := DoneStream{
-		Id:           streamId,
-		DoneUpcoming: true,
-		DoneLive:     !isUpcoming,
-	}
-	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+// CountExpiredLeases returns the number of subscribed channels whose WebSub lease has expired
+// or was not confirmed within the grace period after subscribing
+func (d *DB) CountExpiredLeases(ctx context.Context, grace time.Duration) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
 	defer cancel()
-	exists, err := d.db.NewSelect().Model(&ds).WherePK().Exists(ctx)
+	count, err := d.db.NewSelect().
+		Model((*Channel)(nil)).
+		Where(followedChannel).
+		WhereGroup(" AND ", func(q *bun.SelectQuery) *bun.SelectQuery {
+			return q.
+				Where("(last_update + (channel.lease_seconds || ' seconds')::interval) < NOW()").
+				WhereOr("channel.lease_seconds IS NULL AND last_update < ?", time.Now().Add(-grace))
+		}).
+		Count(ctx)
 	if err != nil {
-		log.Printf("Unable to check if DoneStream with id %v exists: %v", ds.Id, err.Error())
-	}
-	if exists {
-		ctx, cancel = context.WithTimeout(context.Background(), d.timeout)
-		defer cancel()
-		_, err := d.db.NewUpdate().Model(&ds).WherePK().Exec(ctx)
-		return err
+		return 0, errors.Wrap(err, "error during counting expired leases")
 	}
-	ctx, cancel = context.WithTimeout(context.Background(), d.timeout)
-	defer cancel()
-	_, err = d.db.NewInsert().Model(&ds).Exec(ctx)
-	return err
+	return count, nil
 }
 
-func (d *DB) IsUpcomingDone(streamId string) (bool, error) {
-	ds := DoneStream{Id: streamId}
-	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+// MarkDone moves the stream to the given state in a single upsert.
+// The only allowed transitions are none -> upcoming, none -> live and upcoming -> live,
+// returns false if the stream has already reached the state.
+func (d *DB) MarkDone(ctx context.Context, streamId string, state StreamState) (bool, error) {
+	ds := DoneStream{
+		Id:           streamId,
+		State:        state,
+		DoneUpcoming: state == StreamStateUpcoming,
+		DoneLive:     state == StreamStateLive,
+		UpdatedAt:    time.Now(),
+	}
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
 	defer cancel()
-	return d.db.NewSelect().
+	result, err := d.db.NewInsert().
 		Model(&ds).
-		WherePK().
-		Where("done_upcoming = ?", true).
-		Exists(ctx)
+		On("CONFLICT (id) DO UPDATE").
+		Set("state = EXCLUDED.state").
+		Set("done_upcoming = done_stream.done_upcoming OR EXCLUDED.done_upcoming").
+		Set("done_live = done_stream.done_live OR EXCLUDED.done_live").
+		Set("updated_at = EXCLUDED.updated_at").
+		// Rows migrated without notifications have no state
+		Where(
+			"done_stream.state = ? OR (done_stream.state = ? AND EXCLUDED.state = ?)",
+			StreamStateNone, StreamStateUpcoming, StreamStateLive,
+		).
+		Returning("NULL").
+		Exec(ctx)
+	if err != nil {
+		return false, errors.Wrapf(err, "error during marking stream %v as %v", streamId, state)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
 }
 
-func (d *DB) IsLiveDone(streamId string) (bool, error) {
+// GetStreamState returns the state reached by the stream or StreamStateNone
+func (d *DB) GetStreamState(ctx context.Context, streamId string) (StreamState, error) {
 	ds := DoneStream{Id: streamId}
-	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
 	defer cancel()
-	return d.db.NewSelect().
-		Model(&ds).
-		WherePK().
-		Where("done_live = ?", true).
-		Exists(ctx)
+	err := d.db.NewSelect().Model(&ds).WherePK().Scan(ctx)
+	if err != nil && errors.Is(err, sql.ErrNoRows) {
+		return StreamStateNone, nil
+	}
+	if err != nil {
+		return StreamStateNone, errors.Wrap(err, "error during querying stream state")
+	}
+	return ds.State, nil
 }
@@ -0,0 +1,129 @@
+package db
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"time"
+)
+
+type DeliveryStatus string
+
+const (
+	// Delivery is claimed and the message is being sent
+	DeliveryStatusPending DeliveryStatus = "pending"
+	DeliveryStatusSent    DeliveryStatus = "sent"
+	// Message was saved to the outbox during shutdown
+	DeliveryStatusQueued DeliveryStatus = "queued"
+	DeliveryStatusFailed DeliveryStatus = "failed"
+)
+
+// DeliveryTarget is where the chat is notified
+type DeliveryTarget string
+
+const (
+	DeliveryTargetTelegram DeliveryTarget = "telegram"
+	DeliveryTargetDiscord  DeliveryTarget = "discord"
+	DeliveryTargetSlack    DeliveryTarget = "slack"
+	// Webhook of the chat subscription
+	DeliveryTargetWebhook DeliveryTarget = "webhook"
+)
+
+// ClaimDelivery records the intent to notify the chat about the stream state.
+// Every target of the chat is claimed separately.
+// Returns false if the chat was already notified or another worker is notifying it.
+// Only failed deliveries can be claimed again: a delivery left pending by a crash
+// may have been sent already and it is better to skip it than to notify twice.
+func (d *DB) ClaimDelivery(
+	ctx context.Context,
+	streamId string,
+	state StreamState,
+	chatId int64,
+	target DeliveryTarget,
+) (bool, error) {
+	now := time.Now()
+	delivery := Delivery{
+		StreamId:  streamId,
+		State:     state,
+		ChatId:    chatId,
+		Target:    target,
+		Status:    DeliveryStatusPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	result, err := d.db.NewInsert().
+		Model(&delivery).
+		On("CONFLICT (stream_id, state, chat_id, target) DO UPDATE").
+		Set("status = EXCLUDED.status").
+		Set("updated_at = EXCLUDED.updated_at").
+		Where("delivery.status = ?", DeliveryStatusFailed).
+		Returning("NULL").
+		Exec(ctx)
+	if err != nil {
+		return false, errors.Wrap(err, "error during claiming delivery")
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+// CompleteDelivery saves the outcome of a claimed delivery
+func (d *DB) CompleteDelivery(
+	ctx context.Context,
+	streamId string,
+	state StreamState,
+	chatId int64,
+	target DeliveryTarget,
+	status DeliveryStatus,
+	messageId *int,
+) error {
+	delivery := Delivery{
+		StreamId:  streamId,
+		State:     state,
+		ChatId:    chatId,
+		Target:    target,
+		Status:    status,
+		MessageId: messageId,
+		UpdatedAt: time.Now(),
+	}
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	_, err := d.db.NewUpdate().
+		Model(&delivery).
+		Column("status", "message_id", "updated_at").
+		WherePK().
+		Exec(ctx)
+	if err != nil {
+		return errors.Wrap(err, "error during saving delivery status")
+	}
+	return nil
+}
+
+// DeliveryStats is the number of deliveries of a stream by target, state and status
+type DeliveryStats struct {
+	Target DeliveryTarget
+	State  StreamState
+	Status DeliveryStatus
+	Count  int
+}
+
+func (d *DB) GetDeliveryStats(ctx context.Context, streamId string) ([]DeliveryStats, error) {
+	var stats []DeliveryStats
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	err := d.db.NewSelect().
+		Model((*Delivery)(nil)).
+		Column("target", "state", "status").
+		ColumnExpr("COUNT(*) AS count").
+		Where("stream_id = ?", streamId).
+		Group("target", "state", "status").
+		Order("target", "state", "status").
+		Scan(ctx, &stats)
+	if err != nil {
+		return nil, errors.Wrap(err, "error during querying delivery stats")
+	}
+	return stats, nil
+}
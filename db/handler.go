@@ -2,9 +2,10 @@ package db
 
 import (
 	"context"
-	"log"
 	"net/http"
 	"strconv"
+	"time"
+	"youtube-stream-notifier-bot/logging"
 	"youtube-stream-notifier-bot/youtube"
 )
 
@@ -25,33 +26,44 @@ func (d *DB) HandleConfirmSubscription(w http.ResponseWriter, r *http.Request) {
 	channelId := submatch[1]
 	lease, err := strconv.Atoi(leaseSeconds)
 	if err != nil {
-		log.Printf("unable to parse lease seconds: %v, source: %v", err.Error(), leaseSeconds)
+		logger().Warn(
+			"unable to parse lease seconds",
+			logging.ChannelId, channelId,
+			"lease_seconds", leaseSeconds,
+			logging.Err(err),
+		)
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
-	c := Channel{Id: channelId, LeaseSeconds: &lease}
-	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	// The lease starts when the subscription is confirmed
+	c := Channel{Id: channelId, LeaseSeconds: &lease, LastUpdate: time.Now()}
+	ctx, cancel := context.WithTimeout(r.Context(), d.timeout)
 	defer cancel()
-	update, err := d.db.NewUpdate().Model(&c).Set("lease_seconds = ?lease_seconds").WherePK().Exec(ctx)
+	update, err := d.db.NewUpdate().
+		Model(&c).
+		Set("lease_seconds = ?lease_seconds").
+		Set("last_update = ?last_update").
+		WherePK().
+		Exec(ctx)
 	if err != nil {
-		log.Printf("unable to save lease seconds: %v, channelId: %v", err.Error(), channelId)
+		logger().Error("unable to save lease seconds", logging.ChannelId, channelId, logging.Err(err))
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 	rowsAffected, err := update.RowsAffected()
 	if err != nil {
-		log.Printf("error during saving lease seconds: %v", err.Error())
+		logger().Error("unable to save lease seconds", logging.ChannelId, channelId, logging.Err(err))
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 	if rowsAffected == 0 {
-		log.Printf("zero rows affected during saving lease seconds: %v, channelId: %v", lease, channelId)
+		logger().Warn("subscription confirmed for unknown channel", logging.ChannelId, channelId, "lease_seconds", lease)
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 	_, err = w.Write([]byte(challenge))
 	if err != nil {
-		log.Printf("error during write challenge: %v", channelId)
+		logger().Warn("unable to write challenge", logging.ChannelId, channelId, logging.Err(err))
 		return
 	}
 }
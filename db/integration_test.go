@@ -0,0 +1,162 @@
+//go:build integration
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"os"
+	"testing"
+	"time"
+)
+
+// newTestDB connects to the database created by postgres_init.sql, e.g. the postgres service of docker-compose
+// with its port published. The address is taken from TEST_POSTGRES_ADDRESS.
+func newTestDB(t *testing.T) *DB {
+	address := os.Getenv("TEST_POSTGRES_ADDRESS")
+	if len(address) == 0 {
+		address = "localhost:5432"
+	}
+	d := New(address, "bot", "makelovenotwar", "bot")
+	t.Cleanup(func() {
+		_ = d.Close()
+	})
+	err := d.Migrate(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestGetChannelNotFound(t *testing.T) {
+	d := newTestDB(t)
+	_, err := d.GetChannel(context.Background(), "UCmissingChannelForTests")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+// testId makes the rows of a test run unique, so the tests can run against the same database again
+func testId(prefix string) string {
+	return fmt.Sprintf("%v%v", prefix, time.Now().UnixNano())
+}
+
+func TestMarkDone(t *testing.T) {
+	d := newTestDB(t)
+	ctx := context.Background()
+	mark := func(streamId string, state StreamState, expected bool) {
+		t.Helper()
+		done, err := d.MarkDone(ctx, streamId, state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if done != expected {
+			t.Fatalf("expected marking %v as %v to return %v", streamId, state, expected)
+		}
+	}
+	upcoming := testId("upcoming")
+	live := testId("live")
+	t.Cleanup(func() {
+		_, _ = d.db.ExecContext(ctx, "DELETE FROM done_streams WHERE id IN (?, ?)", upcoming, live)
+	})
+
+	mark(upcoming, StreamStateUpcoming, true)
+	mark(upcoming, StreamStateUpcoming, false)
+	mark(upcoming, StreamStateLive, true)
+	mark(upcoming, StreamStateLive, false)
+	mark(upcoming, StreamStateUpcoming, false)
+	mark(live, StreamStateLive, true)
+	mark(live, StreamStateUpcoming, false)
+
+	state, err := d.GetStreamState(ctx, upcoming)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != StreamStateLive {
+		t.Fatalf("expected the stream to be live, got %v", state)
+	}
+	var ds DoneStream
+	err = d.db.NewSelect().Model(&ds).Where("id = ?", upcoming).Scan(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ds.DoneUpcoming || !ds.DoneLive {
+		t.Fatalf("expected both notifications to be done: %+v", ds)
+	}
+}
+
+func TestMarkDoneMigratedStream(t *testing.T) {
+	d := newTestDB(t)
+	ctx := context.Background()
+	// Streams known before the states were added and not notified about have an empty state
+	streamId := testId("migrated")
+	t.Cleanup(func() {
+		_, _ = d.db.ExecContext(ctx, "DELETE FROM done_streams WHERE id = ?", streamId)
+	})
+	_, err := d.db.ExecContext(
+		ctx,
+		"INSERT INTO done_streams (id, state, done_upcoming, done_live, updated_at) VALUES (?, '', false, false, now())",
+		streamId,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done, err := d.MarkDone(ctx, streamId, StreamStateUpcoming)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !done {
+		t.Fatal("expected the migrated stream to become upcoming")
+	}
+	state, err := d.GetStreamState(ctx, streamId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != StreamStateUpcoming {
+		t.Fatalf("expected the stream to be upcoming, got %v", state)
+	}
+}
+
+func TestClaimDelivery(t *testing.T) {
+	d := newTestDB(t)
+	ctx := context.Background()
+	chatId := -time.Now().UnixNano()
+	streamId := testId("delivered")
+	err := d.AddChat(ctx, Chat{Id: chatId, Enabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Deliveries are removed with the chat
+	t.Cleanup(func() {
+		_, _ = d.db.ExecContext(ctx, "DELETE FROM chats WHERE id = ?", chatId)
+	})
+	claim := func(target DeliveryTarget, expected bool) {
+		t.Helper()
+		claimed, err := d.ClaimDelivery(ctx, streamId, StreamStateLive, chatId, target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claimed != expected {
+			t.Fatalf("expected claiming the %v delivery to return %v", target, expected)
+		}
+	}
+	complete := func(target DeliveryTarget, status DeliveryStatus) {
+		t.Helper()
+		err := d.CompleteDelivery(ctx, streamId, StreamStateLive, chatId, target, status, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	claim(DeliveryTargetTelegram, true)
+	// A pending delivery may have been sent already
+	claim(DeliveryTargetTelegram, false)
+	complete(DeliveryTargetTelegram, DeliveryStatusFailed)
+	claim(DeliveryTargetTelegram, true)
+	complete(DeliveryTargetTelegram, DeliveryStatusSent)
+	claim(DeliveryTargetTelegram, false)
+	// Targets of the chat are independent
+	claim(DeliveryTargetSlack, true)
+}
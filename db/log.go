@@ -0,0 +1,32 @@
+package db
+
+import (
+	"context"
+	"github.com/uptrace/bun"
+	"log/slog"
+	"time"
+	"youtube-stream-notifier-bot/logging"
+)
+
+func logger() *slog.Logger {
+	return logging.For("db")
+}
+
+// queryLogHook logs every query at debug level
+type queryLogHook struct{}
+
+func (h queryLogHook) BeforeQuery(ctx context.Context, _ *bun.QueryEvent) context.Context {
+	return ctx
+}
+
+func (h queryLogHook) AfterQuery(ctx context.Context, event *bun.QueryEvent) {
+	attrs := []any{
+		"operation", event.Operation(),
+		"duration", time.Since(event.StartTime),
+		"query", event.Query,
+	}
+	if event.Err != nil {
+		attrs = append(attrs, logging.Err(event.Err))
+	}
+	logger().DebugContext(ctx, "query", attrs...)
+}
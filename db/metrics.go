@@ -0,0 +1,19 @@
+package db
+
+import (
+	"context"
+	"github.com/uptrace/bun"
+	"time"
+	"youtube-stream-notifier-bot/metrics"
+)
+
+// metricsHook records query durations
+type metricsHook struct{}
+
+func (h metricsHook) BeforeQuery(ctx context.Context, _ *bun.QueryEvent) context.Context {
+	return ctx
+}
+
+func (h metricsHook) AfterQuery(_ context.Context, event *bun.QueryEvent) {
+	metrics.ObserveDBQuery(event.Operation(), time.Since(event.StartTime))
+}
@@ -0,0 +1,47 @@
+package db
+
+import (
+	"context"
+	"embed"
+	"github.com/pkg/errors"
+	"github.com/uptrace/bun"
+	"io/fs"
+)
+
+// Every feature brings its schema changes in its own file, the files run in the order of their names
+//
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+// migrationLockKey serializes the migrations of replicas starting at the same time
+const migrationLockKey = 7346510391
+
+// Migrate updates the schema of a database created from an older postgres_init.sql.
+// The migrations are idempotent and run in one transaction, so a failed start leaves the schema unchanged.
+func (d *DB) Migrate(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	return d.db.RunInTx(
+		ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+			_, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(?)", migrationLockKey)
+			if err != nil {
+				return errors.Wrap(err, "unable to lock migrations")
+			}
+			files, err := fs.ReadDir(migrations, "migrations")
+			if err != nil {
+				return errors.Wrap(err, "unable to list migrations")
+			}
+			for _, file := range files {
+				migration, err := fs.ReadFile(migrations, "migrations/"+file.Name())
+				if err != nil {
+					return errors.Wrapf(err, "unable to read migration %v", file.Name())
+				}
+				_, err = tx.ExecContext(ctx, string(migration))
+				if err != nil {
+					return errors.Wrapf(err, "error during migration %v", file.Name())
+				}
+			}
+			return nil
+		},
+	)
+}
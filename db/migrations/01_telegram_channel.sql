@@ -0,0 +1,3 @@
+-- Telegram channels linked to chats
+ALTER TABLE chats ADD COLUMN IF NOT EXISTS telegram_channel_id bigint;
+CREATE UNIQUE INDEX IF NOT EXISTS chats_telegram_channel_id ON chats USING btree (telegram_channel_id);
@@ -0,0 +1,3 @@
+-- Forum topics of chats and subscriptions
+ALTER TABLE chats ADD COLUMN IF NOT EXISTS thread_id integer;
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS thread_id integer;
@@ -0,0 +1,2 @@
+-- Time when the chat was disabled, used to purge long disabled chats
+ALTER TABLE chats ADD COLUMN IF NOT EXISTS disabled_at timestamp;
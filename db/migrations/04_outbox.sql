@@ -0,0 +1,13 @@
+-- Messages waiting for the rate limit of Telegram, claimed by a replica for a lease
+CREATE SEQUENCE IF NOT EXISTS outbox_messages_id_seq INCREMENT 1 MINVALUE 1 MAXVALUE 9223372036854775807 START 1 CACHE 1;
+CREATE TABLE IF NOT EXISTS outbox_messages (
+    id            bigint    DEFAULT nextval('outbox_messages_id_seq') NOT NULL,
+    chat_id       bigint    NOT NULL,
+    thread_id     integer,
+    text          text      NOT NULL,
+    created_at    timestamp NOT NULL,
+    claimed_until timestamp,
+    CONSTRAINT outbox_messages_pkey PRIMARY KEY (id),
+    CONSTRAINT outbox_messages_chat_id_fkey FOREIGN KEY (chat_id) REFERENCES chats(id) ON DELETE CASCADE
+);
+ALTER TABLE outbox_messages ADD COLUMN IF NOT EXISTS claimed_until timestamp;
@@ -0,0 +1,18 @@
+-- Stream states and the delivery log, the state of existing rows is derived from the notifications that were sent
+ALTER TABLE done_streams ADD COLUMN IF NOT EXISTS state text;
+UPDATE done_streams SET state = CASE WHEN done_live THEN 'live' WHEN done_upcoming THEN 'upcoming' ELSE '' END
+WHERE state IS NULL;
+ALTER TABLE done_streams ALTER COLUMN state SET NOT NULL;
+ALTER TABLE done_streams ADD COLUMN IF NOT EXISTS updated_at timestamp;
+UPDATE done_streams SET updated_at = now() WHERE updated_at IS NULL;
+ALTER TABLE done_streams ALTER COLUMN updated_at SET NOT NULL;
+
+CREATE TABLE IF NOT EXISTS deliveries (
+    stream_id  text      NOT NULL,
+    state      text      NOT NULL,
+    chat_id    bigint    NOT NULL,
+    status     text      NOT NULL,
+    updated_at timestamp NOT NULL,
+    CONSTRAINT deliveries_pkey PRIMARY KEY (stream_id, state, chat_id),
+    CONSTRAINT deliveries_chat_id_fkey FOREIGN KEY (chat_id) REFERENCES chats(id) ON DELETE CASCADE
+);
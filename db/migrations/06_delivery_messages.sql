@@ -0,0 +1,8 @@
+-- Deliveries keep the sent message and their age, queued messages complete the delivery of their stream
+ALTER TABLE deliveries ADD COLUMN IF NOT EXISTS message_id integer;
+ALTER TABLE deliveries ADD COLUMN IF NOT EXISTS created_at timestamp DEFAULT now() NOT NULL;
+ALTER TABLE deliveries ALTER COLUMN created_at DROP DEFAULT;
+CREATE INDEX IF NOT EXISTS deliveries_chat_id ON deliveries USING btree (chat_id);
+
+ALTER TABLE outbox_messages ADD COLUMN IF NOT EXISTS stream_id text;
+ALTER TABLE outbox_messages ADD COLUMN IF NOT EXISTS state text;
@@ -0,0 +1,40 @@
+-- Webhooks of subscriptions and the events they failed to receive
+CREATE SEQUENCE IF NOT EXISTS webhooks_id_seq INCREMENT 1 MINVALUE 1 MAXVALUE 9223372036854775807 START 1 CACHE 1;
+CREATE TABLE IF NOT EXISTS webhooks (
+    id         bigint    DEFAULT nextval('webhooks_id_seq') NOT NULL,
+    chat_id    bigint    NOT NULL,
+    channel_id text      NOT NULL,
+    url        text      NOT NULL,
+    secret     text      NOT NULL,
+    created_at timestamp NOT NULL,
+    CONSTRAINT webhooks_pkey PRIMARY KEY (id),
+    CONSTRAINT webhooks_chat_id_fkey FOREIGN KEY (chat_id) REFERENCES chats(id) ON DELETE CASCADE,
+    CONSTRAINT webhooks_channel_id_fkey FOREIGN KEY (channel_id) REFERENCES channels(id) ON DELETE CASCADE
+);
+-- Webhooks used to be set per channel, they cannot be assigned to a subscription and are removed
+ALTER TABLE webhooks ADD COLUMN IF NOT EXISTS chat_id bigint;
+DELETE FROM webhooks WHERE chat_id IS NULL;
+ALTER TABLE webhooks ALTER COLUMN chat_id SET NOT NULL;
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'webhooks_chat_id_fkey') THEN
+        ALTER TABLE webhooks ADD CONSTRAINT webhooks_chat_id_fkey
+            FOREIGN KEY (chat_id) REFERENCES chats(id) ON DELETE CASCADE;
+    END IF;
+END $$;
+CREATE UNIQUE INDEX IF NOT EXISTS webhooks_chat_id_channel_id ON webhooks USING btree (chat_id, channel_id);
+CREATE INDEX IF NOT EXISTS webhooks_channel_id ON webhooks USING btree (channel_id);
+
+CREATE SEQUENCE IF NOT EXISTS dead_letters_id_seq INCREMENT 1 MINVALUE 1 MAXVALUE 9223372036854775807 START 1 CACHE 1;
+CREATE TABLE IF NOT EXISTS dead_letters (
+    id         bigint    DEFAULT nextval('dead_letters_id_seq') NOT NULL,
+    webhook_id bigint    NOT NULL,
+    stream_id  text      NOT NULL,
+    state      text      NOT NULL,
+    payload    text      NOT NULL,
+    error      text      NOT NULL,
+    attempts   integer   NOT NULL,
+    created_at timestamp NOT NULL,
+    CONSTRAINT dead_letters_pkey PRIMARY KEY (id),
+    CONSTRAINT dead_letters_webhook_id_fkey FOREIGN KEY (webhook_id) REFERENCES webhooks(id) ON DELETE CASCADE
+);
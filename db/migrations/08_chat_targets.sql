@@ -0,0 +1,22 @@
+-- Discord and Slack destinations of chats, every target of a chat has its own delivery
+CREATE TABLE IF NOT EXISTS chat_targets (
+    chat_id    bigint    NOT NULL,
+    target     text      NOT NULL,
+    url        text      NOT NULL,
+    created_at timestamp NOT NULL,
+    CONSTRAINT chat_targets_pkey PRIMARY KEY (chat_id, target),
+    CONSTRAINT chat_targets_chat_id_fkey FOREIGN KEY (chat_id) REFERENCES chats(id) ON DELETE CASCADE
+);
+
+-- Deliveries logged before chat targets were Telegram messages
+ALTER TABLE deliveries ADD COLUMN IF NOT EXISTS target text DEFAULT 'telegram' NOT NULL;
+DO $$
+BEGIN
+    IF NOT EXISTS (
+        SELECT 1 FROM information_schema.key_column_usage
+        WHERE table_name = 'deliveries' AND constraint_name = 'deliveries_pkey' AND column_name = 'target'
+    ) THEN
+        ALTER TABLE deliveries DROP CONSTRAINT IF EXISTS deliveries_pkey,
+            ADD CONSTRAINT deliveries_pkey PRIMARY KEY (stream_id, state, chat_id, target);
+    END IF;
+END $$;
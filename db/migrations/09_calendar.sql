@@ -0,0 +1,16 @@
+-- Public calendars of chats and the details of the streams they list
+ALTER TABLE chats ADD COLUMN IF NOT EXISTS calendar_token text;
+CREATE UNIQUE INDEX IF NOT EXISTS chats_calendar_token ON chats USING btree (calendar_token);
+
+CREATE TABLE IF NOT EXISTS streams (
+    id              text      NOT NULL,
+    channel_id      text      NOT NULL,
+    title           text      NOT NULL,
+    scheduled_start timestamp,
+    actual_start    timestamp,
+    sequence        integer   NOT NULL,
+    updated_at      timestamp NOT NULL,
+    CONSTRAINT streams_pkey PRIMARY KEY (id),
+    CONSTRAINT streams_channel_id_fkey FOREIGN KEY (channel_id) REFERENCES channels(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS streams_channel_id ON streams USING btree (channel_id);
@@ -6,6 +6,16 @@ type Chat struct {
 	Id       int64 `bun:",pk"`
 	TimeZone *string
 	Enabled  bool
+	// Time when the chat was disabled, used to purge long disabled chats
+	DisabledAt *time.Time
+	// Telegram channel where notifications are posted instead of this chat
+	TelegramChannelId *int64
+	// Forum topic where notifications are sent by default
+	ThreadId *int
+	// Secret of the public calendar URL, nil until the calendar is requested
+	CalendarToken *string
+	// Forum topic of a particular subscription, filled only by GetSubscribedChats
+	SubscriptionThreadId *int `bun:",scanonly"`
 }
 
 type Channel struct {
@@ -13,16 +23,98 @@ type Channel struct {
 	Title        string
 	LeaseSeconds *int
 	LastUpdate   time.Time
+	// Forum topic of the subscription, filled only by GetSubscribedChannels
+	SubscriptionThreadId *int `bun:",scanonly"`
 }
 
 type Subscription struct {
 	Id        int64 `bun:",pk,autoincrement"`
 	ChatId    int64
 	ChannelId string
+	// Forum topic where notifications about the channel are sent
+	ThreadId *int
 }
 
 type DoneStream struct {
-	Id           string `bun:",pk"`
+	Id    string `bun:",pk"`
+	State StreamState
+	// Whether notifications were sent for the state, upcoming may be skipped
 	DoneUpcoming bool
 	DoneLive     bool
+	UpdatedAt    time.Time
+}
+
+// Stream keeps the details of the streams for calendars, it is updated on every notification
+type Stream struct {
+	Id             string `bun:",pk"`
+	ChannelId      string
+	Title          string
+	ScheduledStart *time.Time
+	ActualStart    *time.Time
+	// Incremented when the title or the start changes, calendar apps replace the event with a higher sequence
+	Sequence  int
+	UpdatedAt time.Time
+	// Filled only by GetCalendarStreams
+	ChannelTitle string `bun:",scanonly"`
+}
+
+// OutboxMessage is a notification that was not sent before shutdown
+type OutboxMessage struct {
+	Id       int64 `bun:",pk,autoincrement"`
+	ChatId   int64
+	ThreadId *int
+	Text     string
+	// Delivery completed when the message is sent
+	StreamId  *string
+	State     *StreamState
+	CreatedAt time.Time
+	// Message is being sent by a process until then
+	ClaimedUntil *time.Time
+}
+
+// Delivery is the status of a notification about the stream state for a chat
+type Delivery struct {
+	StreamId string         `bun:",pk"`
+	State    StreamState    `bun:",pk"`
+	ChatId   int64          `bun:",pk"`
+	Target   DeliveryTarget `bun:",pk"`
+	Status   DeliveryStatus
+	// Telegram message id of the sent notification
+	MessageId *int
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// ChatTarget is an additional destination of the notifications for the chat subscriptions
+type ChatTarget struct {
+	ChatId int64          `bun:",pk"`
+	Target DeliveryTarget `bun:",pk"`
+	// Incoming webhook URL of the Discord or Slack channel
+	URL       string `bun:"url"`
+	CreatedAt time.Time
+}
+
+// Webhook posts the stream events of the chat subscription to an HTTP endpoint.
+// A subscription has at most one webhook, it is removed with the subscription.
+type Webhook struct {
+	Id        int64 `bun:",pk,autoincrement"`
+	ChatId    int64
+	ChannelId string
+	URL       string `bun:"url"`
+	// Key of the HMAC-SHA256 signature of the events
+	Secret    string
+	CreatedAt time.Time
+}
+
+// DeadLetter is an event the webhook did not accept after all attempts
+type DeadLetter struct {
+	Id        int64 `bun:",pk,autoincrement"`
+	WebhookId int64
+	StreamId  string
+	State     StreamState
+	// JSON of the event as it was sent
+	Payload   string
+	Error     string
+	Attempts  int
+	CreatedAt time.Time
 }
@@ -0,0 +1,57 @@
+package db
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"sort"
+	"time"
+)
+
+func (d *DB) AddOutboxMessage(ctx context.Context, m OutboxMessage) error {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	_, err := d.db.NewInsert().Model(&m).Exec(ctx)
+	if err != nil {
+		return errors.Wrap(err, "error during adding outbox message")
+	}
+	return nil
+}
+
+// ClaimOutboxMessages claims up to limit oldest messages that are not claimed by another process for the lease.
+// Messages stay in the outbox until they are removed, so the ones claimed by a process that died are taken again
+// when the lease expires.
+func (d *DB) ClaimOutboxMessages(ctx context.Context, lease time.Duration, limit int) ([]OutboxMessage, error) {
+	var messages []OutboxMessage
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	now := time.Now()
+	_, err := d.db.NewUpdate().
+		Model((*OutboxMessage)(nil)).
+		Set("claimed_until = ?", now.Add(lease)).
+		Where(
+			"id IN (SELECT id FROM outbox_messages WHERE claimed_until IS NULL OR claimed_until < ? "+
+				"ORDER BY id LIMIT ? FOR UPDATE SKIP LOCKED)",
+			now, limit,
+		).
+		Returning("*").
+		Exec(ctx, &messages)
+	if err != nil {
+		return nil, errors.Wrap(err, "error during claiming outbox messages")
+	}
+	sort.Slice(
+		messages, func(i, j int) bool {
+			return messages[i].Id < messages[j].Id
+		},
+	)
+	return messages, nil
+}
+
+func (d *DB) RemoveOutboxMessage(ctx context.Context, id int64) error {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	_, err := d.db.NewDelete().Model((*OutboxMessage)(nil)).Where("id = ?", id).Exec(ctx)
+	if err != nil {
+		return errors.Wrap(err, "error during removing outbox message")
+	}
+	return nil
+}
@@ -2,8 +2,8 @@ package db
 
 import (
 	"context"
-	"fmt"
 	"time"
+	"youtube-stream-notifier-bot/logging"
 )
 
 const (
@@ -29,29 +29,43 @@ func (d *DB) startPolling(ctx context.Context, ids chan Channel, leaseExpiring b
 		var channels []Channel
 		var err error
 		if leaseExpiring {
-			channels, err = d.ListLeaseExpiringChannels()
+			channels, err = d.ListLeaseExpiringChannels(ctx)
 		} else {
-			channels, err = d.ListActiveChannels()
+			channels, err = d.ListActiveChannels(ctx)
 		}
 		if err != nil {
-			fmt.Println(err.Error())
-			time.Sleep(sleepOnErrorTime)
+			logger().Error("unable to list channels", "lease_expiring", leaseExpiring, logging.Err(err))
+			if !sleep(ctx, sleepOnErrorTime) {
+				return
+			}
 			continue
 		}
 		for _, channel := range channels {
+			// The consumer may be gone during shutdown, so the send must not block
 			select {
 			case <-ctx.Done():
 				return
-			default:
-				ids <- channel
+			case ids <- channel:
 			}
 		}
-		if len(channels) == 0 {
-			time.Sleep(sleepOnEmptyTime)
+		if len(channels) == 0 && !sleep(ctx, sleepOnEmptyTime) {
+			return
 		}
 		delta := minimumLeaseExpiringPollInterval.Nanoseconds() - time.Now().Sub(then).Nanoseconds()
-		if leaseExpiring && delta > 0 {
-			time.Sleep(time.Duration(delta))
+		if leaseExpiring && delta > 0 && !sleep(ctx, time.Duration(delta)) {
+			return
 		}
 	}
 }
+
+// sleep returns false if the context is done before the duration elapses
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
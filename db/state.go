@@ -0,0 +1,29 @@
+package db
+
+// StreamState is the last state of a stream whose notifications were sent
+type StreamState string
+
+const (
+	StreamStateNone     StreamState = ""
+	StreamStateUpcoming StreamState = "upcoming"
+	StreamStateLive     StreamState = "live"
+)
+
+var streamStateOrder = map[StreamState]int{
+	StreamStateNone:     0,
+	StreamStateUpcoming: 1,
+	StreamStateLive:     2,
+}
+
+func StreamStateOf(isUpcoming bool) StreamState {
+	if isUpcoming {
+		return StreamStateUpcoming
+	}
+	return StreamStateLive
+}
+
+// Reached reports whether notifications for the target state are no longer needed.
+// A live stream does not need an upcoming notification.
+func (s StreamState) Reached(target StreamState) bool {
+	return streamStateOrder[s] >= streamStateOrder[target]
+}
@@ -0,0 +1,61 @@
+package db
+
+import (
+	"context"
+	"github.com/pkg/errors"
+)
+
+// SetChatTarget adds the target to the chat or replaces its URL
+func (d *DB) SetChatTarget(ctx context.Context, t ChatTarget) error {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	_, err := d.db.NewInsert().
+		Model(&t).
+		On("CONFLICT (chat_id, target) DO UPDATE").
+		Set("url = EXCLUDED.url").
+		Set("created_at = EXCLUDED.created_at").
+		Exec(ctx)
+	if err != nil {
+		return errors.Wrap(err, "error during setting chat target")
+	}
+	return nil
+}
+
+// RemoveChatTarget returns false if the chat did not have the target
+func (d *DB) RemoveChatTarget(ctx context.Context, chatId int64, target DeliveryTarget) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	result, err := d.db.NewDelete().
+		Model((*ChatTarget)(nil)).
+		Where("chat_id = ?", chatId).
+		Where("target = ?", target).
+		Exec(ctx)
+	if err != nil {
+		return false, errors.Wrap(err, "error during removing chat target")
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+// GetSubscribedTargets returns the targets of the enabled chats subscribed to the channel
+func (d *DB) GetSubscribedTargets(ctx context.Context, channelId string, target DeliveryTarget) ([]ChatTarget, error) {
+	var targets []ChatTarget
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	err := d.db.NewSelect().
+		Model(&targets).
+		Join("JOIN subscriptions AS s ON s.chat_id = chat_target.chat_id").
+		Join("JOIN chats AS c ON c.id = chat_target.chat_id").
+		Where("s.channel_id = ?", channelId).
+		Where("chat_target.target = ?", target).
+		Where("c.enabled = ?", true).
+		Order("chat_target.chat_id").
+		Scan(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "error during querying subscribed targets")
+	}
+	return targets, nil
+}
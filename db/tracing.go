@@ -0,0 +1,42 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"github.com/pkg/errors"
+	"github.com/uptrace/bun"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"youtube-stream-notifier-bot/tracing"
+)
+
+type querySpanKey struct{}
+
+// tracingHook records queries as child spans of the trace in the query context.
+// Queries outside of a trace are skipped, otherwise every background query would start a new trace.
+type tracingHook struct{}
+
+func (h tracingHook) BeforeQuery(ctx context.Context, event *bun.QueryEvent) context.Context {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx
+	}
+	ctx, span := tracing.Start(
+		ctx,
+		"db "+event.Operation(),
+		attribute.String("db.system", "postgresql"),
+		attribute.String("db.operation", event.Operation()),
+	)
+	return context.WithValue(ctx, querySpanKey{}, span)
+}
+
+func (h tracingHook) AfterQuery(ctx context.Context, event *bun.QueryEvent) {
+	span, ok := ctx.Value(querySpanKey{}).(trace.Span)
+	if !ok {
+		return
+	}
+	err := event.Err
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+	}
+	tracing.End(span, err)
+}
@@ -0,0 +1,161 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"github.com/pkg/errors"
+)
+
+// SetWebhook adds the webhook to the chat subscription or replaces its URL and secret
+func (d *DB) SetWebhook(ctx context.Context, w *Webhook) error {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	_, err := d.db.NewInsert().
+		Model(w).
+		On("CONFLICT (chat_id, channel_id) DO UPDATE").
+		Set("url = EXCLUDED.url").
+		Set("secret = EXCLUDED.secret").
+		Set("created_at = EXCLUDED.created_at").
+		Exec(ctx)
+	if err != nil {
+		return errors.Wrap(err, "error during setting webhook")
+	}
+	return nil
+}
+
+func (d *DB) GetWebhook(ctx context.Context, id int64) (Webhook, error) {
+	w := Webhook{Id: id}
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	err := d.db.NewSelect().Model(&w).WherePK().Scan(ctx)
+	if err != nil && errors.Is(err, sql.ErrNoRows) {
+		return Webhook{}, ErrNotFound
+	}
+	if err != nil {
+		return Webhook{}, errors.Wrap(err, "error during querying webhook")
+	}
+	return w, nil
+}
+
+func (d *DB) ListWebhooks(ctx context.Context, limit, offset int) ([]Webhook, error) {
+	webhooks := []Webhook{}
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	err := d.db.NewSelect().
+		Model(&webhooks).
+		Order("id").
+		Limit(limit).
+		Offset(offset).
+		Scan(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "error during querying webhooks")
+	}
+	return webhooks, nil
+}
+
+// GetChannelWebhooks returns the webhooks of the enabled chats subscribed to the channel
+func (d *DB) GetChannelWebhooks(ctx context.Context, channelId string) ([]Webhook, error) {
+	var webhooks []Webhook
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	err := d.db.NewSelect().
+		Model(&webhooks).
+		Join("JOIN subscriptions AS s ON s.chat_id = webhook.chat_id AND s.channel_id = webhook.channel_id").
+		Join("JOIN chats AS c ON c.id = webhook.chat_id").
+		Where("webhook.channel_id = ?", channelId).
+		Where("c.enabled = ?", true).
+		Order("webhook.id").
+		Scan(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "error during querying channel webhooks")
+	}
+	return webhooks, nil
+}
+
+func (d *DB) GetChatWebhooks(ctx context.Context, chatId int64) ([]Webhook, error) {
+	var webhooks []Webhook
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	err := d.db.NewSelect().
+		Model(&webhooks).
+		Where("chat_id = ?", chatId).
+		Order("id").
+		Scan(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "error during querying chat webhooks")
+	}
+	return webhooks, nil
+}
+
+// RemoveWebhook removes the webhook of the chat subscription with its dead letters
+func (d *DB) RemoveWebhook(ctx context.Context, chatId int64, channelId string) error {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	result, err := d.db.NewDelete().
+		Model((*Webhook)(nil)).
+		Where("chat_id = ?", chatId).
+		Where("channel_id = ?", channelId).
+		Exec(ctx)
+	if err != nil {
+		return errors.Wrap(err, "error during removing webhook")
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (d *DB) AddDeadLetter(ctx context.Context, l DeadLetter) error {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	_, err := d.db.NewInsert().Model(&l).Exec(ctx)
+	if err != nil {
+		return errors.Wrap(err, "error during adding dead letter")
+	}
+	return nil
+}
+
+func (d *DB) GetDeadLetter(ctx context.Context, id int64) (DeadLetter, error) {
+	l := DeadLetter{Id: id}
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	err := d.db.NewSelect().Model(&l).WherePK().Scan(ctx)
+	if err != nil && errors.Is(err, sql.ErrNoRows) {
+		return DeadLetter{}, ErrNotFound
+	}
+	if err != nil {
+		return DeadLetter{}, errors.Wrap(err, "error during querying dead letter")
+	}
+	return l, nil
+}
+
+// ListDeadLetters returns the dead letters, the most recent first
+func (d *DB) ListDeadLetters(ctx context.Context, limit, offset int) ([]DeadLetter, error) {
+	letters := []DeadLetter{}
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	err := d.db.NewSelect().
+		Model(&letters).
+		Order("id DESC").
+		Limit(limit).
+		Offset(offset).
+		Scan(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "error during querying dead letters")
+	}
+	return letters, nil
+}
+
+func (d *DB) RemoveDeadLetter(ctx context.Context, id int64) error {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	_, err := d.db.NewDelete().Model((*DeadLetter)(nil)).Where("id = ?", id).Exec(ctx)
+	if err != nil {
+		return errors.Wrap(err, "error during removing dead letter")
+	}
+	return nil
+}
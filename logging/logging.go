@@ -0,0 +1,57 @@
+package logging
+
+import (
+	"github.com/pkg/errors"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// Field keys shared by all components
+const (
+	Component = "component"
+	StreamId  = "stream_id"
+	ChannelId = "channel_id"
+	ChatId    = "chat_id"
+	Error     = "error"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Setup makes the configured logger the default one.
+// Empty level means info, empty format means text.
+func Setup(w io.Writer, level string, format string) error {
+	var l slog.Level
+	if len(level) > 0 {
+		err := l.UnmarshalText([]byte(level))
+		if err != nil {
+			return errors.Wrapf(err, "unknown log level %v", level)
+		}
+	}
+	options := &slog.HandlerOptions{Level: l}
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "", FormatText:
+		handler = slog.NewTextHandler(w, options)
+	case FormatJSON:
+		handler = slog.NewJSONHandler(w, options)
+	default:
+		return errors.Errorf("unknown log format %v", format)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// For returns the default logger tagged with the component.
+// The default logger is resolved on every call, so it can be used before Setup.
+func For(component string) *slog.Logger {
+	return slog.Default().With(Component, component)
+}
+
+// Err is the error field
+func Err(err error) slog.Attr {
+	return slog.String(Error, err.Error())
+}
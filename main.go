@@ -3,30 +3,49 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"log"
+	"log/slog"
 	"os"
 	"os/signal"
 	"syscall"
 	"youtube-stream-notifier-bot/bot"
+	"youtube-stream-notifier-bot/logging"
 )
 
 func main() {
 	file, err := os.ReadFile("./config.json")
 	if err != nil {
-		log.Fatalf("unable to read config file: %v", err.Error())
-		return
+		slog.Error("unable to read config file", logging.Err(err))
+		os.Exit(1)
 	}
 
 	var c bot.Config
 	err = json.Unmarshal(file, &c)
 	if err != nil {
-		log.Fatalf("unable to unmarshall config file: %v", err.Error())
+		slog.Error("unable to unmarshall config file", logging.Err(err))
+		os.Exit(1)
+	}
+	// The container health check runs the binary with the same config
+	if len(os.Args) > 1 && os.Args[1] == "healthcheck" {
+		err = bot.CheckHealth(context.Background(), c)
+		if err != nil {
+			slog.Error("bot is not healthy", logging.Err(err))
+			os.Exit(1)
+		}
 		return
 	}
+	err = bot.SetupLogging(c)
+	if err != nil {
+		slog.Error("unable to set up logging", logging.Err(err))
+		os.Exit(1)
+	}
 	ctx, cancel := context.WithCancel(context.Background())
 	confirm := make(chan struct{})
 	go func() {
-		log.Fatal(bot.Start(ctx, c, confirm))
+		err := bot.Start(ctx, c, confirm)
+		if err != nil {
+			slog.Error("unable to start bot", logging.Err(err))
+			os.Exit(1)
+		}
 	}()
 	s := make(chan os.Signal, 1)
 	signal.Notify(s, os.Interrupt, syscall.SIGTERM)
@@ -0,0 +1,159 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const namespace = "notifier"
+
+// Results of webhook delivery attempts
+const (
+	WebhookDelivered  = "delivered"
+	WebhookRetried    = "retried"
+	WebhookDeadLetter = "dead_letter"
+)
+
+// Failure reasons of notifications
+const (
+	ReasonBlocked      = "blocked"
+	ReasonChatNotFound = "chat_not_found"
+	ReasonKicked       = "kicked"
+	ReasonMigrated     = "migrated"
+	ReasonOther        = "other"
+)
+
+// YouTube Data API quota cost of the methods, see https://developers.google.com/youtube/v3/determine_quota_cost
+var quotaCost = map[string]int{
+	"channels.list": 1,
+	"videos.list":   1,
+	"search.list":   100,
+}
+
+// YouTube resets the daily quota at midnight Pacific time
+var quotaLocation = loadQuotaLocation()
+
+func loadQuotaLocation() *time.Location {
+	location, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		return time.UTC
+	}
+	return location
+}
+
+// dailyQuota counts quota units used since the last daily reset
+type dailyQuota struct {
+	mu   sync.Mutex
+	day  string
+	used int
+}
+
+var youtubeDailyQuota dailyQuota
+
+// add returns the units used today including the added ones
+func (q *dailyQuota) add(units int, now time.Time) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	day := now.In(quotaLocation).Format(time.DateOnly)
+	if day != q.day {
+		q.day = day
+		q.used = 0
+	}
+	q.used += units
+	return q.used
+}
+
+var (
+	FeedNotifications = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "feed_notifications_total",
+		Help:      "Incoming WebSub feed notifications by result.",
+	}, []string{"result"})
+	youtubeCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "youtube_api_calls_total",
+		Help:      "YouTube Data API calls by method.",
+	}, []string{"method"})
+	youtubeErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "youtube_api_errors_total",
+		Help:      "Failed YouTube Data API calls by method.",
+	}, []string{"method"})
+	youtubeQuota = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "youtube_api_quota_units_total",
+		Help:      "YouTube Data API quota units used.",
+	})
+	NotificationsSent = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "notifications_sent_total",
+		Help:      "Stream notifications sent to Telegram.",
+	})
+	NotificationsFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "notifications_failed_total",
+		Help:      "Stream notifications that could not be sent by reason.",
+	}, []string{"reason"})
+	WebhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "webhook_deliveries_total",
+		Help:      "Webhook delivery attempts by result.",
+	}, []string{"result"})
+	ChatTargetNotifications = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "chat_target_notifications_total",
+		Help:      "Stream notifications posted to Discord and Slack by target and status.",
+	}, []string{"target", "status"})
+	DispatchLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "dispatch_latency_seconds",
+		Help:      "Time from receiving the stream to sending the notification to Telegram.",
+		Buckets:   []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600},
+	})
+	StreamLockWait = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "stream_lock_wait_seconds",
+		Help:      "Time spent waiting for the stream lock.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 8),
+	})
+	StreamLockFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "stream_lock_failures_total",
+		Help:      "Stream locks that were not obtained because another worker held them.",
+	})
+	dbQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "db_query_duration_seconds",
+		Help:      "Database query durations by operation.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 4, 8),
+	}, []string{"operation"})
+)
+
+// Handler serves metrics in Prometheus format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// ObserveYouTubeCall records the call of YouTube Data API method and the quota it used.
+// Failed calls are charged as well.
+func ObserveYouTubeCall(method string, err error) {
+	youtubeCalls.WithLabelValues(method).Inc()
+	youtubeQuota.Add(float64(quotaCost[method]))
+	youtubeDailyQuota.add(quotaCost[method], time.Now())
+	if err != nil {
+		youtubeErrors.WithLabelValues(method).Inc()
+	}
+}
+
+// YouTubeQuotaToday returns quota units used by this instance since the daily reset
+func YouTubeQuotaToday() int {
+	return youtubeDailyQuota.add(0, time.Now())
+}
+
+func ObserveDBQuery(operation string, duration time.Duration) {
+	dbQueryDuration.WithLabelValues(operation).Observe(duration.Seconds())
+}
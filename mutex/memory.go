@@ -0,0 +1,101 @@
+package mutex
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// memoryLocker keeps locks in the process memory, suitable for a single instance deployment
+type memoryLocker struct {
+	mu    sync.Mutex
+	locks map[string]memoryLock
+	// Distinguishes owners of the same lock name
+	lastToken uint64
+}
+
+type memoryLock struct {
+	token     uint64
+	expiresAt time.Time
+}
+
+func NewMemoryLocker() Locker {
+	return &memoryLocker{locks: make(map[string]memoryLock)}
+}
+
+func (l *memoryLocker) NewMutex(name string, expiry time.Duration) Mutex {
+	return &memoryMutex{locker: l, name: name, expiry: expiry}
+}
+
+func (l *memoryLocker) Ping(context.Context) error {
+	return nil
+}
+
+type memoryMutex struct {
+	locker *memoryLocker
+	name   string
+	expiry time.Duration
+	token  uint64
+}
+
+func (m *memoryMutex) Name() string {
+	return m.name
+}
+
+func (m *memoryMutex) Lock() error {
+	for i := 0; i < lockTries; i++ {
+		if i > 0 {
+			time.Sleep(retryDelay())
+		}
+		if m.tryLock() {
+			return nil
+		}
+	}
+	return ErrNotObtained
+}
+
+func (m *memoryMutex) tryLock() bool {
+	l := m.locker
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	lock, ok := l.locks[m.name]
+	if ok && lock.expiresAt.After(now) {
+		return false
+	}
+	l.lastToken++
+	m.token = l.lastToken
+	l.locks[m.name] = memoryLock{token: m.token, expiresAt: now.Add(m.expiry)}
+	return true
+}
+
+func (m *memoryMutex) Unlock() (bool, error) {
+	l := m.locker
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lock, ok := l.locks[m.name]
+	if !ok || lock.token != m.token {
+		return false, nil
+	}
+	delete(l.locks, m.name)
+	return true, nil
+}
+
+func (m *memoryMutex) Extend() (bool, error) {
+	l := m.locker
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	lock, ok := l.locks[m.name]
+	if !ok || lock.token != m.token || !lock.expiresAt.After(now) {
+		return false, nil
+	}
+	lock.expiresAt = now.Add(m.expiry)
+	l.locks[m.name] = lock
+	return true, nil
+}
+
+func retryDelay() time.Duration {
+	return lockMinRetryDelay + time.Duration(rand.Int63n(int64(lockMaxRetryDelay-lockMinRetryDelay)))
+}
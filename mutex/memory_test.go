@@ -0,0 +1,122 @@
+package mutex
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryMutexContention(t *testing.T) {
+	locker := NewMemoryLocker()
+	first := locker.NewMutex("stream:1", time.Minute)
+	second := locker.NewMutex("stream:1", time.Minute)
+	other := locker.NewMutex("stream:2", time.Minute)
+
+	err := first.Lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.(*memoryMutex).tryLock() {
+		t.Fatal("expected the held lock not to be obtained")
+	}
+	err = other.Lock()
+	if err != nil {
+		t.Fatalf("expected a lock with another name to be obtained, got %v", err)
+	}
+
+	// Lock retries until the holder releases the lock
+	go func() {
+		time.Sleep(lockMinRetryDelay)
+		_, _ = first.Unlock()
+	}()
+	err = second.Lock()
+	if err != nil {
+		t.Fatalf("expected the released lock to be obtained, got %v", err)
+	}
+	unlocked, err := second.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !unlocked {
+		t.Fatal("expected the lock to be released")
+	}
+	unlocked, err = second.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unlocked {
+		t.Fatal("expected the released lock not to be released again")
+	}
+}
+
+func TestMemoryMutexExpiry(t *testing.T) {
+	locker := NewMemoryLocker()
+	expired := locker.NewMutex("stream:1", time.Millisecond*10)
+	holder := locker.NewMutex("stream:1", time.Minute)
+
+	err := expired.Lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 20)
+	if !holder.(*memoryMutex).tryLock() {
+		t.Fatal("expected the expired lock to be obtained")
+	}
+
+	// The stale token of the expired owner neither extends nor releases the new owner's lock
+	extended, err := expired.Extend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if extended {
+		t.Fatal("expected the expired lock not to be extended")
+	}
+	unlocked, err := expired.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unlocked {
+		t.Fatal("expected the stale owner not to release the lock")
+	}
+	if expired.(*memoryMutex).tryLock() {
+		t.Fatal("expected the lock to be kept by the new owner")
+	}
+	unlocked, err = holder.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !unlocked {
+		t.Fatal("expected the new owner to release the lock")
+	}
+}
+
+func TestMemoryMutexExtend(t *testing.T) {
+	locker := NewMemoryLocker()
+	m := locker.NewMutex("stream:1", time.Millisecond*200)
+	contender := locker.NewMutex("stream:1", time.Minute)
+
+	extended, err := m.Extend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if extended {
+		t.Fatal("expected a lock that is not held not to be extended")
+	}
+	err = m.Lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Extending before the expiry keeps the lock past the original expiry
+	for i := 0; i < 3; i++ {
+		time.Sleep(time.Millisecond * 100)
+		extended, err = m.Extend()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !extended {
+			t.Fatal("expected the held lock to be extended")
+		}
+	}
+	if contender.(*memoryMutex).tryLock() {
+		t.Fatal("expected the extended lock not to be obtained")
+	}
+}
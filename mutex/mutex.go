@@ -1,38 +1,52 @@
 package mutex
 
 import (
+	"context"
 	"fmt"
-	"github.com/go-redis/redis"
-	"github.com/go-redsync/redsync/v4"
-	"github.com/go-redsync/redsync/v4/redis/goredis"
+	"github.com/pkg/errors"
 	"time"
 )
 
 const (
-	streamLockExpiration     = time.Minute * 5
-	streamChatLockExpiration = time.Minute * 5
-	streamKeyPattern         = "stream:%v"
-	streamChatKeyPattern     = "stream:%v:user:%v"
+	streamLockExpiration = time.Minute * 5
+	streamKeyPattern     = "stream:%v"
+	// Same defaults as redsync uses
+	lockTries         = 32
+	lockMinRetryDelay = time.Millisecond * 50
+	lockMaxRetryDelay = time.Millisecond * 250
 )
 
+var ErrNotObtained = errors.New("lock already obtained")
+
+// Mutex is a distributed lock that expires unless it is extended
+type Mutex interface {
+	Name() string
+	// Lock retries until the lock is obtained or the tries are exhausted
+	Lock() error
+	Unlock() (bool, error)
+	Extend() (bool, error)
+}
+
+// Locker is a lock backend
+type Locker interface {
+	NewMutex(name string, expiry time.Duration) Mutex
+	// Ping checks that the backend is reachable
+	Ping(ctx context.Context) error
+}
+
 type Builder struct {
-	rs *redsync.Redsync
+	locker Locker
 }
 
-func NewBuilder(address string) *Builder {
-	client := redis.NewClient(&redis.Options{Addr: address})
-	pool := goredis.NewPool(client)
-	rs := redsync.New(pool)
-	return &Builder{rs: rs}
+func NewBuilder(locker Locker) *Builder {
+	return &Builder{locker: locker}
 }
 
-func (c *Builder) Stream(streamId string) *redsync.Mutex {
-	key := fmt.Sprintf(streamKeyPattern, streamId)
-	mutex := c.rs.NewMutex(key, redsync.WithExpiry(streamLockExpiration))
-	return mutex
+func (c *Builder) Ping(ctx context.Context) error {
+	return c.locker.Ping(ctx)
 }
 
-func (c *Builder) LockStreamChat(streamId string, chatId int64) *redsync.Mutex {
-	key := fmt.Sprintf(streamChatKeyPattern, streamId, chatId)
-	return c.rs.NewMutex(key, redsync.WithExpiry(streamChatLockExpiration))
+func (c *Builder) Stream(streamId string) Mutex {
+	key := fmt.Sprintf(streamKeyPattern, streamId)
+	return c.locker.NewMutex(key, streamLockExpiration)
 }
@@ -0,0 +1,133 @@
+package mutex
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"github.com/pkg/errors"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+const postgresLockTimeout = time.Second * 10
+
+// postgresLocker uses session level advisory locks.
+// A lock holds its own connection, so it is released by Postgres if the instance dies.
+// Advisory locks do not expire, the expiry is ignored and Extend always succeeds while the lock is held.
+type postgresLocker struct {
+	db *sql.DB
+}
+
+func NewPostgresLocker(db *sql.DB) Locker {
+	return &postgresLocker{db: db}
+}
+
+func (l *postgresLocker) NewMutex(name string, _ time.Duration) Mutex {
+	return &postgresMutex{db: l.db, name: name, key: advisoryKey(name)}
+}
+
+func (l *postgresLocker) Ping(ctx context.Context) error {
+	return l.db.PingContext(ctx)
+}
+
+// advisoryKey maps the lock name to the bigint key of an advisory lock
+func advisoryKey(name string) int64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(name))
+	return int64(h.Sum64())
+}
+
+type postgresMutex struct {
+	db   *sql.DB
+	name string
+	key  int64
+	mu   sync.Mutex
+	conn *sql.Conn
+}
+
+func (m *postgresMutex) Name() string {
+	return m.name
+}
+
+func (m *postgresMutex) Lock() error {
+	for i := 0; i < lockTries; i++ {
+		if i > 0 {
+			time.Sleep(retryDelay())
+		}
+		ok, err := m.tryLock()
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+	}
+	return ErrNotObtained
+}
+
+func (m *postgresMutex) tryLock() (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), postgresLockTimeout)
+	defer cancel()
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return false, errors.Wrap(err, "unable to get connection for advisory lock")
+	}
+	var obtained bool
+	err = conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", m.key).Scan(&obtained)
+	if err != nil {
+		_ = conn.Close()
+		return false, errors.Wrap(err, "unable to obtain advisory lock")
+	}
+	if !obtained {
+		_ = conn.Close()
+		return false, nil
+	}
+	m.mu.Lock()
+	m.conn = conn
+	m.mu.Unlock()
+	return true, nil
+}
+
+func (m *postgresMutex) Unlock() (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.conn == nil {
+		return false, nil
+	}
+	conn := m.conn
+	m.conn = nil
+	defer func() {
+		_ = conn.Close()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), postgresLockTimeout)
+	defer cancel()
+	var released bool
+	err := conn.QueryRowContext(ctx, "SELECT pg_advisory_unlock($1)", m.key).Scan(&released)
+	if err != nil {
+		// Discard the connection instead of returning it to the pool, Postgres releases the lock with the session
+		_ = conn.Raw(
+			func(interface{}) error {
+				return driver.ErrBadConn
+			},
+		)
+		return false, errors.Wrap(err, "unable to release advisory lock")
+	}
+	return released, nil
+}
+
+func (m *postgresMutex) Extend() (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.conn == nil {
+		return false, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), postgresLockTimeout)
+	defer cancel()
+	// Keeps the connection alive and checks that the session still exists
+	err := m.conn.PingContext(ctx)
+	if err != nil {
+		return false, errors.Wrap(err, "advisory lock connection is lost")
+	}
+	return true, nil
+}
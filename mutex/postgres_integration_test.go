@@ -0,0 +1,89 @@
+//go:build integration
+
+package mutex
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+	"youtube-stream-notifier-bot/db"
+)
+
+// newTestPostgresLocker connects to the database used by the db integration tests, see TEST_POSTGRES_ADDRESS
+func newTestPostgresLocker(t *testing.T) Locker {
+	address := os.Getenv("TEST_POSTGRES_ADDRESS")
+	if len(address) == 0 {
+		address = "localhost:5432"
+	}
+	d := db.New(address, "bot", "makelovenotwar", "bot")
+	t.Cleanup(func() {
+		_ = d.Close()
+	})
+	locker := NewPostgresLocker(d.SQL())
+	err := locker.Ping(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return locker
+}
+
+func TestPostgresMutex(t *testing.T) {
+	locker := newTestPostgresLocker(t)
+	name := "test:" + time.Now().Format(time.RFC3339Nano)
+	first := locker.NewMutex(name, time.Minute)
+	second := locker.NewMutex(name, time.Minute)
+
+	err := first.Lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Advisory locks are held by the session, the second mutex has its own connection
+	obtained, err := second.(*postgresMutex).tryLock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obtained {
+		t.Fatal("expected the held lock not to be obtained")
+	}
+	extended, err := first.Extend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !extended {
+		t.Fatal("expected the held lock to be extended")
+	}
+	extended, err = second.Extend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if extended {
+		t.Fatal("expected a lock that is not held not to be extended")
+	}
+	unlocked, err := second.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unlocked {
+		t.Fatal("expected a lock that is not held not to be released")
+	}
+
+	unlocked, err = first.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !unlocked {
+		t.Fatal("expected the lock to be released")
+	}
+	err = second.Lock()
+	if err != nil {
+		t.Fatalf("expected the released lock to be obtained, got %v", err)
+	}
+	unlocked, err = second.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !unlocked {
+		t.Fatal("expected the lock to be released")
+	}
+}
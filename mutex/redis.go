@@ -0,0 +1,28 @@
+package mutex
+
+import (
+	"context"
+	"github.com/go-redis/redis"
+	"github.com/go-redsync/redsync/v4"
+	"github.com/go-redsync/redsync/v4/redis/goredis"
+	"time"
+)
+
+type redisLocker struct {
+	client *redis.Client
+	rs     *redsync.Redsync
+}
+
+func NewRedisLocker(address string) Locker {
+	client := redis.NewClient(&redis.Options{Addr: address})
+	pool := goredis.NewPool(client)
+	return &redisLocker{client: client, rs: redsync.New(pool)}
+}
+
+func (l *redisLocker) NewMutex(name string, expiry time.Duration) Mutex {
+	return l.rs.NewMutex(name, redsync.WithExpiry(expiry))
+}
+
+func (l *redisLocker) Ping(ctx context.Context) error {
+	return l.client.WithContext(ctx).Ping().Err()
+}
@@ -15,16 +15,26 @@ CREATE TABLE "public"."chats" (
                                   "id" bigint NOT NULL,
                                   "time_zone" text,
                                   "enabled" boolean NOT NULL,
+                                  "disabled_at" timestamp,
+                                  "telegram_channel_id" bigint,
+                                  "thread_id" integer,
+                                  "calendar_token" text,
                                   CONSTRAINT "users_user_id" PRIMARY KEY ("id")
 ) WITH (oids = false);
 
 CREATE INDEX "chats_enabled" ON "public"."chats" USING btree ("enabled");
 
+CREATE UNIQUE INDEX "chats_telegram_channel_id" ON "public"."chats" USING btree ("telegram_channel_id");
+
+CREATE UNIQUE INDEX "chats_calendar_token" ON "public"."chats" USING btree ("calendar_token");
+
 
 CREATE TABLE "public"."done_streams" (
                                          "id" text NOT NULL,
+                                         "state" text NOT NULL,
                                          "done_upcoming" boolean NOT NULL,
                                          "done_live" boolean NOT NULL,
+                                         "updated_at" timestamp NOT NULL,
                                          CONSTRAINT "done_streams_id" PRIMARY KEY ("id")
 ) WITH (oids = false);
 
@@ -32,6 +42,19 @@ CREATE INDEX "done_streams_done_live" ON "public"."done_streams" USING btree ("d
 
 CREATE INDEX "done_streams_done_upcoming" ON "public"."done_streams" USING btree ("done_upcoming");
 
+CREATE TABLE "public"."streams" (
+                                    "id" text NOT NULL,
+                                    "channel_id" text NOT NULL,
+                                    "title" text NOT NULL,
+                                    "scheduled_start" timestamp,
+                                    "actual_start" timestamp,
+                                    "sequence" integer NOT NULL,
+                                    "updated_at" timestamp NOT NULL,
+                                    CONSTRAINT "streams_pkey" PRIMARY KEY ("id")
+) WITH (oids = false);
+
+CREATE INDEX "streams_channel_id" ON "public"."streams" USING btree ("channel_id");
+
 
 CREATE SEQUENCE subscriptions_id_seq INCREMENT 1 MINVALUE 1 MAXVALUE 9223372036854775807 START 10 CACHE 1;
 
@@ -39,11 +62,85 @@ CREATE TABLE "public"."subscriptions" (
                                           "id" bigint DEFAULT nextval('subscriptions_id_seq') NOT NULL,
                                           "chat_id" bigint NOT NULL,
                                           "channel_id" text NOT NULL,
+                                          "thread_id" integer,
                                           CONSTRAINT "subscriptions_pkey" PRIMARY KEY ("id")
 ) WITH (oids = false);
 
 
+CREATE TABLE "public"."deliveries" (
+                                       "stream_id" text NOT NULL,
+                                       "state" text NOT NULL,
+                                       "chat_id" bigint NOT NULL,
+                                       "target" text DEFAULT 'telegram' NOT NULL,
+                                       "status" text NOT NULL,
+                                       "message_id" integer,
+                                       "created_at" timestamp NOT NULL,
+                                       "updated_at" timestamp NOT NULL,
+                                       CONSTRAINT "deliveries_pkey" PRIMARY KEY ("stream_id", "state", "chat_id", "target")
+) WITH (oids = false);
+
+CREATE INDEX "deliveries_chat_id" ON "public"."deliveries" USING btree ("chat_id");
+
+CREATE SEQUENCE outbox_messages_id_seq INCREMENT 1 MINVALUE 1 MAXVALUE 9223372036854775807 START 1 CACHE 1;
+
+CREATE TABLE "public"."outbox_messages" (
+                                            "id" bigint DEFAULT nextval('outbox_messages_id_seq') NOT NULL,
+                                            "chat_id" bigint NOT NULL,
+                                            "thread_id" integer,
+                                            "text" text NOT NULL,
+                                            "stream_id" text,
+                                            "state" text,
+                                            "created_at" timestamp NOT NULL,
+                                            "claimed_until" timestamp,
+                                            CONSTRAINT "outbox_messages_pkey" PRIMARY KEY ("id")
+) WITH (oids = false);
+
+CREATE TABLE "public"."chat_targets" (
+                                         "chat_id" bigint NOT NULL,
+                                         "target" text NOT NULL,
+                                         "url" text NOT NULL,
+                                         "created_at" timestamp NOT NULL,
+                                         CONSTRAINT "chat_targets_pkey" PRIMARY KEY ("chat_id", "target")
+) WITH (oids = false);
+
+CREATE SEQUENCE webhooks_id_seq INCREMENT 1 MINVALUE 1 MAXVALUE 9223372036854775807 START 1 CACHE 1;
+
+CREATE TABLE "public"."webhooks" (
+                                     "id" bigint DEFAULT nextval('webhooks_id_seq') NOT NULL,
+                                     "chat_id" bigint NOT NULL,
+                                     "channel_id" text NOT NULL,
+                                     "url" text NOT NULL,
+                                     "secret" text NOT NULL,
+                                     "created_at" timestamp NOT NULL,
+                                     CONSTRAINT "webhooks_pkey" PRIMARY KEY ("id")
+) WITH (oids = false);
+
+CREATE UNIQUE INDEX "webhooks_chat_id_channel_id" ON "public"."webhooks" USING btree ("chat_id", "channel_id");
+
+CREATE INDEX "webhooks_channel_id" ON "public"."webhooks" USING btree ("channel_id");
+
+CREATE SEQUENCE dead_letters_id_seq INCREMENT 1 MINVALUE 1 MAXVALUE 9223372036854775807 START 1 CACHE 1;
+
+CREATE TABLE "public"."dead_letters" (
+                                         "id" bigint DEFAULT nextval('dead_letters_id_seq') NOT NULL,
+                                         "webhook_id" bigint NOT NULL,
+                                         "stream_id" text NOT NULL,
+                                         "state" text NOT NULL,
+                                         "payload" text NOT NULL,
+                                         "error" text NOT NULL,
+                                         "attempts" integer NOT NULL,
+                                         "created_at" timestamp NOT NULL,
+                                         CONSTRAINT "dead_letters_pkey" PRIMARY KEY ("id")
+) WITH (oids = false);
+
 ALTER TABLE ONLY "public"."subscriptions" ADD CONSTRAINT "subscriptions_channel_id_fkey" FOREIGN KEY (channel_id) REFERENCES channels(id) ON DELETE CASCADE NOT DEFERRABLE;
 ALTER TABLE ONLY "public"."subscriptions" ADD CONSTRAINT "subscriptions_user_id_fkey" FOREIGN KEY (chat_id) REFERENCES chats(id) ON DELETE CASCADE NOT DEFERRABLE;
+ALTER TABLE ONLY "public"."deliveries" ADD CONSTRAINT "deliveries_chat_id_fkey" FOREIGN KEY (chat_id) REFERENCES chats(id) ON DELETE CASCADE NOT DEFERRABLE;
+ALTER TABLE ONLY "public"."outbox_messages" ADD CONSTRAINT "outbox_messages_chat_id_fkey" FOREIGN KEY (chat_id) REFERENCES chats(id) ON DELETE CASCADE NOT DEFERRABLE;
+ALTER TABLE ONLY "public"."streams" ADD CONSTRAINT "streams_channel_id_fkey" FOREIGN KEY (channel_id) REFERENCES channels(id) ON DELETE CASCADE NOT DEFERRABLE;
+ALTER TABLE ONLY "public"."chat_targets" ADD CONSTRAINT "chat_targets_chat_id_fkey" FOREIGN KEY (chat_id) REFERENCES chats(id) ON DELETE CASCADE NOT DEFERRABLE;
+ALTER TABLE ONLY "public"."webhooks" ADD CONSTRAINT "webhooks_chat_id_fkey" FOREIGN KEY (chat_id) REFERENCES chats(id) ON DELETE CASCADE NOT DEFERRABLE;
+ALTER TABLE ONLY "public"."webhooks" ADD CONSTRAINT "webhooks_channel_id_fkey" FOREIGN KEY (channel_id) REFERENCES channels(id) ON DELETE CASCADE NOT DEFERRABLE;
+ALTER TABLE ONLY "public"."dead_letters" ADD CONSTRAINT "dead_letters_webhook_id_fkey" FOREIGN KEY (webhook_id) REFERENCES webhooks(id) ON DELETE CASCADE NOT DEFERRABLE;
 
 -- 2022-04-05 15:23:32.591474+00
\ No newline at end of file
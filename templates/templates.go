@@ -31,4 +31,80 @@ var (
 	SetTimeZoneHelp string
 	//go:embed resource/timeZoneSuccess.txt
 	TimeZoneSuccess string
+	//go:embed resource/adminOnly.txt
+	AdminOnly string
+	//go:embed resource/groupHello.txt
+	GroupHello string
+	//go:embed resource/emptyLink.txt
+	EmptyLink string
+	//go:embed resource/linkPrivateOnly.txt
+	LinkPrivateOnly string
+	//go:embed resource/linkNotChannel.txt
+	LinkNotChannel string
+	//go:embed resource/linkBotNotAdmin.txt
+	LinkBotNotAdmin string
+	//go:embed resource/linkSenderNotAdmin.txt
+	LinkSenderNotAdmin string
+	//go:embed resource/linkAlreadyLinked.txt
+	LinkAlreadyLinked string
+	//go:embed resource/linkSuccess.txt
+	LinkSuccess string
+	//go:embed resource/unlinkSuccess.txt
+	UnlinkSuccess string
+	//go:embed resource/notLinked.txt
+	NotLinked string
+	//go:embed resource/hereSuccess.txt
+	HereSuccess string
+	//go:embed resource/hereGeneral.txt
+	HereGeneral string
+	//go:embed resource/chatTargetUsage.txt
+	ChatTargetUsage string
+	//go:embed resource/chatTargetSuccess.txt
+	ChatTargetSuccess string
+	//go:embed resource/chatTargetRemoved.txt
+	ChatTargetRemoved string
+	//go:embed resource/chatTargetNotSet.txt
+	ChatTargetNotSet string
+	//go:embed resource/chatTargetInvalid.txt
+	ChatTargetInvalid string
+	//go:embed resource/webhookUsage.txt
+	WebhookUsage string
+	//go:embed resource/webhookSuccess.txt
+	WebhookSuccess string
+	//go:embed resource/webhookSecret.txt
+	WebhookSecret string
+	//go:embed resource/webhookSecretSent.txt
+	WebhookSecretSent string
+	//go:embed resource/webhookSecretNotSent.txt
+	WebhookSecretNotSent string
+	//go:embed resource/webhookRemoved.txt
+	WebhookRemoved string
+	//go:embed resource/webhookNotSet.txt
+	WebhookNotSet string
+	//go:embed resource/webhookInvalid.txt
+	WebhookInvalid string
+	//go:embed resource/calendarLink.txt
+	CalendarLink string
+	//go:embed resource/calendarDisabled.txt
+	CalendarDisabled string
+	//go:embed resource/adminStats.txt
+	AdminStats string
+	//go:embed resource/adminUsage.txt
+	AdminUsage string
+	//go:embed resource/broadcastStarted.txt
+	BroadcastStarted string
+	//go:embed resource/broadcastDone.txt
+	BroadcastDone string
+	//go:embed resource/adminChannel.txt
+	AdminChannel string
+	//go:embed resource/channelNotFound.txt
+	ChannelNotFound string
+	//go:embed resource/resubscribeSuccess.txt
+	ResubscribeSuccess string
+	//go:embed resource/notSubscriptionMode.txt
+	NotSubscriptionMode string
+	//go:embed resource/chatNotFound.txt
+	ChatNotFound string
+	//go:embed resource/chatDisabled.txt
+	ChatDisabled string
 )
@@ -1,12 +1,13 @@
 package timezone
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/pkg/errors"
-	"log"
 	"net/http"
 	"net/url"
+	"youtube-stream-notifier-bot/logging"
 )
 
 type Service struct {
@@ -19,7 +20,7 @@ func NewService(token string) *Service {
 
 const getTZURL = "http://api.timezonedb.com/v2.1/get-time-zone"
 
-func (s *Service) GetTimeZone(lat, lng string) (string, error) {
+func (s *Service) GetTimeZone(ctx context.Context, lat, lng string) (string, error) {
 	values := url.Values{}
 	values.Set("key", s.token)
 	values.Set("format", "json")
@@ -27,14 +28,18 @@ func (s *Service) GetTimeZone(lat, lng string) (string, error) {
 	values.Set("fields", "zoneName")
 	values.Set("lat", lat)
 	values.Set("lng", lng)
-	response, err := http.Get(fmt.Sprintf("%v?%v", getTZURL, values.Encode()))
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%v?%v", getTZURL, values.Encode()), nil)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to create timezonedb request")
+	}
+	response, err := http.DefaultClient.Do(request)
 	if err != nil {
 		return "", errors.Wrap(err, "unable to get timezone from timezonedb")
 	}
 	defer func() {
 		err := response.Body.Close()
 		if err != nil {
-			log.Printf("Error during closing TZ body: %v", err.Error())
+			logging.For("timezone").Warn("unable to close response body", logging.Err(err))
 		}
 	}()
 	tzPayload := struct {
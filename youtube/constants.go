@@ -12,11 +12,12 @@ const (
 )
 
 const (
-	HubModeSubscribe          = "subscribe"
-	HubVerifyAsync            = "async"
-	HubTopicFormat            = "https://www.youtube.com/xml/feeds/videos.xml?channel_id=%v"
-	HubYouTubeURL             = "https://pubsubhubbub.appspot.com/subscribe"
-	HubSubscribePathURLFormat = "http://%v/video"
+	HubModeSubscribe = "subscribe"
+	HubVerifyAsync   = "async"
+	HubTopicFormat   = "https://www.youtube.com/xml/feeds/videos.xml?channel_id=%v"
+	HubYouTubeURL    = "https://pubsubhubbub.appspot.com/subscribe"
+	// Path of the feed callback relative to the callback base URL
+	HubCallbackPath = "/video"
 )
 
 var (
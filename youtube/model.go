@@ -16,6 +16,10 @@ type StreamInfo struct {
 	Title          string
 	IsUpcoming     bool
 	ScheduledStart time.Time
+	// Zero if unknown, search results of the poller do not include it
+	ActualStart time.Time
+	// When the bot learned about the stream from the feed or the poller
+	ReceivedAt time.Time
 }
 
 type Feed struct {
@@ -2,9 +2,10 @@ package youtube
 
 import (
 	"context"
-	"fmt"
 	ytApi "google.golang.org/api/youtube/v3"
+	"log/slog"
 	"time"
+	"youtube-stream-notifier-bot/logging"
 )
 
 const (
@@ -18,62 +19,101 @@ const (
 	videoType         = "video"
 )
 
-func (s *Service) PollStreams(channels <-chan ChannelInfo) <-chan StreamInfo {
+// PollStreams searches for live and upcoming streams of the channels.
+// The returned channel is closed when the channels are exhausted or the context is done.
+func (s *Service) PollStreams(ctx context.Context, channels <-chan ChannelInfo) <-chan StreamInfo {
 	streams := make(chan StreamInfo)
 	go func() {
 		defer close(streams)
 		for channel := range channels {
-			response, err := s.searchVideos(channel.Id, liveEventType)
+			response, err := s.searchVideos(ctx, channel.Id, liveEventType)
 			if err != nil {
-				fmt.Printf("error during search for live streams %v", err.Error())
+				logger().Error("unable to search for live streams", logging.ChannelId, channel.Id, logging.Err(err))
 				continue
 			}
 			for _, item := range response.Items {
-				streams <- StreamInfo{
+				stream := StreamInfo{
 					Id:         item.Id.VideoId,
 					Channel:    channel,
 					Title:      item.Snippet.Title,
 					IsUpcoming: false,
+					ReceivedAt: time.Now(),
+				}
+				if !emit(ctx, streams, stream) {
+					return
 				}
 			}
-			response, err = s.searchVideos(channel.Id, upcomingEventType)
+			response, err = s.searchVideos(ctx, channel.Id, upcomingEventType)
 			if err != nil {
-				fmt.Printf("error during search for upcoming streams %v", err.Error())
+				logger().Error("unable to search for upcoming streams", logging.ChannelId, channel.Id, logging.Err(err))
 				continue
 			}
 			for _, item := range response.Items {
-				upcomingBroadcast, err := s.getVideo(item.Id.VideoId, livestreamingDetailsPart)
+				upcomingBroadcast, err := s.getVideo(ctx, item.Id.VideoId, livestreamingDetailsPart)
 				if err != nil {
-					fmt.Printf("error during search for upcoming stream %v", err.Error())
+					logger().Error(
+						"unable to get upcoming stream",
+						logging.ChannelId, channel.Id,
+						logging.StreamId, item.Id.VideoId,
+						logging.Err(err),
+					)
 					continue
 				}
 				startTimeText := upcomingBroadcast.LiveStreamingDetails.ScheduledStartTime
 				startTime, err := parseTime(startTimeText)
 				if err != nil {
-					fmt.Printf("unable to parse time %v during search for upcoming stream", startTimeText)
+					logger().Error(
+						"unable to parse scheduled start time",
+						logging.StreamId, item.Id.VideoId,
+						"scheduled_start_time", startTimeText,
+						logging.Err(err),
+					)
 					continue
 				}
-				streams <- StreamInfo{
+				stream := StreamInfo{
 					Id:             item.Id.VideoId,
 					Channel:        channel,
 					Title:          item.Snippet.Title,
 					IsUpcoming:     true,
 					ScheduledStart: startTime,
+					ReceivedAt:     time.Now(),
+				}
+				if !emit(ctx, streams, stream) {
+					return
 				}
 			}
-			time.Sleep(pollDelay)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(pollDelay):
+			}
 		}
 	}()
 	return streams
 }
 
+// emit sends the stream unless the context is done first
+func emit(ctx context.Context, streams chan<- StreamInfo, stream StreamInfo) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case streams <- stream:
+		return true
+	}
+}
+
 func parseTime(timeText string) (time.Time, error) {
 	return time.Parse(time.RFC3339Nano, timeText)
 }
 
-func (s *Service) searchVideos(channelId string, eventType string) (*ytApi.SearchListResponse, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), searchTimeout)
+func (s *Service) searchVideos(
+	ctx context.Context,
+	channelId string,
+	eventType string,
+) (*ytApi.SearchListResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, searchTimeout)
 	defer cancel()
+	ctx, observe := observeCall(ctx, searchListMethod)
 	response, err := s.yt.Search.
 		List(snippetPart).
 		Context(ctx).
@@ -82,5 +122,10 @@ func (s *Service) searchVideos(channelId string, eventType string) (*ytApi.Searc
 		Type(videoType).
 		MaxResults(searchMaxResults).
 		Do()
+	observe(err)
 	return response, err
 }
+
+func logger() *slog.Logger {
+	return logging.For("youtube")
+}
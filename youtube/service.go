@@ -2,7 +2,6 @@ package youtube
 
 import (
 	"context"
-	"fmt"
 	"github.com/pkg/errors"
 	"google.golang.org/api/option"
 	ytApi "google.golang.org/api/youtube/v3"
@@ -32,8 +31,14 @@ type Service struct {
 	yt *ytApi.Service
 }
 
-func NewService(apiKey string) (*Service, error) {
-	service, err := ytApi.NewService(context.Background(), option.WithAPIKey(apiKey))
+// NewService creates YouTube Data API client.
+// apiURL overrides the API base URL, e.g. to use a local stand-in server; empty means the default.
+func NewService(ctx context.Context, apiKey string, apiURL string) (*Service, error) {
+	options := []option.ClientOption{option.WithAPIKey(apiKey)}
+	if len(apiURL) > 0 {
+		options = append(options, option.WithEndpoint(apiURL))
+	}
+	service, err := ytApi.NewService(ctx, options...)
 	if err != nil {
 		return nil, err
 	}
@@ -41,13 +46,13 @@ func NewService(apiKey string) (*Service, error) {
 }
 
 func (s *Service) FindChannel(ctx context.Context, url string) (ChannelInfo, error) {
-	call := s.yt.Channels.List(snippetPart).Context(ctx).MaxResults(1)
+	call := s.yt.Channels.List(snippetPart).MaxResults(1)
 	submatch := urlChannelPattern.FindStringSubmatch(url)
 	if submatch != nil {
 		channelId := submatch[channelIdIndex]
 		if len(channelId) > 0 {
 			call = call.Id(channelId)
-			return executeChannelSearch(call)
+			return executeChannelSearch(ctx, call)
 		}
 	}
 	submatch = urlVideoPattern.FindStringSubmatch(url)
@@ -56,7 +61,7 @@ func (s *Service) FindChannel(ctx context.Context, url string) (ChannelInfo, err
 	}
 	videoId := submatch[videoIdIndex]
 	if len(videoId) > 0 {
-		video, err := s.getVideo(videoId, snippetPart)
+		video, err := s.getVideo(ctx, videoId, snippetPart)
 		if err != nil {
 			return ChannelInfo{}, errors.Errorf("unable to get video by url: %v", err.Error())
 		}
@@ -69,12 +74,14 @@ func (s *Service) FindChannel(ctx context.Context, url string) (ChannelInfo, err
 }
 
 func (s *Service) FindChannelById(ctx context.Context, id string) (ChannelInfo, error) {
-	call := s.yt.Channels.List(snippetPart).Context(ctx).MaxResults(1).Id(id)
-	return executeChannelSearch(call)
+	call := s.yt.Channels.List(snippetPart).MaxResults(1).Id(id)
+	return executeChannelSearch(ctx, call)
 }
 
-func executeChannelSearch(call *ytApi.ChannelsListCall) (ChannelInfo, error) {
-	response, err := call.Do()
+func executeChannelSearch(ctx context.Context, call *ytApi.ChannelsListCall) (ChannelInfo, error) {
+	ctx, observe := observeCall(ctx, channelsListMethod)
+	response, err := call.Context(ctx).Do()
+	observe(err)
 	if err != nil {
 		return ChannelInfo{}, errors.Wrap(err, "error on calling youtube api")
 	}
@@ -83,7 +90,7 @@ func executeChannelSearch(call *ytApi.ChannelsListCall) (ChannelInfo, error) {
 		return ChannelInfo{}, errors.New("unable to find channel")
 	}
 	if len(items) > 1 {
-		fmt.Printf("unexpected item count (%v) during search for channel", len(items))
+		logger().Warn("unexpected item count during search for channel", "count", len(items))
 	}
 	channel := items[0]
 	if channel.Snippet == nil {
@@ -96,9 +103,9 @@ func executeChannelSearch(call *ytApi.ChannelsListCall) (ChannelInfo, error) {
 	return info, nil
 }
 
-func (s *Service) GetStreamInfo(videoId string) (StreamInfo, error) {
+func (s *Service) GetStreamInfo(ctx context.Context, videoId string) (StreamInfo, error) {
 	part := append(snippetPart, livestreamingDetailsPart...)
-	video, err := s.getVideo(videoId, part)
+	video, err := s.getVideo(ctx, videoId, part)
 	if err != nil {
 		return StreamInfo{}, err
 	}
@@ -116,6 +123,17 @@ func (s *Service) GetStreamInfo(videoId string) (StreamInfo, error) {
 	if broadcastContent != liveEventType && broadcastContent != upcomingEventType {
 		return StreamInfo{}, ErrNotStream
 	}
+	actualStart := time.Time{}
+	if broadcastContent == liveEventType && len(streamingDetails.ActualStartTime) > 0 {
+		actualStart, err = parseTime(streamingDetails.ActualStartTime)
+		if err != nil {
+			return StreamInfo{}, errors.Errorf(
+				"unable to parse actual start time: %v; source: %v",
+				err.Error(),
+				streamingDetails.ActualStartTime,
+			)
+		}
+	}
 	if broadcastContent == upcomingEventType {
 		isUpcoming = true
 		startTime, err = parseTime(streamingDetails.ScheduledStartTime)
@@ -136,17 +154,20 @@ func (s *Service) GetStreamInfo(videoId string) (StreamInfo, error) {
 		Title:          video.Snippet.Title,
 		IsUpcoming:     isUpcoming,
 		ScheduledStart: startTime,
+		ActualStart:    actualStart,
 	}, nil
 }
 
-func (s *Service) getVideo(videoId string, part []string) (*ytApi.Video, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), searchTimeout)
+func (s *Service) getVideo(ctx context.Context, videoId string, part []string) (*ytApi.Video, error) {
+	ctx, cancel := context.WithTimeout(ctx, searchTimeout)
 	defer cancel()
+	ctx, observe := observeCall(ctx, videosListMethod)
 	response, err := s.yt.Videos.
 		List(part).
 		Context(ctx).
 		Id(videoId).
 		Do()
+	observe(err)
 	if err != nil {
 		return nil, err
 	}
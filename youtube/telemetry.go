@@ -0,0 +1,24 @@
+package youtube
+
+import (
+	"context"
+	"youtube-stream-notifier-bot/metrics"
+	"youtube-stream-notifier-bot/tracing"
+)
+
+// Method names used in metrics and spans
+const (
+	channelsListMethod = "channels.list"
+	videosListMethod   = "videos.list"
+	searchListMethod   = "search.list"
+)
+
+// observeCall starts the span of YouTube Data API method call.
+// The returned function records the outcome in the span and metrics.
+func observeCall(ctx context.Context, method string) (context.Context, func(err error)) {
+	ctx, span := tracing.Start(ctx, "youtube "+method)
+	return ctx, func(err error) {
+		metrics.ObserveYouTubeCall(method, err)
+		tracing.End(span, err)
+	}
+}